@@ -73,7 +73,8 @@ type QuotedElement struct {
 
 // UnquotedArgument is CMake's standed unquoted command argument:
 // https://cmake.org/cmake/help/v3.0/manual/cmake-language.7.html#unquoted-argument
-// Note: The unquoted_legacy production mentioned above is *not* supported.
+// The unquoted_legacy production, e.g. -Da="b c", is lexed as a single Unquoted token by the lexer,
+// so embedded quotes and whitespace are retained as literal text within a single argument.
 type UnquotedArgument struct {
 	Elements []UnquotedElement `@@ ( @@ )*`
 }
@@ -97,7 +98,8 @@ type VariableReference struct {
 
 // VariableElement is either a run of text corresponding the a variable name
 // or a nested VariableReference.
+// Escape sequences, such as the `\}` in `${foo\}bar}`, are part of the name rather than closing the reference.
 type VariableElement struct {
-	Text string             `@( Identifier | Unquoted | Quoted )?`
+	Text string             `@( Identifier | Unquoted | Quoted | EscapeSequence )?`
 	Ref  *VariableReference `( @@ )?`
 }
@@ -18,12 +18,14 @@ package ast
 
 import (
 	"reflect"
+	"strings"
 	"testing"
 
 	"github.com/alecthomas/participle"
 	plex "github.com/alecthomas/participle/lexer"
 	"github.com/google/go-cmp/cmp"
 
+	"github.com/kythe/llvmbzlgen/cmakelib/bindings"
 	"github.com/kythe/llvmbzlgen/cmakelib/lexer"
 )
 
@@ -97,9 +99,11 @@ func TestVariableReferences(t *testing.T) {
 	tests := map[string]VariableReference{
 		`${VAR}`:                       varRef,
 		`$ENV{VAR}`:                    {Domain: DomainEnv, Elements: varRef.Elements},
+		`$CACHE{VAR}`:                  {Domain: DomainCache, Elements: varRef.Elements},
 		`${${VAR}}`:                    {Elements: []VariableElement{{Ref: &varRef}}},
 		`${pre_${VAR}_in_${VAR}_post}`: {Elements: []VariableElement{{"pre_", &varRef}, {"_in_", &varRef}, {Text: "_post"}}},
 		`${${VAR}_in_${VAR}}`:          {Elements: []VariableElement{{Ref: &varRef}, {"_in_", &varRef}}},
+		`${foo\}bar}`:                  {Elements: []VariableElement{{Text: "foo"}, {Text: `\}`}, {Text: "bar"}}},
 	}
 	for input, expected := range tests {
 		root, err := parseVariableReference(input)
@@ -126,6 +130,12 @@ func TestUnquotedArgument(t *testing.T) {
 		}},
 		// This is divided during evaluation, but is still a single argument.
 		`This;Divides;Into;Five;Arguments`: {Elements: []UnquotedElement{{Text: "This;Divides;Into;Five;Arguments"}}},
+		`Legacy"em bedded"Quotes`:          {Elements: []UnquotedElement{{Text: `Legacy"em bedded"Quotes`}}},
+		`-Da="${VAR} x"`: {Elements: []UnquotedElement{
+			{Text: `-Da="`},
+			{Ref: &VariableReference{Elements: []VariableElement{{Text: "VAR"}}}},
+			{Text: ` x"`},
+		}},
 	}
 	for input, expected := range tests {
 		root, err := parseUnquotedArgument(input)
@@ -168,8 +178,14 @@ func TestUnquotedEvaluation(t *testing.T) {
 		`This;Divides;Into;Five;Arguments`: {"This", "Divides", "Into", "Five", "Arguments"},
 		`Escaped\${VAR}Ref`:                {"Escaped${VAR}Ref"},
 		`;LeadingSemicolon`:                {"", "LeadingSemicolon"},
+		`Legacy"em bedded"Quotes`:          {`Legacy"em bedded"Quotes`},
+		`-Da="${VAR} x"`:                   {`-Da="VAR x"`},
+		`${foo\}bar}`:                      {"Brace"},
+		`${foo\}${VAR}}`:                   {"BraceVAR"},
 	}
 	vars := binder{
+		"foo}bar": "Brace",
+		"foo}VAR": "BraceVAR",
 		"VAR":     "VAR",
 		"LIST":    "A;List;Of;Items",
 		"ESCAPED": `Escaped\;Semicolon`,
@@ -184,6 +200,372 @@ func TestUnquotedEvaluation(t *testing.T) {
 	}
 }
 
+func TestCacheReference(t *testing.T) {
+	vars := bindings.New()
+	vars.Set("X", "scope")
+	vars.SetCache("X", "cache")
+	file, err := parseCMakeFile(`x($CACHE{X} ${X} "$CACHE{X}-${X}" ${$CACHE{NAME}})` + "\n")
+	if err != nil {
+		t.Fatal("Unexpected error parsing input: ", err)
+	}
+	vars.SetCache("NAME", "X")
+	expected := []string{"cache", "scope", "cache-scope", "scope"}
+	if diff := cmp.Diff(expected, file.Commands[0].Arguments.Eval(vars)); diff != "" {
+		t.Errorf("Unexpected evaluation:\n%s", diff)
+	}
+}
+
+func TestUndefinedVarErrors(t *testing.T) {
+	vars := bindings.New()
+	vars.Set("SET", "value")
+	vars.Set("EMPTY", "")
+	tests := map[string]string{
+		`x(${SET} ${EMPTY} "${EMPTY}")`:             "",
+		`x(${SET} ${UNSET})`:                        `1:10: undefined variable "UNSET"`,
+		`x("${${UNSET}}")`:                          `1:6: undefined variable "UNSET"`,
+		`x($ENV{UNSET} $CACHE{UNSET} [[${UNSET}]])`: "",
+	}
+	for input, expected := range tests {
+		file, err := parseCMakeFile(input + "\n")
+		if err != nil {
+			t.Fatalf("Unexpected error parsing %#v: %v", input, err)
+		}
+		ctx := NewEvalContext(vars)
+		ctx.UndefinedVarErrors = true
+		file.Commands[0].Arguments.EvalIn(ctx)
+		var actual string
+		if err := ctx.Err(); err != nil {
+			actual = err.Error()
+		}
+		if actual != expected {
+			t.Errorf("Expected %#v to report %#v, found %#v", input, expected, actual)
+		}
+
+		ctx = NewEvalContext(vars)
+		file.Commands[0].Arguments.EvalIn(ctx)
+		if err := ctx.Err(); err != nil {
+			t.Errorf("Unexpected error evaluating %#v without UndefinedVarErrors: %v", input, err)
+		}
+	}
+}
+
+func TestRawArguments(t *testing.T) {
+	file, err := parseCMakeFile(`add_subdirectory(${DIR}/lib "quoted ${VAR}\n" [=[bracket]=] $ENV{HOME} (nested ${$CACHE{X}}) Escaped\;Semi)` + "\n")
+	if err != nil {
+		t.Fatal("Unexpected error parsing input: ", err)
+	}
+	cmd := file.Commands[0]
+	raw := []string{"${DIR}/lib", `quoted ${VAR}\n`, "bracket", "$ENV{HOME}", "(nested ${$CACHE{X}})", `Escaped\;Semi`}
+	if diff := cmp.Diff(raw, cmd.RawArguments()); diff != "" {
+		t.Errorf("Unexpected raw arguments:\n%s", diff)
+	}
+	vars := binder{"DIR": "llvm", "VAR": "value", "HOME": "/home", "X": "X"}
+	evaluated := []string{"llvm/lib", "quoted value\n", "bracket", "/home", "(", "nested", "X", ")", "Escaped;Semi"}
+	if diff := cmp.Diff(evaluated, cmd.Arguments.Eval(vars)); diff != "" {
+		t.Errorf("Unexpected evaluated arguments:\n%s", diff)
+	}
+
+	// Make references are not parsed, but are closed appropriately when constructed.
+	makeCmd := &CommandInvocation{Name: "cmd", Arguments: ArgumentList{Values: []Argument{{
+		UnquotedArgument: &UnquotedArgument{Elements: []UnquotedElement{{
+			Ref: &VariableReference{Domain: DomainMake, Elements: []VariableElement{{Text: "X"}}},
+		}}},
+	}}}}
+	if diff := cmp.Diff([]string{"$(X)"}, makeCmd.RawArguments()); diff != "" {
+		t.Errorf("Unexpected raw arguments:\n%s", diff)
+	}
+}
+
+func TestQuotedEvaluation(t *testing.T) {
+	tests := map[string][]string{
+		`""`:                      {""},
+		`"\t"`:                    {"\t"},
+		`"\\"`:                    {`\`},
+		`"\$"`:                    {"$"},
+		`"\${VAR}"`:               {"${VAR}"},
+		`"Not;Divided"`:           {"Not;Divided"},
+		`"Mixed\t${VAR}\n${ESC}"`: {"Mixed\tVAR\n" + `Escaped\tValue`},
+		"\"cont\\\ninue\"":        {"continue"},      // Continuations are removed entirely.
+		"\"${VAR}\\\n${VAR}\"":    {"VARVAR"},        // Including between references.
+		"\"line\\\\\nbreak\"":     {"line\\\nbreak"}, // An escaped backslash does not continue.
+		`"${foo\}bar}"`:           {"Brace"},
+	}
+	vars := binder{
+		"foo}bar": "Brace",
+		"VAR":     "VAR",
+		"ESC":     `Escaped\tValue`,
+	}
+	for input, expected := range tests {
+		root, err := parseQuotedArgument(input)
+		if err != nil {
+			t.Errorf("Error parsing %#v: %s", input, err)
+		} else if diff := cmp.Diff(root.Eval(vars), expected); diff != "" {
+			t.Errorf("Unexpected evaluation %#v:\n%s", input, diff)
+		}
+	}
+}
+
+func TestAtReferences(t *testing.T) {
+	vars := binder{"X": "value", "Y": "a;b"}
+	tests := []struct {
+		input    string
+		enabled  bool
+		expected []string
+	}{
+		{`"${X} @X@"`, false, []string{"value @X@"}},
+		{`"${X} @X@"`, true, []string{"value value"}},
+		{`"\t@X@\n"`, true, []string{"\tvalue\n"}},
+		{`"@X@@Y@"`, true, []string{"valuea;b"}},
+		{`"user@example.com"`, true, []string{"user@example.com"}},
+		{`${X}@X@`, false, []string{"value@X@"}},
+		{`${X}@X@`, true, []string{"valuevalue"}},
+		{`@Y@`, true, []string{"a", "b"}},
+		{`[[@X@]]`, true, []string{"@X@"}},
+	}
+	for _, test := range tests {
+		args, err := parseArgumentList("(" + test.input + ")")
+		if err != nil {
+			t.Errorf("Error parsing %#v: %v", test.input, err)
+			continue
+		}
+		ctx := NewEvalContext(vars)
+		ctx.AtReferences = test.enabled
+		if diff := cmp.Diff(test.expected, args.EvalIn(ctx)); diff != "" {
+			t.Errorf("Unexpected evaluation of %#v with AtReferences=%v:\n%s", test.input, test.enabled, diff)
+		}
+	}
+}
+
+func TestListReferenceQuoting(t *testing.T) {
+	vars := binder{
+		"LIST": "a;b;c",
+		"NAME": "LIST",
+	}
+	tests := []struct {
+		input    string
+		expected []string
+	}{
+		{`("${LIST}")`, []string{"a;b;c"}},
+		{`(${LIST})`, []string{"a", "b", "c"}},
+		{`("${${NAME}}")`, []string{"a;b;c"}},
+		{`(${${NAME}})`, []string{"a", "b", "c"}},
+		{`("x${LIST}y" x${LIST}y)`, []string{"xa;b;cy", "xa", "b", "cy"}},
+	}
+	for _, test := range tests {
+		root, err := parseArgumentList(test.input)
+		if err != nil {
+			t.Errorf("Error parsing %#v: %s", test.input, err)
+		} else if diff := cmp.Diff(root.Eval(vars), test.expected); diff != "" {
+			t.Errorf("Unexpected evaluation %#v:\n%s", test.input, diff)
+		}
+	}
+}
+
+func TestEvalDepthLimit(t *testing.T) {
+	// By default, bound values are not themselves expanded, so a self-referential binding is harmless.
+	vars := binder{"A": "${A}"}
+	root, err := parseArgumentList("(${A})")
+	if err != nil {
+		t.Fatalf("Error parsing: %s", err)
+	}
+	if values, err := root.EvalLimit(vars, 1); err != nil {
+		t.Errorf("Unexpected error evaluating self-referential binding: %s", err)
+	} else if diff := cmp.Diff(values, []string{"${A}"}); diff != "" {
+		t.Errorf("Unexpected evaluation:\n%s", diff)
+	}
+
+	nested := "(" + strings.Repeat("${", DefaultMaxDepth+1) + "A" + strings.Repeat("}", DefaultMaxDepth+1) + ")"
+	root, err = parseArgumentList(nested)
+	if err != nil {
+		t.Fatalf("Error parsing nested references: %s", err)
+	}
+	if _, err := root.EvalLimit(vars, DefaultMaxDepth); err == nil {
+		t.Errorf("Expected error evaluating references nested %d deep", DefaultMaxDepth+1)
+	} else if _, ok := err.(*DepthError); !ok {
+		t.Errorf("Unexpected error type: %T", err)
+	}
+	if diff := cmp.Diff(root.Eval(vars), []string{""}); diff != "" {
+		t.Errorf("Unexpected evaluation:\n%s", diff)
+	}
+	if _, err := root.EvalLimit(vars, DefaultMaxDepth+1); err != nil {
+		t.Errorf("Unexpected error evaluating within the limit: %s", err)
+	}
+
+	// When values are expanded, a self-referential binding is bounded by the limit.
+	root, err = parseArgumentList("(${A} ${B})")
+	if err != nil {
+		t.Fatalf("Error parsing: %s", err)
+	}
+	ctx := &EvalContext{Bindings: binder{"A": "${A}${A}", "B": "\"${C}\"", "C": "c"}, ExpandValues: true}
+	values := root.EvalIn(ctx)
+	if _, ok := ctx.Err().(*DepthError); !ok {
+		t.Errorf("Expected DepthError evaluating self-referential binding, found %v", ctx.Err())
+	}
+	if diff := cmp.Diff(values[1:], []string{`"c"`}); diff != "" {
+		t.Errorf("Unexpected evaluation:\n%s", diff)
+	}
+}
+
+func TestEvalContext(t *testing.T) {
+	root, err := parseArgumentList(`(${${A}} "\t${B}" \;)`)
+	if err != nil {
+		t.Fatalf("Error parsing: %s", err)
+	}
+	vars := binder{"A": "B", "B": "C"}
+
+	ctx := NewEvalContext(vars)
+	if diff := cmp.Diff(root.EvalIn(ctx), []string{"C", "\tC", ";"}); diff != "" {
+		t.Errorf("Unexpected evaluation:\n%s", diff)
+	}
+	if err := ctx.Err(); err != nil {
+		t.Errorf("Unexpected error: %s", err)
+	}
+
+	ctx = &EvalContext{Bindings: vars, MaxDepth: 1}
+	if diff := cmp.Diff(root.EvalIn(ctx), []string{"", "\tC", ";"}); diff != "" {
+		t.Errorf("Unexpected evaluation:\n%s", diff)
+	}
+	if diff := cmp.Diff(ctx.Errors, []error{&DepthError{Limit: 1}}); diff != "" {
+		t.Errorf("Unexpected errors:\n%s", diff)
+	}
+
+	ctx = &EvalContext{Bindings: vars, KeepEscapes: true}
+	if diff := cmp.Diff(root.EvalIn(ctx), []string{"C", `\tC`, `\;`}); diff != "" {
+		t.Errorf("Unexpected evaluation:\n%s", diff)
+	}
+}
+
+func TestStrictEscapes(t *testing.T) {
+	root, err := parseArgumentList(`(\t "a\;b" \q "\(\ \$")`)
+	if err != nil {
+		t.Fatalf("Error parsing: %s", err)
+	}
+	ctx := NewEvalContext(binder{})
+	if diff := cmp.Diff(root.EvalIn(ctx), []string{"\t", "a;b", "q", "( $"}); diff != "" {
+		t.Errorf("Unexpected evaluation:\n%s", diff)
+	}
+	if err := ctx.Err(); err != nil {
+		t.Errorf("Unexpected error: %s", err)
+	}
+
+	ctx = &EvalContext{Bindings: binder{}, StrictEscapes: true}
+	if diff := cmp.Diff(root.EvalIn(ctx), []string{"\t", "a;b", "q", "( $"}); diff != "" {
+		t.Errorf("Unexpected evaluation:\n%s", diff)
+	}
+	expected := []error{&EscapeError{Pos: plex.Position{Offset: 11, Line: 1, Column: 12}, Sequence: `\q`}}
+	if diff := cmp.Diff(expected, ctx.Errors); diff != "" {
+		t.Errorf("Unexpected errors:\n%s", diff)
+	}
+	if msg := `1:12: unknown escape sequence "\\q"`; ctx.Err() == nil || ctx.Err().Error() != msg {
+		t.Errorf("Expected error %#v, found %v", msg, ctx.Err())
+	}
+}
+
+func TestNestedReferenceEvaluation(t *testing.T) {
+	vars := MapBindings{
+		"NAME":         "Support",
+		"KIND":         "NAME",
+		"LLVMSupport":  "lib",
+		"lib_DIR":      "llvm/lib",
+		"EMPTY":        "",
+		"TARGET_X86":   "X86",
+		"PREFIX":       "TARGET_",
+		"SUFFIX":       "X86",
+		"LIST":         "a;b",
+		"PATH_SUPPORT": "${NOT_EXPANDED}",
+	}
+	tests := map[string][]string{
+		"${${KIND}}":                {"Support"},
+		"${${LLVM${NAME}}_DIR}":     {"llvm/lib"},
+		"${${PREFIX}${SUFFIX}}":     {"X86"},
+		"${UNDEFINED}${EMPTY}":      {""},
+		"${${UNDEFINED}}":           {""},
+		"\"${LIST}\"":               {"a;b"},
+		"${LIST}":                   {"a", "b"},
+		"$CACHE{NAME}$ENV{${KIND}}": {"SupportSupport"},
+		"${PATH_SUPPORT}":           {"${NOT_EXPANDED}"},
+		"pre${${KIND}}post":         {"preSupportpost"},
+	}
+	for input, expected := range tests {
+		root, err := parseArgumentList("(" + input + ")")
+		if err != nil {
+			t.Errorf("Error parsing %#v: %s", input, err)
+			continue
+		}
+		if diff := cmp.Diff(expected, root.Eval(vars)); diff != "" {
+			t.Errorf("Unexpected evaluation of %#v:\n%s", input, diff)
+		}
+	}
+}
+
+func TestNestedArgumentListEvaluation(t *testing.T) {
+	tests := map[string][]string{
+		"directive(A (B (C)) D)":       {"A", "(", "B", "(", "C", ")", ")", "D"},
+		"directive( A(B(C))D )":        {"A", "(", "B", "(", "C", ")", ")", "D"},
+		"directive(\n(\n  A\n)\n)":     {"(", "A", ")"},
+		"directive(() ( ) ${X}(${X}))": {"(", ")", "(", ")", "x", "(", "x", ")"},
+	}
+	for input, expected := range tests {
+		root, err := parseCMakeFile(input)
+		if err != nil {
+			t.Errorf("Error parsing %#v: %s", input, err)
+		} else if diff := cmp.Diff(root.Commands[0].Arguments.Eval(binder{"X": "x"}), expected); diff != "" {
+			t.Errorf("Unexpected evaluation %#v:\n%s", input, diff)
+		}
+	}
+}
+
+func TestVarDomainCapture(t *testing.T) {
+	tests := map[string]VarDomain{
+		"${":      DomainDefault,
+		"$CACHE{": DomainCache,
+		"$ENV{":   DomainEnv,
+		"ENV":     DomainEnv,
+		"":        DomainDefault,
+	}
+	for value, expected := range tests {
+		var d VarDomain
+		if err := d.Capture([]string{value}); err != nil {
+			t.Errorf("Unexpected error capturing %#v: %v", value, err)
+		} else if d != expected {
+			t.Errorf("Expected %#v to capture %v, found %v", value, expected, d)
+		}
+	}
+
+	for _, values := range [][]string{nil, {}, {"$"}, {"$ENV"}, {"$ENV}"}, {"$OTHER{"}, {"${", "${"}} {
+		var d VarDomain
+		if err := d.Capture(values); err == nil {
+			t.Errorf("Expected error capturing %#v, found %v", values, d)
+		}
+	}
+}
+
+func TestVarDomainSyntax(t *testing.T) {
+	// Make variables are not lexed as references, so only the remaining domains round-trip through a parse.
+	for _, d := range []VarDomain{DomainDefault, DomainCache, DomainEnv} {
+		input := d.Syntax() + "VAR}"
+		ref, err := parseVariableReference(input)
+		if err != nil {
+			t.Errorf("Error parsing %#v: %v", input, err)
+		} else if ref.Domain != d {
+			t.Errorf("Expected %#v to parse as %v, found %v", input, d, ref.Domain)
+		}
+
+		var captured VarDomain
+		if err := captured.Capture([]string{d.Syntax()}); err != nil {
+			t.Errorf("Unexpected error capturing %#v: %v", d.Syntax(), err)
+		} else if captured != d {
+			t.Errorf("Expected %#v to capture %v, found %v", d.Syntax(), d, captured)
+		}
+	}
+	if got := DomainMake.Syntax(); got != "$(" {
+		t.Errorf("Expected %v syntax %#v, found %#v", DomainMake, "$(", got)
+	}
+	if got := DomainMake.Closing(); got != ")" {
+		t.Errorf("Expected %v closing %#v, found %#v", DomainMake, ")", got)
+	}
+}
+
 func TestBracketArgument(t *testing.T) {
 	tests := map[string]string{
 		`[[]]`:                         ``,                   // Empty
@@ -328,3 +710,32 @@ func TestCMakeFile(t *testing.T) {
 		}
 	}
 }
+
+func TestParseKeywordArgs(t *testing.T) {
+	keywords := []string{"SOURCES", "DEPENDS", "LINK_COMPONENTS"}
+	tests := []struct {
+		args     []string
+		expected map[string][]string
+	}{
+		{
+			[]string{"LLVMFoo", "SHARED", "SOURCES", "a.cpp", "b.cpp", "DEPENDS", "c"},
+			map[string][]string{"": {"LLVMFoo", "SHARED"}, "SOURCES": {"a.cpp", "b.cpp"}, "DEPENDS": {"c"}},
+		},
+		// Repeated keywords have their values concatenated.
+		{
+			[]string{"SOURCES", "a.cpp", "DEPENDS", "c", "SOURCES", "b.cpp"},
+			map[string][]string{"SOURCES": {"a.cpp", "b.cpp"}, "DEPENDS": {"c"}},
+		},
+		// Unknown tokens belong to the preceding keyword and keywords may be empty.
+		{
+			[]string{"name", "LINK_COMPONENTS", "DEPENDS", "c", "UNKNOWN", "d"},
+			map[string][]string{"": {"name"}, "LINK_COMPONENTS": {}, "DEPENDS": {"c", "UNKNOWN", "d"}},
+		},
+		{nil, map[string][]string{}},
+	}
+	for _, test := range tests {
+		if diff := cmp.Diff(test.expected, ParseKeywordArgs(test.args, keywords)); diff != "" {
+			t.Errorf("Unexpected sections for %#v:\n%s", test.args, diff)
+		}
+	}
+}
@@ -24,3 +24,34 @@ type Bindings interface {
 	GetCache(string) string // Returns the named CMake variable from the cache.
 	GetEnv(string) string   // Returns the named Environment variable.
 }
+
+// DefinedBindings is implemented by Bindings which distinguish unset variables from those set to the empty string.
+type DefinedBindings interface {
+	Bindings
+	IsSet(string) bool // Returns true if the named CMake variable is set, even if empty.
+}
+
+// MapBindings is a Bindings which resolves variables from a single flat map,
+// regardless of whether they are referenced as normal, cache or environment variables.
+type MapBindings map[string]string
+
+// Get implements Bindings for MapBindings.
+func (m MapBindings) Get(key string) string {
+	return m[key]
+}
+
+// GetCache implements Bindings for MapBindings.
+func (m MapBindings) GetCache(key string) string {
+	return m[key]
+}
+
+// GetEnv implements Bindings for MapBindings.
+func (m MapBindings) GetEnv(key string) string {
+	return m[key]
+}
+
+// IsSet implements DefinedBindings for MapBindings.
+func (m MapBindings) IsSet(key string) bool {
+	_, ok := m[key]
+	return ok
+}
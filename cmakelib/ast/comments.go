@@ -0,0 +1,48 @@
+/*
+ * Copyright 2019 The Kythe Authors. All rights reserved.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *   http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package ast
+
+import (
+	plex "github.com/alecthomas/participle/lexer"
+	"github.com/kythe/llvmbzlgen/cmakelib/lexer"
+)
+
+// CommentMap associates comment tokens with the command invocation which follows them.
+// Comments which follow the final command are associated with the nil key.
+type CommentMap map[*CommandInvocation][]plex.Token
+
+// AssociateComments associates each of the Comment and BracketComment tokens, as
+// produced by a lexer configured with lexer.RetainComments, with the nearest following
+// command invocation in file. Other tokens are ignored.
+func AssociateComments(file *CMakeFile, tokens []plex.Token) CommentMap {
+	comments := make(CommentMap)
+	i := 0
+	for _, tok := range tokens {
+		if tok.Type != lexer.Comment && tok.Type != lexer.BracketComment {
+			continue
+		}
+		for i < len(file.Commands) && file.Commands[i].Pos.Offset < tok.Pos.Offset {
+			i++
+		}
+		var cmd *CommandInvocation
+		if i < len(file.Commands) {
+			cmd = &file.Commands[i]
+		}
+		comments[cmd] = append(comments[cmd], tok)
+	}
+	return comments
+}
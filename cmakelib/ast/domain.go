@@ -16,7 +16,11 @@
 
 package ast
 
-import "fmt"
+import (
+	"errors"
+	"fmt"
+	"strings"
+)
 
 // Constants defining the recognized valid variable domains.
 const (
@@ -30,12 +34,20 @@ const (
 type VarDomain int
 
 // Capture translates a sequence of values into the appropriate variable domain.
+// The value is either the bare domain name or a variable reference opening, such as "$ENV{".
 func (d *VarDomain) Capture(values []string) error {
-	if len(values) > 1 {
+	switch len(values) {
+	case 0:
+		return errors.New("missing Domain value")
+	case 1:
+	default:
 		return fmt.Errorf("invalid Domain values: %v", values)
 	}
 	value := values[0]
-	if len(value) > 0 && value[0] == '$' {
+	if strings.HasPrefix(value, "$") {
+		if len(value) < 2 || !strings.HasSuffix(value, "{") {
+			return fmt.Errorf("unterminated Domain: %q", value)
+		}
 		value = value[1 : len(value)-1]
 	}
 	switch value {
@@ -67,3 +79,29 @@ func (d VarDomain) String() string {
 
 	}
 }
+
+// Syntax returns the source-level opening of a variable reference in the domain, such as "$ENV{",
+// suitable for reconstructing the reference and accepted by Capture for all but DomainMake.
+func (d VarDomain) Syntax() string {
+	switch d {
+	case DomainDefault:
+		return "${"
+	case DomainEnv:
+		return "$ENV{"
+	case DomainCache:
+		return "$CACHE{"
+	case DomainMake:
+		return "$("
+	default:
+		panic("invalid domain")
+	}
+}
+
+// Closing returns the source-level closing of a variable reference in the domain,
+// which is ")" for DomainMake and "}" otherwise.
+func (d VarDomain) Closing() string {
+	if d == DomainMake {
+		return ")"
+	}
+	return "}"
+}
@@ -20,36 +20,180 @@ import (
 	"fmt"
 	"regexp"
 	"strings"
+
+	"github.com/alecthomas/participle/lexer"
 )
 
 var (
 	escapePattern = regexp.MustCompile(`\\.`)
 	splitPattern  = regexp.MustCompile(`^;|[^\\];`)
+	atRefPattern  = regexp.MustCompile(`@[A-Za-z0-9_/.+-]+@`)
 )
 
+// DefaultMaxDepth is the default limit on the nesting of variable references during evaluation,
+// including references expanded from variable values when evaluating with ExpandValues.
+const DefaultMaxDepth = 128
+
+// DepthError is returned when variable references are nested more deeply than the evaluation limit.
+type DepthError struct {
+	Limit int
+}
+
+// Error implements the error interface for DepthError.
+func (e *DepthError) Error() string {
+	return fmt.Sprintf("variable references nested more than %d deep", e.Limit)
+}
+
+// EscapeError is returned for escape sequences not recognized by CMake when evaluating with StrictEscapes.
+type EscapeError struct {
+	Pos      lexer.Position // The position of the argument containing the sequence.
+	Sequence string
+}
+
+// Error implements the error interface for EscapeError.
+func (e *EscapeError) Error() string {
+	return lexer.FormatError(e.Pos, fmt.Sprintf("unknown escape sequence %q", e.Sequence))
+}
+
+// UndefinedError is returned for references to unset variables when evaluating with UndefinedVarErrors.
+// Only ${} references are checked, and only if the Bindings implement DefinedBindings,
+// as variables set to the empty string are otherwise indistinguishable.
+type UndefinedError struct {
+	Pos  lexer.Position // The position of the variable reference.
+	Name string
+}
+
+// Error implements the error interface for UndefinedError.
+func (e *UndefinedError) Error() string {
+	return lexer.FormatError(e.Pos, fmt.Sprintf("undefined variable %q", e.Name))
+}
+
+// EvalContext carries the bindings and options used when evaluating arguments,
+// along with any errors encountered.
+type EvalContext struct {
+	Bindings
+	MaxDepth           int     // The maximum nesting of variable references; DefaultMaxDepth if zero.
+	KeepEscapes        bool    // If true, escape sequences are left in the evaluated text.
+	StrictEscapes      bool    // If true, escape sequences unknown to CMake are reported as an EscapeError.
+	AtReferences       bool    // If true, @VAR@ references in literal text are also resolved, as in configure_file templates.
+	UndefinedVarErrors bool    // If true, references to unset variables are reported as an UndefinedError.
+	ExpandValues       bool    // If true, references within the values of ${} and $CACHE{} references are also resolved.
+	Errors             []error // Errors accumulated during evaluation.
+	depth              int
+	expanding          int            // The nesting of values being expanded.
+	abandoned          bool           // True if the limit was exceeded while expanding values, so expansion is abandoned.
+	pos                lexer.Position // The position of the argument being evaluated.
+}
+
+// NewEvalContext returns an EvalContext with default options resolving references using vars.
+func NewEvalContext(vars Bindings) *EvalContext {
+	return &EvalContext{Bindings: vars}
+}
+
+// Err returns the first error encountered during evaluation, if any.
+func (c *EvalContext) Err() error {
+	if len(c.Errors) == 0 {
+		return nil
+	}
+	return c.Errors[0]
+}
+
+func (c *EvalContext) maxDepth() int {
+	if c.MaxDepth == 0 {
+		return DefaultMaxDepth
+	}
+	return c.MaxDepth
+}
+
+func (c *EvalContext) unescape(text string) string {
+	if c.StrictEscapes {
+		for _, m := range escapePattern.FindAllString(text, -1) {
+			if !knownEscape(m[1]) {
+				c.Errors = append(c.Errors, &EscapeError{c.pos, m})
+			}
+		}
+	}
+	if c.KeepEscapes {
+		return text
+	}
+	return replaceEscapes(text)
+}
+
+// expandAtReferences replaces any @VAR@ references in text with their values, if enabled,
+// applying literal to the remaining text.
+func (c *EvalContext) expandAtReferences(text string, literal func(string) string) string {
+	if !c.AtReferences {
+		return literal(text)
+	}
+	var b strings.Builder
+	var start int
+	for _, m := range atRefPattern.FindAllStringIndex(text, -1) {
+		b.WriteString(literal(text[start:m[0]]))
+		b.WriteString(c.Get(text[m[0]+1 : m[1]-1]))
+		start = m[1]
+	}
+	b.WriteString(literal(text[start:]))
+	return b.String()
+}
+
+// knownEscape returns true if the character following a backslash forms one of the
+// escape sequences recognized by CMake: an encoded \t, \r or \n, or an escaped
+// character which is neither alphanumeric nor a semicolon, which is handled when splitting lists.
+func knownEscape(c byte) bool {
+	switch {
+	case c == 't', c == 'r', c == 'n', c == ';':
+		return true
+	case c >= 'a' && c <= 'z', c >= 'A' && c <= 'Z', c >= '0' && c <= '9':
+		return false
+	}
+	return true
+}
+
 // Eval uses the provided bindings to resolve any variable references and returns a slice
 // corresponding to the argument values.
+// Nested argument lists are flattened into the result, delimited by "(" and ")" values,
+// so `A (B (C)) D` evaluates to ["A", "(", "B", "(", "C", ")", ")", "D"].
+// Variable references nested more than DefaultMaxDepth deep evaluate to the empty string.
 func (a *ArgumentList) Eval(vars Bindings) []string {
+	return a.EvalIn(NewEvalContext(vars))
+}
+
+// EvalLimit evaluates the arguments as Eval does, but returns an error if variable references
+// are nested more than limit deep.
+func (a *ArgumentList) EvalLimit(vars Bindings, limit int) ([]string, error) {
+	ctx := &EvalContext{Bindings: vars, MaxDepth: limit}
+	values := a.EvalIn(ctx)
+	return values, ctx.Err()
+}
+
+// EvalIn evaluates the arguments as Eval does, using the bindings and options in ctx.
+func (a *ArgumentList) EvalIn(ctx *EvalContext) []string {
 	var values []string
 	for _, arg := range a.Values {
-		values = append(values, arg.Eval(vars)...)
+		values = append(values, arg.EvalIn(ctx)...)
 	}
 	return values
 }
 
 // Eval returns a slice of argument values after resolving variable references from vars.
 func (a *Argument) Eval(vars Bindings) []string {
+	return a.EvalIn(NewEvalContext(vars))
+}
+
+// EvalIn evaluates the argument as Eval does, using the bindings and options in ctx.
+func (a *Argument) EvalIn(ctx *EvalContext) []string {
+	ctx.pos = a.Pos
 	switch {
 	case a.QuotedArgument != nil:
-		return a.QuotedArgument.Eval(vars)
+		return a.QuotedArgument.EvalIn(ctx)
 	case a.UnquotedArgument != nil:
-		return a.UnquotedArgument.Eval(vars)
+		return a.UnquotedArgument.EvalIn(ctx)
 	case a.BracketArgument != nil:
-		return a.BracketArgument.Eval(vars)
+		return a.BracketArgument.EvalIn(ctx)
 	case a.ArgumentList != nil:
 		// Include the parens, but only for nested argument lists.
 		values := []string{"("}
-		values = append(values, a.ArgumentList.Eval(vars)...)
+		values = append(values, a.ArgumentList.EvalIn(ctx)...)
 		return append(values, ")")
 	}
 	panic("Missing concrete argument!")
@@ -58,72 +202,153 @@ func (a *Argument) Eval(vars Bindings) []string {
 // Eval returns a slice of argument values after resolving variable references from vars.
 // Semi-colon delimited lists are not separated.
 func (a *QuotedArgument) Eval(vars Bindings) []string {
+	return a.EvalIn(NewEvalContext(vars))
+}
+
+// EvalIn evaluates the argument as Eval does, using the bindings and options in ctx.
+func (a *QuotedArgument) EvalIn(ctx *EvalContext) []string {
 	var parts []string
 	for _, e := range a.Elements {
-		parts = append(parts, e.Eval(vars)...)
+		parts = append(parts, e.EvalIn(ctx)...)
 	}
-	return []string{replaceEscapes(strings.Join(parts, ""))}
+	return []string{strings.Join(parts, "")}
 }
 
 // Eval returns a slice of values after resolving variable references using vars.
+// Escape sequences in the literal text are replaced, but those in variable values are not.
 func (e *QuotedElement) Eval(vars Bindings) []string {
+	return e.EvalIn(NewEvalContext(vars))
+}
+
+// EvalIn evaluates the element as Eval does, using the bindings and options in ctx.
+func (e *QuotedElement) EvalIn(ctx *EvalContext) []string {
 	if e.Ref != nil {
-		return e.Ref.Eval(vars)
+		return e.Ref.EvalIn(ctx)
 	}
-	return []string{e.Text}
+	return []string{ctx.expandAtReferences(e.Text, ctx.unescape)}
 }
 
 // Eval returns a slice of argument values after resolving variable references from vars.
 // Semi-colon delimited lists are separated.
 func (a *UnquotedArgument) Eval(vars Bindings) []string {
+	return a.EvalIn(NewEvalContext(vars))
+}
+
+// EvalIn evaluates the argument as Eval does, using the bindings and options in ctx.
+func (a *UnquotedArgument) EvalIn(ctx *EvalContext) []string {
 	var parts []string
 	for _, e := range a.Elements {
-		parts = append(parts, e.Eval(vars)...)
+		parts = append(parts, e.EvalIn(ctx)...)
 	}
-	return splitAndUnescape(strings.Join(parts, ""))
+	return splitAndUnescape(strings.Join(parts, ""), ctx.unescape)
 }
 
 // Eval returns a slice of values after evaluating escape sequences
 // and splitting on semicolons.
 func (e *UnquotedElement) Eval(vars Bindings) []string {
+	return e.EvalIn(NewEvalContext(vars))
+}
+
+// EvalIn evaluates the element as Eval does, using the bindings and options in ctx.
+func (e *UnquotedElement) EvalIn(ctx *EvalContext) []string {
 	if e.Ref != nil {
-		return e.Ref.Eval(vars)
+		return e.Ref.EvalIn(ctx)
 	}
-	return []string{e.Text}
+	return []string{ctx.expandAtReferences(e.Text, identity)}
+}
+
+func identity(text string) string {
+	return text
 }
 
 // Eval returns a slice of values for the text of the argument.
 func (a *BracketArgument) Eval(vars Bindings) []string {
+	return a.EvalIn(NewEvalContext(vars))
+}
+
+// EvalIn evaluates the argument as Eval does, using the bindings and options in ctx.
+func (a *BracketArgument) EvalIn(ctx *EvalContext) []string {
 	return []string{a.Text}
 }
 
 // Eval recursively resolves variable references using vars and returns the result.
 func (v *VariableReference) Eval(vars Bindings) []string {
+	return v.EvalIn(NewEvalContext(vars))
+}
+
+// EvalIn evaluates the reference as Eval does, using the bindings and options in ctx.
+func (v *VariableReference) EvalIn(ctx *EvalContext) []string {
+	if ctx.depth >= ctx.maxDepth() {
+		ctx.Errors = append(ctx.Errors, &DepthError{ctx.maxDepth()})
+		ctx.abandoned = ctx.expanding > 0
+		return []string{""}
+	}
+	ctx.depth++
+	defer func() { ctx.depth-- }()
 	var name []string
 	for _, e := range v.Elements {
-		name = append(name, e.Eval(vars)...)
+		name = append(name, e.EvalIn(ctx)...)
 	}
 	var get func(string) string
 	switch v.Domain {
 	case DomainDefault:
-		get = vars.Get
+		get = ctx.Get
+		if defined, ok := ctx.Bindings.(DefinedBindings); ok && ctx.UndefinedVarErrors {
+			get = func(key string) string {
+				if !defined.IsSet(key) {
+					ctx.Errors = append(ctx.Errors, &UndefinedError{v.Pos, key})
+				}
+				return defined.Get(key)
+			}
+		}
 	case DomainCache:
-		get = vars.GetCache
+		get = ctx.GetCache
 	case DomainEnv:
-		get = vars.GetEnv
+		get = ctx.GetEnv
 	case DomainMake:
 		fallthrough
 	default:
 		panic(fmt.Sprintf("unrecognized domain: %#v", v.Domain))
 	}
-	return []string{get(strings.Join(name, ""))}
+	value := get(strings.Join(name, ""))
+	if ctx.ExpandValues && v.Domain != DomainEnv {
+		value = ctx.expandValue(value)
+	}
+	return []string{value}
+}
+
+// expandValue evaluates value as a quoted argument, within the depth of the reference from which it was retrieved,
+// so that a value which refers to itself results in a DepthError rather than unbounded recursion.
+// Once the limit is exceeded, the remaining values are left unexpanded until the outermost expansion completes,
+// as a value such as "${A}${A}" would otherwise be expanded exponentially many times.
+func (c *EvalContext) expandValue(value string) string {
+	if c.abandoned || !strings.ContainsAny(value, "$@\\") {
+		return value
+	}
+	arg, err := ParseQuoted(value)
+	if err != nil {
+		c.Errors = append(c.Errors, err)
+		return value
+	}
+	c.expanding++
+	value = arg.EvalIn(c)[0]
+	if c.expanding--; c.expanding == 0 {
+		c.abandoned = false
+	}
+	return value
 }
 
 // Eval recursively resolves variable references using vars and returns the result.
+// Escape sequences in the name are always replaced, so `${foo\}bar}` refers to the variable "foo}bar".
 func (v *VariableElement) Eval(vars Bindings) []string {
-	parts := []string{v.Text}
+	return v.EvalIn(NewEvalContext(vars))
+}
+
+// EvalIn evaluates the element as Eval does, using the bindings and options in ctx.
+func (v *VariableElement) EvalIn(ctx *EvalContext) []string {
+	parts := []string{replaceEscapes(v.Text)}
 	if v.Ref != nil {
-		for _, p := range v.Ref.Eval(vars) {
+		for _, p := range v.Ref.EvalIn(ctx) {
 			parts = append(parts, p)
 		}
 	}
@@ -146,13 +371,14 @@ func replaceEscapes(text string) string {
 	})
 }
 
-// splitAndUnescape splits the provided text on non-escaped semi-colons and replaces escape sequences.
-func splitAndUnescape(text string) []string {
+// splitAndUnescape splits the provided text on non-escaped semi-colons and replaces escape sequences
+// using unescape.
+func splitAndUnescape(text string, unescape func(string) string) []string {
 	var start int
 	var result []string
 	for _, m := range splitPattern.FindAllStringIndex(text, -1) {
-		result = append(result, replaceEscapes(text[start:m[1]-1]))
+		result = append(result, unescape(text[start:m[1]-1]))
 		start = m[1]
 	}
-	return append(result, replaceEscapes(text[start:len(text)]))
+	return append(result, unescape(text[start:len(text)]))
 }
@@ -0,0 +1,41 @@
+/*
+ * Copyright 2019 The Kythe Authors. All rights reserved.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *   http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package ast
+
+// ParseKeywordArgs groups the evaluated arguments into sections delimited by the provided keywords,
+// as used by commands like add_llvm_library(name SOURCES a b DEPENDS c).
+// Arguments preceding the first keyword are grouped under the empty string.
+// Each keyword present in args has an entry, possibly empty, and the values of repeated keywords are concatenated.
+func ParseKeywordArgs(args []string, keywords []string) map[string][]string {
+	isKeyword := make(map[string]bool, len(keywords))
+	for _, kw := range keywords {
+		isKeyword[kw] = true
+	}
+	sections := make(map[string][]string)
+	section := ""
+	for _, arg := range args {
+		if isKeyword[arg] {
+			section = arg
+			if _, ok := sections[section]; !ok {
+				sections[section] = []string{}
+			}
+			continue
+		}
+		sections[section] = append(sections[section], arg)
+	}
+	return sections
+}
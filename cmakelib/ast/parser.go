@@ -17,7 +17,11 @@
 package ast
 
 import (
+	"fmt"
 	"io"
+	"reflect"
+	"strings"
+	"sync"
 
 	"github.com/alecthomas/participle"
 	"github.com/kythe/llvmbzlgen/cmakelib/lexer"
@@ -29,9 +33,24 @@ type Parser struct {
 	p *participle.Parser
 }
 
+var (
+	buildOnce sync.Once
+	grammar   *participle.Parser
+)
+
+// sharedParser returns the compiled participle grammar, building it on first use.
+// The compiled grammar is immutable and safe to share among goroutines.
+func sharedParser() *participle.Parser {
+	buildOnce.Do(func() {
+		grammar = participle.MustBuild(&CMakeFile{}, participle.Lexer(lexer.New()))
+	})
+	return grammar
+}
+
 // NewParser constructs a new parser for CMakeLists-style files.
+// Parsers share a single underlying grammar and may be used concurrently.
 func NewParser() *Parser {
-	return &Parser{participle.MustBuild(&CMakeFile{}, participle.Lexer(lexer.New()))}
+	return &Parser{sharedParser()}
 }
 
 // Parse reads a CMakeLists.txt file from r and parses it into an AST.
@@ -52,7 +71,75 @@ func (p *Parser) ParseBytes(b []byte) (*CMakeFile, error) {
 	return cmf, p.p.ParseBytes(b, cmf)
 }
 
+// ParseQuoted parses text as the content of a quoted argument, so that it may be evaluated
+// with any variable references or escape sequences it contains.
+// Unlike in CMake source, unescaped double quotes within text are taken literally.
+func ParseQuoted(text string) (*QuotedArgument, error) {
+	cmf := &CMakeFile{}
+	if err := sharedParser().ParseString("quoted(\""+escapeQuotes(text)+"\")\n", cmf); err != nil {
+		return nil, err
+	}
+	if len(cmf.Commands) != 1 || len(cmf.Commands[0].Arguments.Values) != 1 {
+		return nil, fmt.Errorf("unable to parse %q as a quoted argument", text)
+	}
+	return cmf.Commands[0].Arguments.Values[0].QuotedArgument, nil
+}
+
+// escapeQuotes escapes each double quote in text which is not already escaped,
+// so that text may be enclosed in a quoted argument.
+func escapeQuotes(text string) string {
+	var b strings.Builder
+	escaped := false
+	for _, r := range text {
+		if r == '"' && !escaped {
+			b.WriteByte('\\')
+		}
+		escaped = r == '\\' && !escaped
+		b.WriteRune(r)
+	}
+	return b.String()
+}
+
 // String returns a string corresponding to the CMakeLists grammar.
 func (p *Parser) String() string {
 	return p.p.String()
 }
+
+// Grammar returns an EBNF-like description of the CMakeLists grammar accepted by Parser,
+// with one production per AST node, starting from CMakeFile.
+// Terminals are the token types of the lexer. Unlike String, nested nodes are referenced by name.
+func Grammar() string {
+	var b strings.Builder
+	seen := map[reflect.Type]bool{}
+	queue := []reflect.Type{reflect.TypeOf(CMakeFile{})}
+	for len(queue) > 0 {
+		t := queue[0]
+		queue = queue[1:]
+		if seen[t] {
+			continue
+		}
+		seen[t] = true
+		var exprs []string
+		for i := 0; i < t.NumField(); i++ {
+			field := t.Field(i)
+			tag := field.Tag.Get("parser")
+			if tag == "" {
+				tag = string(field.Tag)
+			}
+			if tag == "" {
+				continue
+			}
+			elem := field.Type
+			for elem.Kind() == reflect.Ptr || elem.Kind() == reflect.Slice {
+				elem = elem.Elem()
+			}
+			if strings.Contains(tag, "@@") {
+				tag = strings.ReplaceAll(tag, "@@", elem.Name())
+				queue = append(queue, elem)
+			}
+			exprs = append(exprs, strings.Join(strings.Fields(strings.ReplaceAll(tag, "@", "")), " "))
+		}
+		fmt.Fprintf(&b, "%s = %s .\n", t.Name(), strings.Join(exprs, " "))
+	}
+	return b.String()
+}
@@ -0,0 +1,168 @@
+/*
+ * Copyright 2019 The Kythe Authors. All rights reserved.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *   http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package ast
+
+import (
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/alecthomas/participle"
+	plex "github.com/alecthomas/participle/lexer"
+	"github.com/google/go-cmp/cmp"
+
+	"github.com/kythe/llvmbzlgen/cmakelib/lexer"
+)
+
+const benchmarkInput = `set(LLVM_LINK_COMPONENTS Support)
+add_llvm_library(LLVMSupport
+  APInt.cpp
+  ${CMAKE_CURRENT_SOURCE_DIR}/APFloat.cpp
+  "Quoted ${VAR} Argument"
+  )
+`
+
+func TestConcurrentParse(t *testing.T) {
+	expected, err := NewParser().ParseString(benchmarkInput)
+	if err != nil {
+		t.Fatal("Unexpected error parsing input: ", err)
+	}
+	var wg sync.WaitGroup
+	for i := 0; i < 8; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for j := 0; j < 10; j++ {
+				file, err := NewParser().ParseString(benchmarkInput)
+				if err != nil {
+					t.Error("Unexpected error parsing input: ", err)
+					return
+				}
+				if diff := cmp.Diff(expected, file); diff != "" {
+					t.Error("Unexpected parse:\n", diff)
+					return
+				}
+			}
+		}()
+	}
+	wg.Wait()
+}
+
+// BenchmarkBuildParser measures the per-file cost avoided by sharing the compiled grammar.
+func BenchmarkBuildParser(b *testing.B) {
+	b.ReportAllocs()
+	for i := 0; i < b.N; i++ {
+		p := &Parser{participle.MustBuild(&CMakeFile{}, participle.Lexer(lexer.New()))}
+		if _, err := p.ParseString(benchmarkInput); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+func BenchmarkNewParser(b *testing.B) {
+	b.ReportAllocs()
+	for i := 0; i < b.N; i++ {
+		if _, err := NewParser().ParseString(benchmarkInput); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+func BenchmarkParallelParse(b *testing.B) {
+	b.ReportAllocs()
+	b.RunParallel(func(pb *testing.PB) {
+		for pb.Next() {
+			if _, err := NewParser().ParseString(benchmarkInput); err != nil {
+				b.Error(err)
+				return
+			}
+		}
+	})
+}
+
+func TestNamedPositions(t *testing.T) {
+	const filename = "llvm/lib/Support/CMakeLists.txt"
+	file, err := NewParser().Parse(lexer.NamedReader(strings.NewReader(benchmarkInput), filename))
+	if err != nil {
+		t.Fatal("Unexpected error parsing input: ", err)
+	}
+	if len(file.Commands) == 0 {
+		t.Fatal("Expected parsed commands")
+	}
+	for _, cmd := range file.Commands {
+		if cmd.Pos.Filename != filename {
+			t.Errorf("Expected %s() at %s to have filename %#v", cmd.Name, cmd.Pos, filename)
+		}
+		for _, arg := range cmd.Arguments.Values {
+			if arg.Pos.Filename != filename {
+				t.Errorf("Expected argument of %s() at %s to have filename %#v", cmd.Name, arg.Pos, filename)
+			}
+		}
+	}
+}
+
+func TestAssociateComments(t *testing.T) {
+	const input = "# About foo.\nfoo(a) # After foo.\n\n#[[About bar.]]\nbar()\n# Trailing.\n"
+	file, err := NewParser().ParseString(input)
+	if err != nil {
+		t.Fatal("Unexpected error parsing input: ", err)
+	}
+	lex, err := lexer.New(lexer.RetainComments()).Lex(strings.NewReader(input))
+	if err != nil {
+		t.Fatal(err)
+	}
+	tokens, err := plex.ConsumeAll(lex)
+	if err != nil {
+		t.Fatal("Unexpected error lexing input: ", err)
+	}
+	comments := AssociateComments(file, tokens)
+	values := func(cmd *CommandInvocation) (result []string) {
+		for _, tok := range comments[cmd] {
+			result = append(result, tok.Value)
+		}
+		return result
+	}
+	expected := map[*CommandInvocation][]string{
+		&file.Commands[0]: {"# About foo."},
+		&file.Commands[1]: {"# After foo.", "About bar."},
+		nil:               {"# Trailing."},
+	}
+	if len(comments) != len(expected) {
+		t.Errorf("Unexpected number of associated commands: %d != %d", len(comments), len(expected))
+	}
+	for cmd, want := range expected {
+		if diff := cmp.Diff(want, values(cmd)); diff != "" {
+			t.Errorf("Unexpected comments for %v:\n%s", cmd, diff)
+		}
+	}
+}
+
+func TestGrammar(t *testing.T) {
+	grammar := Grammar()
+	if !strings.HasPrefix(grammar, "CMakeFile = ") {
+		t.Errorf("Expected grammar to begin with the CMakeFile production:\n%s", grammar)
+	}
+	for _, production := range []string{
+		"CommandInvocation = Space* Identifier Space* ArgumentList .\n",
+		"Argument = ArgumentList | QuotedArgument | UnquotedArgument | BracketArgument .\n",
+		"VariableReference = VarOpen VariableElement ( VariableElement )* \"}\" .\n",
+	} {
+		if !strings.Contains(grammar, production) {
+			t.Errorf("Expected grammar to contain %#v:\n%s", production, grammar)
+		}
+	}
+}
@@ -0,0 +1,79 @@
+/*
+ * Copyright 2019 The Kythe Authors. All rights reserved.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *   http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package ast
+
+import "strings"
+
+// RawArguments returns the literal text of each of the command's arguments, without evaluation.
+// Variable references and escape sequences are retained as written, quoted and bracket arguments
+// are returned without their delimiters and nested argument lists are returned parenthesized.
+func (c *CommandInvocation) RawArguments() []string {
+	raw := make([]string, len(c.Arguments.Values))
+	for i, arg := range c.Arguments.Values {
+		var b strings.Builder
+		arg.writeRaw(&b)
+		raw[i] = b.String()
+	}
+	return raw
+}
+
+func (a *ArgumentList) writeRaw(b *strings.Builder) {
+	b.WriteByte('(')
+	for i, arg := range a.Values {
+		if i > 0 {
+			b.WriteByte(' ')
+		}
+		arg.writeRaw(b)
+	}
+	b.WriteByte(')')
+}
+
+func (a *Argument) writeRaw(b *strings.Builder) {
+	switch {
+	case a.ArgumentList != nil:
+		a.ArgumentList.writeRaw(b)
+	case a.QuotedArgument != nil:
+		for _, e := range a.QuotedArgument.Elements {
+			if e.Ref != nil {
+				e.Ref.writeRaw(b)
+			} else {
+				b.WriteString(e.Text)
+			}
+		}
+	case a.UnquotedArgument != nil:
+		for _, e := range a.UnquotedArgument.Elements {
+			if e.Ref != nil {
+				e.Ref.writeRaw(b)
+			} else {
+				b.WriteString(e.Text)
+			}
+		}
+	case a.BracketArgument != nil:
+		b.WriteString(a.BracketArgument.Text)
+	}
+}
+
+func (v *VariableReference) writeRaw(b *strings.Builder) {
+	b.WriteString(v.Domain.Syntax())
+	for _, e := range v.Elements {
+		b.WriteString(e.Text)
+		if e.Ref != nil {
+			e.Ref.writeRaw(b)
+		}
+	}
+	b.WriteString(v.Domain.Closing())
+}
@@ -18,24 +18,92 @@
 // https://cmake.org/cmake/help/latest/manual/cmake-language.7.html#variables
 package bindings
 
-import "log"
+import (
+	"log"
+	"os"
+	"sort"
+	"strings"
+)
 
-// Mapping is a stack of map[string]string for CMake variables.
+// value is the value of a variable, set either as a string or as a list of elements.
+type value struct {
+	str   string
+	list  []string // Non-nil if the value was set as a list.
+	unset bool     // True if the value is a tombstone hiding any binding in enclosing scopes, but not the cache.
+	typ   string   // The type of a CACHE value, e.g. "BOOL", if known.
+}
+
+// String returns the value as a string, joining list elements with semicolons.
+// Semicolons within an element are escaped, so that the element is preserved by splitList.
+func (v value) String() string {
+	if v.list == nil {
+		return v.str
+	}
+	elems := make([]string, len(v.list))
+	for i, e := range v.list {
+		elems[i] = strings.Replace(e, ";", `\;`, -1)
+	}
+	return strings.Join(elems, ";")
+}
+
+// List returns the elements of the value, splitting strings on unescaped semicolons.
+func (v value) List() []string {
+	if v.list == nil {
+		return splitList(v.str)
+	}
+	return append([]string(nil), v.list...)
+}
+
+// splitList splits s into elements on semicolons which are not escaped by a backslash,
+// replacing escaped semicolons with their literal value.
+func splitList(s string) []string {
+	if s == "" {
+		return nil
+	}
+	var elems []string
+	var start int
+	for i := 0; i < len(s); i++ {
+		switch s[i] {
+		case '\\':
+			i++ // Skip the escaped character.
+		case ';':
+			elems = append(elems, unescapeSemicolons(s[start:i]))
+			start = i + 1
+		}
+	}
+	return append(elems, unescapeSemicolons(s[start:]))
+}
+
+func unescapeSemicolons(s string) string {
+	return strings.Replace(s, `\;`, ";", -1)
+}
+
+// Mapping is a stack of variable scopes for CMake variables.
 type Mapping struct {
-	vs    []map[string]string
-	cache map[string]string
+	vs    []map[string]value
+	cache map[string]value
+	env   map[string]value // Overrides of the host environment, with tombstones for unset variables.
 }
 
 // New returns a new, empty, variable stack.
 func New() *Mapping {
-	m := &Mapping{cache: make(map[string]string)}
+	m := &Mapping{cache: make(map[string]value), env: make(map[string]value)}
 	m.Push()
 	return m
 }
 
+// Clone returns a deep copy of the variable stack and cache.
+func (m *Mapping) Clone() *Mapping {
+	c := &Mapping{cache: copyMap(m.cache), env: copyMap(m.env)}
+	for _, v := range m.vs {
+		c.vs = append(c.vs, copyMap(v))
+	}
+	return c
+}
+
 // Push pushes a new variable binding scope.
 func (m *Mapping) Push() {
-	m.vs = append(m.vs, make(map[string]string))
+	m.vs = append(m.vs, make(map[string]value))
 }
 
 // Pop removes the most recently pushed scope.
@@ -49,69 +117,209 @@ func (m *Mapping) Depth() int {
 }
 
 // Set sets a key to a particular value in the current scope.
-// Setting a key to the empty string is equivalent to deleting it, in accordance with CMake semantics.
-func (m *Mapping) Set(key, value string) {
-	// Keep empty strings in the current scope as a tombstone to prevent searching in parent scopes.
-	m.vs[len(m.vs)-1][key] = value
+// Setting a key to the empty string defines it as empty; use Unset to remove the binding.
+func (m *Mapping) Set(key, val string) {
+	m.vs[len(m.vs)-1][key] = value{str: val}
+}
+
+// Unset removes the binding for key in the current scope.
+// As in CMake, any binding of key in CACHE scope is unaffected and becomes visible to lookups.
+func (m *Mapping) Unset(key string) {
+	// Keep a tombstone in the current scope to prevent searching in parent scopes.
+	m.vs[len(m.vs)-1][key] = value{unset: true}
+}
+
+// SetList sets a key to a list of elements in the current scope.
+// Elements may contain semicolons, which are escaped when the value is retrieved as a string.
+// Setting a key to an empty list is equivalent to setting it to the empty string.
+func (m *Mapping) SetList(key string, elems []string) {
+	if len(elems) == 0 {
+		m.Set(key, "")
+		return
+	}
+	m.vs[len(m.vs)-1][key] = value{list: append([]string(nil), elems...)}
 }
 
 // SetParent sets a key to a particular value in the parent scope.
-// Setting a key to the empty string is equivalent to deleting it, in accordance with CMake semantics.
-func (m *Mapping) SetParent(key, value string) {
+// As in CMake, the value in the current scope is unaffected.
+func (m *Mapping) SetParent(key, val string) {
+	m.setParent(key, value{str: val})
+}
+
+// UnsetParent removes the binding for key in the parent scope.
+func (m *Mapping) UnsetParent(key string) {
+	m.setParent(key, value{unset: true})
+}
+
+func (m *Mapping) setParent(key string, val value) {
 	if m.Depth() == 0 {
 		log.Println("Attempt to set ", key, "in PARENT_SCOPE at root")
 	} else {
-		m.vs[len(m.vs)-2][key] = value
+		// The current scope began as a copy of its parent, so retains the value from before the change.
+		if cur := m.vs[len(m.vs)-1]; !hasKey(cur, key) {
+			cur[key] = m.scopedValue(key)
+		}
+		m.vs[len(m.vs)-2][key] = val
+	}
+}
+
+// scopedValue returns the nearest value for key in any scope, ignoring the cache, or a tombstone if there is none.
+func (m *Mapping) scopedValue(key string) value {
+	for i := len(m.vs) - 1; i >= 0; i-- {
+		if val, ok := m.vs[i][key]; ok {
+			return val
+		}
 	}
+	return value{unset: true}
+}
+
+func hasKey(vs map[string]value, key string) bool {
+	_, ok := vs[key]
+	return ok
 }
 
 // SetCache sets a key to a particular value in CACHE scope.
-// Setting a key to the empty string is equivalent to deleting it, in accordance with CMake semantics.
-func (m *Mapping) SetCache(key, value string) {
-	m.cache[key] = value
+func (m *Mapping) SetCache(key, val string) {
+	m.cache[key] = value{str: val}
+}
+
+// SetCacheTyped sets a key to a particular value and type, e.g. "STRING" or "BOOL", in CACHE scope.
+func (m *Mapping) SetCacheTyped(key, typ, val string) {
+	m.cache[key] = value{str: val, typ: typ}
+}
+
+// GetCacheType returns the type of the associated value in the variable cache or an
+// empty string if not found or the type is unknown.
+func (m *Mapping) GetCacheType(key string) string {
+	return m.cache[key].typ
+}
+
+// UnsetCache removes the binding for key from the CACHE scope.
+func (m *Mapping) UnsetCache(key string) {
+	delete(m.cache, key)
 }
 
 // Get looks from the current scope up to find the nearest value for key.
 // If they key is absent, returns the empty string.
 // This matches the semantics of CMake variable lookup.
 func (m *Mapping) Get(key string) string {
-	for i := len(m.vs) - 1; i >= 0; i-- {
-		val, ok := m.vs[i][key]
-		if ok {
-			return val
-		}
+	val, _ := m.lookup(key)
+	return val.String()
+}
+
+// GetList looks up the value of key as Get does, returning the elements of the list.
+// Values set as strings are split on unescaped semicolons.
+func (m *Mapping) GetList(key string) []string {
+	val, _ := m.lookup(key)
+	return val.List()
+}
+
+// GetOrDefault looks up the value of key as Get does, returning def if the key is not set.
+// Unlike Get, a key which has been set to the empty string returns the empty string.
+func (m *Mapping) GetOrDefault(key, def string) string {
+	if val, ok := m.lookup(key); ok {
+		return val.String()
+	}
+	return def
+}
+
+// IsSet returns true if key is bound in the current scope, an enclosing one, or the cache,
+// even if it is bound to the empty string.
+func (m *Mapping) IsSet(key string) bool {
+	_, ok := m.lookup(key)
+	return ok
+}
+
+// lookup returns the nearest value for key and whether it was found.
+func (m *Mapping) lookup(key string) (value, bool) {
+	if val := m.scopedValue(key); !val.unset {
+		return val, true
 	}
 	// From https://cmake.org/cmake/help/latest/manual/cmake-language.7.html#variables
 	// Variable references are looked up in the cache if not present in the current scope.
-	return m.GetCache(key)
+	val, ok := m.cache[key]
+	return val, ok
 }
 
 // GetCache returns the associated value from the variable cache or an empty string if not found.
 func (m *Mapping) GetCache(key string) string {
-	val, ok := m.cache[key]
-	if ok {
-		return val
-	}
-	return ""
+	return m.cache[key].String()
 }
 
-// GetEnv returns the corresponding environment variable or the empty string (not implemented).
+// GetEnv returns the corresponding environment variable or the empty string if it is not defined.
 func (m *Mapping) GetEnv(key string) string {
-	return ""
+	val, _ := m.LookupEnv(key)
+	return val
 }
 
-// Values returns the currently set values as a map[string]string.
-// Keys set to the empty string will be omitted from the final map.
+// LookupEnv returns the value of the named environment variable and whether it is defined,
+// consulting the overrides set by SetEnv and UnsetEnv before the host environment.
+func (m *Mapping) LookupEnv(key string) (string, bool) {
+	if val, ok := m.env[key]; ok {
+		return val.str, !val.unset
+	}
+	return os.LookupEnv(key)
+}
+
+// SetEnv overrides the value of the named environment variable, as set(ENV{key} val) does.
+func (m *Mapping) SetEnv(key, val string) {
+	m.env[key] = value{str: val}
+}
+
+// UnsetEnv hides the named environment variable, even if it is defined in the host environment.
+func (m *Mapping) UnsetEnv(key string) {
+	m.env[key] = value{unset: true}
+}
+
+// Values returns the values currently set in the current and enclosing scopes as a map[string]string.
+// Keys which are unset, or set to the empty string, are omitted from the final map;
+// use IsSet to distinguish them.
 func (m *Mapping) Values() map[string]string {
 	vals := make(map[string]string)
 	for _, v := range m.vs {
 		for key, val := range v {
-			if val == "" {
+			if s := val.String(); s == "" {
 				delete(vals, key)
 			} else {
-				vals[key] = val
+				vals[key] = s
 			}
 		}
 	}
 	return vals
 }
+
+// KeyValue is a single variable binding.
+type KeyValue struct {
+	Key, Value string
+}
+
+// ValuesSorted returns the currently set values as Values does, as a slice sorted by key.
+func (m *Mapping) ValuesSorted() []KeyValue {
+	vals := m.Values()
+	kvs := make([]KeyValue, 0, len(vals))
+	for key, val := range vals {
+		kvs = append(kvs, KeyValue{key, val})
+	}
+	sort.Slice(kvs, func(i, j int) bool { return kvs[i].Key < kvs[j].Key })
+	return kvs
+}
+
+// CacheValues returns the values set in CACHE scope as a map[string]string.
+// Keys set to the empty string will be omitted from the final map.
+func (m *Mapping) CacheValues() map[string]string {
+	vals := make(map[string]string, len(m.cache))
+	for key, val := range m.cache {
+		if s := val.String(); s != "" {
+			vals[key] = s
+		}
+	}
+	return vals
+}
+
+func copyMap(m map[string]value) map[string]value {
+	c := make(map[string]value, len(m))
+	for k, v := range m {
+		c[k] = v
+	}
+	return c
+}
@@ -1,6 +1,7 @@
 package bindings
 
 import (
+	"os"
 	"testing"
 
 	"github.com/google/go-cmp/cmp"
@@ -72,3 +73,209 @@ func TestOverridesDeletion(t *testing.T) {
 		t.Errorf("Unexpected diff: %#v", diff)
 	}
 }
+
+func TestValuesSorted(t *testing.T) {
+	vars := New()
+	vars.Set("ZETA", "z")
+	vars.Set("ALPHA", "a")
+	vars.Set("MIDDLE", "m")
+	vars.Set("EMPTY", "e")
+	vars.Push()
+	vars.Set("MIDDLE", "shadowed")
+	vars.Set("EMPTY", "")
+	vars.Set("BETA", "b")
+	expected := []KeyValue{
+		{"ALPHA", "a"},
+		{"BETA", "b"},
+		{"MIDDLE", "shadowed"},
+		{"ZETA", "z"},
+	}
+	if diff := cmp.Diff(vars.ValuesSorted(), expected); diff != "" {
+		t.Errorf("Unexpected diff: %#v", diff)
+	}
+	vars.Pop()
+	expected = []KeyValue{
+		{"ALPHA", "a"},
+		{"EMPTY", "e"},
+		{"MIDDLE", "m"},
+		{"ZETA", "z"},
+	}
+	if diff := cmp.Diff(vars.ValuesSorted(), expected); diff != "" {
+		t.Errorf("Unexpected diff: %#v", diff)
+	}
+}
+
+func TestSetParent(t *testing.T) {
+	vars := New()
+	vars.Set("HELLO", "world")
+	vars.Push()
+	vars.SetParent("HELLO", "goodbye")
+	vars.SetParent("NEW", "value")
+	vars.UnsetParent("MISSING")
+	// Only the parent scope is changed.
+	expected := map[string]string{
+		"HELLO": "world",
+	}
+	if diff := cmp.Diff(vars.Values(), expected); diff != "" {
+		t.Errorf("Unexpected diff: %#v", diff)
+	}
+	vars.Pop()
+	expected = map[string]string{
+		"HELLO": "goodbye",
+		"NEW":   "value",
+	}
+	if diff := cmp.Diff(vars.Values(), expected); diff != "" {
+		t.Errorf("Unexpected diff: %#v", diff)
+	}
+}
+
+func TestClone(t *testing.T) {
+	vars := New()
+	vars.Set("HELLO", "world")
+	vars.SetCache("CACHED", "value")
+	vars.Push()
+	clone := vars.Clone()
+	clone.Set("HELLO", "goodbye")
+	clone.SetCache("CACHED", "changed")
+	clone.Pop()
+	if diff := cmp.Diff(vars.Values(), map[string]string{"HELLO": "world"}); diff != "" {
+		t.Errorf("Unexpected diff: %#v", diff)
+	}
+	if actual := vars.GetCache("CACHED"); actual != "value" {
+		t.Errorf("Expected %#v found %#v", "value", actual)
+	}
+	if actual := vars.Depth(); actual != 1 {
+		t.Errorf("Expected depth %d found %d", 1, actual)
+	}
+}
+
+func TestLists(t *testing.T) {
+	vars := New()
+	vars.SetList("LIST", []string{"a;b", "c"})
+	if actual := vars.Get("LIST"); actual != `a\;b;c` {
+		t.Errorf("Expected %#v found %#v", `a\;b;c`, actual)
+	}
+	if diff := cmp.Diff([]string{"a;b", "c"}, vars.GetList("LIST")); diff != "" {
+		t.Errorf("Unexpected list:\n%s", diff)
+	}
+
+	// Values set as strings round-trip through the same escaping.
+	vars.Set("STRING", vars.Get("LIST"))
+	if diff := cmp.Diff([]string{"a;b", "c"}, vars.GetList("STRING")); diff != "" {
+		t.Errorf("Unexpected list:\n%s", diff)
+	}
+	vars.Set("PLAIN", "x;y;;z")
+	if diff := cmp.Diff([]string{"x", "y", "", "z"}, vars.GetList("PLAIN")); diff != "" {
+		t.Errorf("Unexpected list:\n%s", diff)
+	}
+
+	vars.Push()
+	vars.SetList("LIST", nil)
+	if actual := vars.GetList("LIST"); actual != nil {
+		t.Errorf("Expected empty list found %#v", actual)
+	}
+	vars.Pop()
+	if actual := vars.GetList("MISSING"); actual != nil {
+		t.Errorf("Expected empty list found %#v", actual)
+	}
+}
+
+func TestIsSet(t *testing.T) {
+	vars := New()
+	vars.Set("EMPTY", "")
+	vars.Set("VALUE", "value")
+	vars.SetCache("CACHED", "")
+	vars.Push()
+	vars.Unset("VALUE")
+	tests := []struct {
+		key   string
+		set   bool
+		value string
+	}{
+		{"EMPTY", true, ""},
+		{"CACHED", true, ""},
+		{"VALUE", false, "default"},
+		{"ABSENT", false, "default"},
+	}
+	for _, test := range tests {
+		if set := vars.IsSet(test.key); set != test.set {
+			t.Errorf("IsSet(%#v) = %v; want %v", test.key, set, test.set)
+		}
+		if value := vars.GetOrDefault(test.key, "default"); value != test.value {
+			t.Errorf("GetOrDefault(%#v) = %#v; want %#v", test.key, value, test.value)
+		}
+	}
+	vars.Pop()
+	if value := vars.GetOrDefault("VALUE", "default"); value != "value" {
+		t.Errorf("GetOrDefault(%#v) = %#v; want %#v", "VALUE", value, "value")
+	}
+	vars.UnsetCache("CACHED")
+	if vars.IsSet("CACHED") {
+		t.Errorf("IsSet(%#v) = true after UnsetCache", "CACHED")
+	}
+}
+
+func TestUnsetRevealsCache(t *testing.T) {
+	vars := New()
+	vars.SetCache("SHADOWED", "cached")
+	vars.Set("SHADOWED", "normal")
+	vars.Push()
+	vars.Unset("SHADOWED")
+	if actual := vars.Get("SHADOWED"); actual != "cached" {
+		t.Errorf("Expected %#v found %#v", "cached", actual)
+	}
+	if !vars.IsSet("SHADOWED") {
+		t.Errorf("IsSet(%#v) = false after Unset with a CACHE binding", "SHADOWED")
+	}
+	vars.Pop()
+	if actual := vars.Get("SHADOWED"); actual != "normal" {
+		t.Errorf("Expected %#v found %#v", "normal", actual)
+	}
+}
+
+func TestCacheValues(t *testing.T) {
+	vars := New()
+	vars.SetCache("CACHED", "value")
+	vars.SetCache("EMPTY", "")
+	vars.Set("REGULAR", "value")
+	expected := map[string]string{"CACHED": "value"}
+	if diff := cmp.Diff(expected, vars.CacheValues()); diff != "" {
+		t.Errorf("Unexpected diff: %#v", diff)
+	}
+}
+
+func TestEnvOverrides(t *testing.T) {
+	const host = "LLVMBZLGEN_TEST_HOST_ENV"
+	os.Setenv(host, "host")
+	defer os.Unsetenv(host)
+
+	vars := New()
+	vars.SetEnv("OVERRIDE", "")
+	tests := []struct {
+		key     string
+		value   string
+		defined bool
+	}{
+		{host, "host", true},
+		{"OVERRIDE", "", true},
+		{host + "_UNSET", "", false},
+	}
+	for _, test := range tests {
+		if value, defined := vars.LookupEnv(test.key); value != test.value || defined != test.defined {
+			t.Errorf("Expected LookupEnv(%#v) = %#v, %v found %#v, %v", test.key, test.value, test.defined, value, defined)
+		}
+	}
+
+	clone := vars.Clone()
+	vars.SetEnv(host, "override")
+	if actual := vars.GetEnv(host); actual != "override" {
+		t.Errorf("Expected overridden %s=%#v found %#v", host, "override", actual)
+	}
+	if actual := clone.GetEnv(host); actual != "host" {
+		t.Errorf("Expected cloned %s=%#v found %#v", host, "host", actual)
+	}
+	vars.UnsetEnv(host)
+	if _, defined := vars.LookupEnv(host); defined {
+		t.Errorf("Expected %s to be undefined after UnsetEnv", host)
+	}
+}
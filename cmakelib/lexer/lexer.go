@@ -19,9 +19,12 @@
 package lexer
 
 import (
+	"fmt"
 	"io"
+	"sort"
 
 	"github.com/alecthomas/participle/lexer"
+	"github.com/kythe/llvmbzlgen/cmakelib/lexer/rules"
 )
 
 // Constants defining the token types used by CMake
@@ -68,19 +71,142 @@ func init() {
 	}
 }
 
+// TokenName returns the name of the token type t, as reported by Symbols,
+// or a description including its value if t is not a token type of this lexer.
+func TokenName(t rune) string {
+	if name, ok := tokenNames[t]; ok {
+		return name
+	}
+	return fmt.Sprintf("Unknown(%d)", t)
+}
+
+// Error is returned when the input cannot be lexed.
+type Error struct {
+	Pos       lexer.Position       // The position of the token at which lexing failed.
+	Text      string               // The offending input text.
+	Condition rules.StartCondition // The start condition active when lexing failed.
+	Msg       string
+}
+
+// Error implements the error interface for Error.
+func (e *Error) Error() string {
+	return lexer.FormatError(e.Pos, e.Msg)
+}
+
+// Message returns the error message without position information.
+func (e *Error) Message() string {
+	return e.Msg
+}
+
+// Token returns a token describing the offending input.
+func (e *Error) Token() lexer.Token {
+	return lexer.Token{Pos: e.Pos, Value: e.Text}
+}
+
+// Option configures the lexer.Definition returned by New.
+type Option func(*cmakeDefinition)
+
+// RetainComments configures the lexer to emit Comment and BracketComment tokens,
+// which are otherwise discarded.
+func RetainComments() Option {
+	return func(d *cmakeDefinition) {
+		d.comments = true
+	}
+}
+
+// StrictUTF8 configures the lexer to fail on unquoted arguments which are not valid UTF-8.
+// By default, invalid bytes are retained as opaque single-byte content, with positions
+// advancing by one column per byte, so that files with Latin-1 content still lex.
+// Comments and the content of quoted and bracket arguments are never checked.
+func StrictUTF8() Option {
+	return func(d *cmakeDefinition) {
+		d.strictUTF8 = true
+	}
+}
+
 // New returns a new lexer.Definition suitable for lexing CMakeLists.txt
-func New() lexer.Definition {
-	return &cmakeDefinition{}
+func New(opts ...Option) lexer.Definition {
+	d := &cmakeDefinition{}
+	for _, opt := range opts {
+		opt(d)
+	}
+	return d
 }
 
-type cmakeDefinition struct{}
+type cmakeDefinition struct {
+	comments   bool
+	strictUTF8 bool
+}
 
 // Lex implements lexer.Definition for CMakeLists.
-func (cmakeDefinition) Lex(reader io.Reader) (lexer.Lexer, error) {
-	return newSplitLexer(reader), nil
+func (d *cmakeDefinition) Lex(reader io.Reader) (lexer.Lexer, error) {
+	l := newSplitLexer(reader)
+	l.file.(*tableLexer).comments = d.comments
+	l.strictUTF8 = d.strictUTF8
+	return l, nil
 }
 
 // Symbols implements lexer.Definition for CMakeLists.
-func (cmakeDefinition) Symbols() map[string]rune {
+func (*cmakeDefinition) Symbols() map[string]rune {
 	return tokenSyms
 }
+
+// NamedReader returns an io.Reader which reads from r and reports name as the
+// filename of the positions of lexed tokens.
+func NamedReader(r io.Reader, name string) io.Reader {
+	return &namedReader{r, name}
+}
+
+type namedReader struct {
+	io.Reader
+	name string
+}
+
+// Name returns the name of the reader, as consulted by lexer.NameOfReader.
+func (r *namedReader) Name() string {
+	return r.name
+}
+
+// TokenAt returns the token from the position-sorted tokens which covers the given byte offset.
+// Returns false if no token spans the offset, such as when it falls in elided whitespace.
+func TokenAt(tokens []lexer.Token, offset int) (lexer.Token, bool) {
+	i := sort.Search(len(tokens), func(i int) bool {
+		return tokens[i].Pos.Offset > offset
+	})
+	if i == 0 {
+		return lexer.Token{}, false
+	}
+	tok := tokens[i-1]
+	if offset >= tok.Pos.Offset+len(tok.Value) {
+		return lexer.Token{}, false
+	}
+	return tok, true
+}
+
+// CheckBalance returns an *Error positioned at the first unmatched parenthesis in the tokens,
+// or nil if each "(" is matched by a subsequent ")".
+// Unclosed argument lists are reported at their opening parenthesis.
+// Parentheses within quoted, bracket and comment text are not considered.
+func CheckBalance(tokens []lexer.Token) error {
+	var open []lexer.Token
+	for _, tok := range tokens {
+		if tok.Type != Punct {
+			continue
+		}
+		switch tok.Value {
+		case "(":
+			open = append(open, tok)
+		case ")":
+			if len(open) == 0 {
+				return &Error{Pos: tok.Pos, Text: tok.Value, Condition: initialCondition, Msg: "unexpected )"}
+			}
+			open = open[:len(open)-1]
+		}
+	}
+	if len(open) > 0 {
+		// Report the innermost unclosed list, which is most likely where the ) is missing.
+		tok := open[len(open)-1]
+		return &Error{Pos: tok.Pos, Text: tok.Value, Condition: initialCondition, Msg: "unbalanced ( is never closed"}
+	}
+	return nil
+}
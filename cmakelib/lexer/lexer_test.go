@@ -323,3 +323,288 @@ func TestLexerMixedArguments(t *testing.T) {
 		}
 	}
 }
+
+func TestTokenAt(t *testing.T) {
+	toks, err := lexString("set(FOO bar)\n\nadd_subdirectory(baz)\n")
+	if err != nil {
+		t.Fatal("Unexpected error lexing input: ", err)
+	}
+	toks = removeWhitespace(toks)
+	tests := []struct {
+		offset   int
+		expected *Token
+	}{
+		{0, &Token{Type: Identifier, Value: "set"}},
+		{5, &Token{Type: Identifier, Value: "FOO"}},
+		{7, nil}, // Whitespace between arguments.
+		{12, nil},
+		{14, &Token{Type: Identifier, Value: "add_subdirectory"}},
+		{32, &Token{Type: Identifier, Value: "baz"}},
+		{34, &Token{Type: Punct, Value: ")"}},
+		{35, nil},
+		{36, nil},
+		{-1, nil},
+	}
+	for _, test := range tests {
+		tok, ok := TokenAt(toks, test.offset)
+		switch {
+		case test.expected == nil && ok:
+			t.Errorf("Unexpected token at %d: %#v", test.offset, tok)
+		case test.expected == nil:
+		case !ok:
+			t.Errorf("Missing token at %d", test.offset)
+		default:
+			if diff := cmp.Diff(*test.expected, tok, ignorePosition()); diff != "" {
+				t.Errorf("Unexpected token at %d:\n%s", test.offset, diff)
+			}
+		}
+	}
+}
+
+func TestCheckBalance(t *testing.T) {
+	tests := map[string]*Error{
+		"set(FOO bar)\nmessage(\"(\" [[)]])\n": nil,
+		"set(FOO bar\nadd_subdirectory(baz)\n": {
+			Pos:       plex.Position{Offset: 3, Line: 1, Column: 4},
+			Text:      "(",
+			Condition: initialCondition,
+			Msg:       "unbalanced ( is never closed",
+		},
+		"if((A AND B)\n": {
+			Pos:       plex.Position{Offset: 2, Line: 1, Column: 3},
+			Text:      "(",
+			Condition: initialCondition,
+			Msg:       "unbalanced ( is never closed",
+		},
+		"set(FOO))\n": {
+			Pos:       plex.Position{Offset: 8, Line: 1, Column: 9},
+			Text:      ")",
+			Condition: initialCondition,
+			Msg:       "unexpected )",
+		},
+	}
+	for input, expected := range tests {
+		toks, err := lexString(input)
+		if err != nil {
+			t.Errorf("Unexpected error lexing %#v: %v", input, err)
+			continue
+		}
+		err = CheckBalance(toks)
+		if expected == nil {
+			if err != nil {
+				t.Errorf("Unexpected error checking %#v: %v", input, err)
+			}
+			continue
+		}
+		if diff := cmp.Diff(expected, err); diff != "" {
+			t.Errorf("Unexpected error checking %#v:\n%s", input, diff)
+		}
+	}
+}
+
+func TestLexerError(t *testing.T) {
+	tests := map[string]*Error{
+		"foo(\x00)": {
+			Pos:       plex.Position{Offset: 4, Line: 1, Column: 5},
+			Text:      "\x00",
+			Condition: initialCondition,
+			Msg:       `invalid token '\x00'`,
+		},
+		"foo(\n[==[text]]\n": {
+			Pos:       plex.Position{Offset: 5, Line: 2, Column: 1},
+			Text:      "text]]\n",
+			Condition: bracketCondition,
+			Msg:       "unterminated bracket with text: text]]\n",
+		},
+	}
+	for input, expected := range tests {
+		_, err := lexString(input)
+		lerr, ok := err.(*Error)
+		if !ok {
+			t.Errorf("Expected *Error lexing %#v, found %T: %v", input, err, err)
+			continue
+		}
+		if diff := cmp.Diff(expected, lerr); diff != "" {
+			t.Errorf("Unexpected error lexing %#v:\n%s", input, diff)
+		}
+		if msg := plex.FormatError(expected.Pos, expected.Msg); lerr.Error() != msg {
+			t.Errorf("Unexpected error string %#v != %#v", lerr.Error(), msg)
+		}
+	}
+}
+
+func TestInvalidUTF8(t *testing.T) {
+	input := "foo(a\xffb c)\n"
+	tokens, err := lexString(input)
+	if err != nil {
+		t.Fatal("Unexpected error lexing invalid UTF-8: ", err)
+	}
+	expected := []Token{
+		newTokenAt(Identifier, "foo", 0, 1, 1),
+		newTokenAt(Punct, "(", 3, 1, 4),
+		newTokenAt(Unquoted, "a\xffb", 4, 1, 5),
+		newTokenAt(Space, " ", 7, 1, 8),
+		newTokenAt(Identifier, "c", 8, 1, 9),
+		newTokenAt(Punct, ")", 9, 1, 10),
+		newTokenAt(Newline, "\n", 10, 1, 11),
+		newTokenAt(plex.EOF, "", 11, 2, 1),
+	}
+	if diff := cmp.Diff(expected, tokens); diff != "" {
+		t.Errorf("Unexpected tokens:\n%s", diff)
+	}
+
+	strict := func(input string) error {
+		lex, err := New(StrictUTF8()).Lex(strings.NewReader(input))
+		if err != nil {
+			return err
+		}
+		_, err = plex.ConsumeAll(lex)
+		return err
+	}
+	err = strict(input)
+	expectedErr := &Error{
+		Pos:       plex.Position{Offset: 5, Line: 1, Column: 6},
+		Text:      "\xff",
+		Condition: initialCondition,
+		Msg:       "invalid UTF-8 byte 0xff",
+	}
+	if diff := cmp.Diff(expectedErr, err); diff != "" {
+		t.Errorf("Unexpected error:\n%s", diff)
+	}
+
+	// Only unquoted arguments are checked.
+	for _, input := range []string{"set(A \"b\xe9c\")\n", "set(A [[b\xe9c]])\n", "# caf\xe9\n", "#[[ caf\xe9 ]]\n"} {
+		if err := strict(input); err != nil {
+			t.Errorf("Unexpected error lexing %q: %v", input, err)
+		}
+	}
+}
+
+func TestRetainComments(t *testing.T) {
+	input := "# Leading comment.\nfoo(a) #[[bracket\ncomment]] # trailing\n#\n"
+	lex, err := New(RetainComments()).Lex(strings.NewReader(input))
+	if err != nil {
+		t.Fatal(err)
+	}
+	tokens, err := plex.ConsumeAll(lex)
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := []Token{
+		newTokenAt(Comment, "# Leading comment.", 0, 1, 1),
+		newTokenAt(Newline, "\n", 18, 1, 19),
+		newTokenAt(Identifier, "foo", 19, 2, 1),
+		newTokenAt(Punct, "(", 22, 2, 4),
+		newTokenAt(Identifier, "a", 23, 2, 5),
+		newTokenAt(Punct, ")", 24, 2, 6),
+		newTokenAt(Space, " ", 25, 2, 7),
+		newTokenAt(BracketComment, "bracket\ncomment", 26, 2, 8),
+		newTokenAt(Space, " ", 46, 3, 10),
+		newTokenAt(Comment, "# trailing", 47, 3, 11),
+		newTokenAt(Newline, "\n", 57, 3, 21),
+		newTokenAt(Comment, "#", 58, 4, 1),
+		newTokenAt(Newline, "\n", 59, 4, 2),
+		newTokenAt(plex.EOF, "", 60, 5, 1),
+	}
+	if diff := cmp.Diff(expected, tokens); diff != "" {
+		t.Errorf("Unexpected tokens:\n%s", diff)
+	}
+
+	// By default, comments are discarded.
+	tokens, err = lexString(input)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, tok := range tokens {
+		if tok.Type == Comment || tok.Type == BracketComment {
+			t.Errorf("Unexpected comment token: %v", tok)
+		}
+	}
+}
+
+func TestNextAfterEOF(t *testing.T) {
+	for _, input := range []string{"", "foo(a)", "foo(\"${a}\")\n", "foo() # comment", "#[[comment]]"} {
+		for _, def := range []plex.Definition{New(), New(RetainComments())} {
+			lex, err := def.Lex(strings.NewReader(input))
+			if err != nil {
+				t.Fatal(err)
+			}
+			tokens, err := plex.ConsumeAll(lex)
+			if err != nil {
+				t.Fatalf("Unexpected error lexing %#v: %v", input, err)
+			}
+			eof := tokens[len(tokens)-1]
+			for i := 0; i < 3; i++ {
+				tok, err := lex.Next()
+				if err != nil {
+					t.Errorf("Unexpected error after EOF lexing %#v: %v", input, err)
+				}
+				if diff := cmp.Diff(eof, tok); diff != "" {
+					t.Errorf("Unexpected token after EOF lexing %#v:\n%s", input, diff)
+				}
+			}
+		}
+	}
+}
+
+// largeInput returns a representative CMakeLists.txt of roughly n commands.
+func largeInput(n int) string {
+	var b strings.Builder
+	b.WriteString("# A large, generated CMakeLists.txt\ncmake_minimum_required(VERSION 3.4.3)\n")
+	for i := 0; i < n; i++ {
+		b.WriteString("set(SOURCES_${NAME} a.cpp b.cpp \"quoted ${VAR} value\" [[bracket\ncontent]])\n")
+		b.WriteString("if(DEFINED LLVM_${TARGET} AND NOT (A OR B)) # Trailing comment.\n")
+		b.WriteString("  add_llvm_library(LLVM${NAME} ${SOURCES} DEPENDS intrinsics_gen\n    LINK_LIBS $ENV{HOME}/lib \\;escaped)\n")
+		b.WriteString("endif()\n\n")
+	}
+	return b.String()
+}
+
+// BenchmarkLexLargeFile measures lexing a large input.
+// Before indexing rules by start condition and anchoring their patterns:
+//
+//	BenchmarkLexLargeFile  3  390ms/op  0.33 MB/s  485k allocs/op
+//
+// After:
+//
+//	BenchmarkLexLargeFile  6  177ms/op  0.71 MB/s  218k allocs/op
+func BenchmarkLexLargeFile(b *testing.B) {
+	input := largeInput(500)
+	b.SetBytes(int64(len(input)))
+	b.ReportAllocs()
+	for i := 0; i < b.N; i++ {
+		if _, err := lexString(input); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+func TestTokenName(t *testing.T) {
+	tests := map[rune]string{
+		lexer.EOF:      "EOF",
+		Space:          "Space",
+		Newline:        "Newline",
+		EscapeSequence: "EscapeSequence",
+		Quoted:         "Quoted",
+		Quote:          "Quote",
+		BracketContent: "BracketContent",
+		BracketComment: "BracketComment",
+		VarOpen:        "VarOpen",
+		VarClose:       "VarClose",
+		Identifier:     "Identifier",
+		Unquoted:       "Unquoted",
+		Punct:          "Punct",
+		Comment:        "Comment",
+		'x':            "Unknown(120)",
+	}
+	for kind, expected := range tests {
+		if actual := TokenName(kind); actual != expected {
+			t.Errorf("Expected TokenName(%d) to be %#v, found %#v", kind, expected, actual)
+		}
+	}
+	for name, kind := range New().Symbols() {
+		if actual := TokenName(kind); actual != name {
+			t.Errorf("Expected TokenName(%d) to be %#v, found %#v", kind, name, actual)
+		}
+	}
+}
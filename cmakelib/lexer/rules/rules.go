@@ -19,6 +19,7 @@ package rules
 
 import (
 	"regexp"
+	"sync"
 
 	"github.com/alecthomas/participle/lexer"
 )
@@ -51,6 +52,9 @@ type Action func(ScanState) (bool, error)
 type Rules struct {
 	condMap map[StartCondition]bool
 	table   []rule
+
+	mu    sync.RWMutex
+	index map[StartCondition][]*rule // Lazily computed rules applicable to each start condition.
 }
 
 // rule is a single entry, indicating a list of start conditions and pattern to select an action.
@@ -75,6 +79,7 @@ func ExclusiveConditions(cond StartCondition, tail ...StartCondition) Option {
 		for _, cond := range tail {
 			r.condMap[cond] = true
 		}
+		r.resetIndex()
 	}
 }
 
@@ -85,9 +90,25 @@ func InclusiveConditions(cond StartCondition, tail ...StartCondition) Option {
 		for _, cond := range tail {
 			r.condMap[cond] = false
 		}
+		r.resetIndex()
 	}
 }
 
+// SetExclusive configures whether the provided StartCondition is exclusive.
+func (r *Rules) SetExclusive(cond StartCondition, exclusive bool) {
+	r.mu.Lock()
+	r.condMap[cond] = exclusive
+	r.index = nil
+	r.mu.Unlock()
+}
+
+// IsExclusive reports whether the provided StartCondition is exclusive.
+func (r *Rules) IsExclusive(cond StartCondition) bool {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	return r.condMap[cond]
+}
+
 // In accepts a (possibly empty) list of start conditions during which to consider a rule.
 func In(conds ...StartCondition) *ruleBuilder {
 	return &ruleBuilder{conds}
@@ -102,7 +123,7 @@ func (c *ruleBuilder) Match(pat string, action Action) Option {
 
 // New returns a new Rules table, after applying the provided options.
 func New(opts ...Option) *Rules {
-	r := &Rules{make(map[StartCondition]bool), nil}
+	r := &Rules{condMap: make(map[StartCondition]bool)}
 	for _, opt := range opts {
 		opt(r)
 	}
@@ -110,12 +131,16 @@ func New(opts ...Option) *Rules {
 }
 
 // AddRegexp adds a rule matching the regular expression and start conditions.
+// The expression is used as given, so matches with its own semantics, and only if the match
+// it finds begins at the start of the text. Expressions anchored with ^ match most efficiently.
 func (r *Rules) AddRegexp(conds []StartCondition, re *regexp.Regexp, action Action) error {
 	r.table = append(r.table, rule{conds, re, action})
+	r.resetIndex()
 	return nil
 }
 
 // Add adds a rule matching the pattern and start conditions.
+// The leftmost-longest match of the pattern at the start of the text is used.
 func (r *Rules) Add(conds []StartCondition, pat string, action Action) error {
 	re, err := compileRegexp(pat)
 	if err != nil {
@@ -131,30 +156,62 @@ func (r *Rules) MustAdd(conds []StartCondition, pat string, action Action) {
 
 // Match considers applicable rules and returns the action associated with the longest
 // matching pattern, as well as the portion of the data matched by that pattern.
+// Of equally long matches, the earliest rule wins.
 func (r *Rules) Match(curr StartCondition, data []byte) (Action, []byte) {
 	var found struct {
 		action  Action
 		matched []byte
 	}
-	for _, entry := range r.table {
-		if r.matchCondition(curr, entry.conds) {
-			// EOF pattern matches at EOF and only at EOF, so take the first.
-			if entry.re == EOFRegexp {
-				if len(data) == 0 {
-					return entry.action, nil
-				} else {
-					continue
-				}
+	for _, entry := range r.applicable(curr) {
+		// EOF pattern matches at EOF and only at EOF, so take the first.
+		if entry.re == EOFRegexp {
+			if len(data) == 0 {
+				return entry.action, nil
 			}
-			if locs := entry.re.FindIndex(data); locs != nil && locs[0] == 0 && locs[1] > len(found.matched) {
-				found.action = entry.action
-				found.matched = data[0:locs[1]]
+			continue
+		}
+		if locs := entry.re.FindIndex(data); locs != nil && locs[0] == 0 && locs[1] > len(found.matched) {
+			found.action = entry.action
+			found.matched = data[0:locs[1]]
+			if len(found.matched) == len(data) {
+				// No subsequent rule can match more of the data.
+				break
 			}
 		}
 	}
 	return found.action, found.matched
 }
 
+// applicable returns the rules, in order, which apply in the given start condition.
+func (r *Rules) applicable(curr StartCondition) []*rule {
+	r.mu.RLock()
+	rules, ok := r.index[curr]
+	r.mu.RUnlock()
+	if ok {
+		return rules
+	}
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if r.index == nil {
+		r.index = make(map[StartCondition][]*rule)
+	}
+	rules = []*rule{}
+	for i := range r.table {
+		if r.matchCondition(curr, r.table[i].conds) {
+			rules = append(rules, &r.table[i])
+		}
+	}
+	r.index[curr] = rules
+	return rules
+}
+
+// resetIndex discards the rules computed for each start condition.
+func (r *Rules) resetIndex() {
+	r.mu.Lock()
+	r.index = nil
+	r.mu.Unlock()
+}
+
 func (r *Rules) matchCondition(curr StartCondition, conds []StartCondition) bool {
 	if len(conds) == 0 && !r.condMap[curr] {
 		return true
@@ -171,7 +228,7 @@ func compileRegexp(pat string) (*regexp.Regexp, error) {
 	if pat == EOFPattern {
 		return EOFRegexp, nil
 	}
-	re, err := regexp.Compile(pat)
+	re, err := regexp.Compile(anchor(pat))
 	if err != nil {
 		return re, err
 	}
@@ -183,7 +240,12 @@ func mustCompileRegexp(pat string) *regexp.Regexp {
 	if pat == EOFPattern {
 		return EOFRegexp
 	}
-	re := regexp.MustCompile(pat)
+	re := regexp.MustCompile(anchor(pat))
 	re.Longest()
 	return re
 }
+
+// anchor returns pat modified to only match at the start of the text.
+func anchor(pat string) string {
+	return `^(?:` + pat + `)`
+}
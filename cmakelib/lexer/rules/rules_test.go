@@ -0,0 +1,189 @@
+/*
+ * Copyright 2019 The Kythe Authors. All rights reserved.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *   http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package rules
+
+import (
+	"regexp"
+	"testing"
+)
+
+// referenceMatch is a straightforward implementation of Rules.Match, considering every rule in turn.
+func referenceMatch(r *Rules, curr StartCondition, data []byte) (int, []byte) {
+	found, matched := -1, []byte(nil)
+	for i, entry := range r.table {
+		if !r.matchCondition(curr, entry.conds) {
+			continue
+		}
+		if entry.re == EOFRegexp {
+			if len(data) == 0 {
+				return i, nil
+			}
+			continue
+		}
+		if locs := entry.re.FindIndex(data); locs != nil && locs[0] == 0 && locs[1] > len(matched) {
+			found, matched = i, data[0:locs[1]]
+		}
+	}
+	return found, matched
+}
+
+func TestMatchEquivalence(t *testing.T) {
+	const (
+		inclusive StartCondition = iota + 1
+		exclusive
+	)
+	// Each action reports its index in the table via fired, so results can be compared with referenceMatch.
+	fired := -1
+	count := 0
+	action := func() Action {
+		i := count
+		count++
+		return func(ScanState) (bool, error) {
+			fired = i
+			return false, nil
+		}
+	}
+	r := New(
+		ExclusiveConditions(exclusive),
+		In().Match(`[a-z]+`, action()),
+		In().Match(`[a-z]+[0-9]*`, action()),
+		In(inclusive).Match(`[a-z0-9]+`, action()),
+		In(exclusive).Match(`[^"]*`, action()),
+		In(exclusive).Match(`"`, action()),
+		In(InitialCondition, exclusive).Match(`\n`, action()),
+		In().Match(`(a|ab)(c|bcd)`, action()),
+		In().Match(`.`, action()),
+		In(inclusive, exclusive).Match(EOFPattern, action()),
+		In().Match(EOFPattern, action()),
+	)
+	inputs := []string{
+		"", "abc", "abcd", "abc123 def", "123abc", "\"quoted\" text\n", "\n", "x\ny",
+	}
+	for _, cond := range []StartCondition{InitialCondition, inclusive, exclusive} {
+		for _, input := range inputs {
+			for start := 0; start <= len(input); start++ {
+				data := []byte(input[start:])
+				act, matched := r.Match(cond, data)
+				fired = -1
+				if act != nil {
+					act(nil)
+				}
+				want, expected := referenceMatch(r, cond, data)
+				if fired != want || string(matched) != string(expected) {
+					t.Errorf("Match(%d, %q) = rule %d, %q; want rule %d, %q", cond, data, fired, matched, want, expected)
+				}
+			}
+		}
+	}
+}
+
+func BenchmarkMatch(b *testing.B) {
+	noop := func(ScanState) (bool, error) { return false, nil }
+	r := New(
+		In().Match(`[a-z_]+`, noop),
+		In().Match(`[a-z_0-9]+`, noop),
+		In().Match(`[ \t]+`, noop),
+		In().Match(`\n`, noop),
+		In().Match(`.`, noop),
+		In().Match(EOFPattern, noop),
+	)
+	data := []byte("add_subdirectory(lib)\n")
+	b.SetBytes(int64(len(data)))
+	for i := 0; i < b.N; i++ {
+		for rest := data; len(rest) > 0; {
+			_, matched := r.Match(InitialCondition, rest)
+			rest = rest[len(matched):]
+		}
+	}
+}
+
+func TestSetExclusive(t *testing.T) {
+	const cond StartCondition = 1
+	var fired string
+	action := func(name string) Action {
+		return func(ScanState) (bool, error) {
+			fired = name
+			return false, nil
+		}
+	}
+	r := New(
+		In().Match(`[a-z]+`, action("default")),
+		In(cond).Match(`[a-z]`, action("conditional")),
+	)
+	match := func() string {
+		fired = ""
+		if act, _ := r.Match(cond, []byte("abc")); act != nil {
+			act(nil)
+		}
+		return fired
+	}
+
+	if r.IsExclusive(cond) {
+		t.Errorf("IsExclusive(%d) = true; want false", cond)
+	}
+	if got := match(); got != "default" {
+		t.Errorf("inclusive Match() fired %q; want %q", got, "default")
+	}
+
+	r.SetExclusive(cond, true)
+	if !r.IsExclusive(cond) {
+		t.Errorf("IsExclusive(%d) = false; want true", cond)
+	}
+	if got := match(); got != "conditional" {
+		t.Errorf("exclusive Match() fired %q; want %q", got, "conditional")
+	}
+
+	r.SetExclusive(cond, false)
+	if got := match(); got != "default" {
+		t.Errorf("inclusive Match() fired %q; want %q", got, "default")
+	}
+}
+
+func TestAddRegexp(t *testing.T) {
+	var fired string
+	action := func(name string) Action {
+		return func(ScanState) (bool, error) {
+			fired = name
+			return false, nil
+		}
+	}
+	r := New()
+	// Regexps added directly retain their leftmost-first semantics, unlike patterns added with Add.
+	if err := r.AddRegexp(nil, regexp.MustCompile(`a|ab`), action("first")); err != nil {
+		t.Fatal(err)
+	}
+	if err := r.Add(nil, `x|xy`, action("longest")); err != nil {
+		t.Fatal(err)
+	}
+	tests := []struct {
+		input, action, matched string
+	}{
+		{"abc", "first", "a"},
+		{"xyz", "longest", "xy"},
+		{"cab", "", ""},
+	}
+	for _, test := range tests {
+		fired = ""
+		act, matched := r.Match(InitialCondition, []byte(test.input))
+		if act != nil {
+			act(nil)
+		}
+		if fired != test.action || string(matched) != test.matched {
+			t.Errorf("Match(%q) = %q, %q; want %q, %q", test.input, fired, matched, test.action, test.matched)
+		}
+	}
+}
@@ -63,6 +63,11 @@ func (s *Scanner) Begin(cond StartCondition) {
 	s.cond = cond
 }
 
+// Condition returns the current start condition of the scanner.
+func (s *Scanner) Condition() StartCondition {
+	return s.cond
+}
+
 // SetPosition sets the starting position of the scanner.
 func (s *Scanner) SetPosition(pos lexer.Position) {
 	s.pos = pos
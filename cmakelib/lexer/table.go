@@ -54,6 +54,7 @@ var fileTable = rules.New(
 	rules.In().Match(`#?\[=*\[\n?`, lexBracketOpen),
 	rules.In().Match(`#`, lexCommentStart),
 	rules.In(commentCondition).Match(`[^\0\n]*`, lexComment),
+	rules.In(commentCondition).Match(rules.EOFPattern, lexCommentEOF),
 	rules.In().Match(`[()]`, lexParen),
 	rules.In().Match(`[A-Zaa-z_][A-Za-z0-9_]*`, lexIdentifier),
 	rules.In(bracketCondition).Match(`\]=*`, lexBracketTail),
@@ -94,8 +95,10 @@ type tableLexer struct {
 
 	buf []lexer.Token
 
-	bracket int         // Number of `=` in the opening bracket.
-	base    lexer.Token // Token used to initiate argument lexing.
+	bracket  int          // Number of `=` in the opening bracket.
+	base     lexer.Token  // Token used to initiate argument lexing.
+	comments bool         // Whether to emit comment tokens.
+	eof      *lexer.Token // The EOF token, once it has been returned.
 }
 
 // driver is a ScanState-compatible wrapper over tableLexer.
@@ -105,9 +108,12 @@ type driver tableLexer
 type splitLexer struct {
 	file lexer.Lexer
 	arg  lexer.Lexer
+
+	strictUTF8 bool // Whether to reject unquoted arguments containing invalid UTF-8.
 }
 
 // Next implements the lexer.Lexer interface for splitLexer.
+// As with tableLexer, calls after EOF continue to return EOF.
 func (s *splitLexer) Next() (lexer.Token, error) {
 	if s.arg != nil {
 		if next, err := s.arg.Next(); !(err == nil && next.Type == lexer.EOF) {
@@ -119,6 +125,9 @@ func (s *splitLexer) Next() (lexer.Token, error) {
 	if err != nil {
 		return next, err
 	}
+	if s.strictUTF8 && next.Type == Unquoted && !utf8.ValidString(next.Value) {
+		return next, invalidUTF8Error(next, s.file.(*tableLexer).s.Condition())
+	}
 	switch next.Type {
 	case Quoted, Unquoted:
 		arg := newArgumentLexer(next)
@@ -138,6 +147,8 @@ func newFileLexer(r io.Reader) *tableLexer {
 		nil,
 		-1,
 		lexer.Token{},
+		false,
+		nil,
 	}
 }
 
@@ -148,6 +159,8 @@ func newArgumentLexer(base lexer.Token) *tableLexer {
 		nil,
 		-1,
 		base,
+		false,
+		nil,
 	}
 	l.s.SetPosition(base.Pos)
 	return l
@@ -155,15 +168,22 @@ func newArgumentLexer(base lexer.Token) *tableLexer {
 
 // newSplitLexer constructs a new CMakeLists lexer over the given io.Reader.
 func newSplitLexer(r io.Reader) *splitLexer {
-	return &splitLexer{newFileLexer(r), nil}
+	return &splitLexer{newFileLexer(r), nil, false}
 }
 
 // Next implements lexer.Lexer interface for tableLexer.
+// Once EOF has been returned, subsequent calls return the same EOF token without scanning further.
 func (l *tableLexer) Next() (lexer.Token, error) {
+	if l.eof != nil {
+		return *l.eof, nil
+	}
 	for {
 		if len(l.buf) > 0 {
 			tok := l.buf[0]
 			l.buf = l.buf[1:]
+			if tok.Type == lexer.EOF {
+				l.eof = &tok
+			}
 			return tok, nil
 		}
 		if err := l.advance(); err != nil {
@@ -209,20 +229,55 @@ func (d *driver) Token() *lexer.Token {
 }
 
 func lexNewline(d rules.ScanState) (bool, error) {
-	setValue(d.Token(), Newline, string(d.Bytes()))
 	d.Begin(initialCondition)
+	if d.Token().Type == Comment {
+		// Emit the retained comment and the newline which immediately follows it.
+		appendAfterComment(d, Newline, string(d.Bytes()))
+		return true, nil
+	}
+	setValue(d.Token(), Newline, string(d.Bytes()))
 	return true, nil
 }
 
+// appendAfterComment adds a token immediately following the retained comment being lexed.
+func appendAfterComment(d rules.ScanState, kind rune, value string) {
+	tok := d.Token()
+	pos := tok.Pos
+	pos.Offset += len(tok.Value)
+	pos.Column += utf8.RuneCountInString(tok.Value)
+	l := d.(*driver)
+	l.buf = append(l.buf, lexer.Token{
+		Pos:   pos,
+		Type:  kind,
+		Value: value,
+	})
+}
+
 func lexCommentStart(d rules.ScanState) (bool, error) {
+	if d.(*driver).comments {
+		setValue(d.Token(), Comment, string(d.Bytes()))
+	}
 	d.Begin(commentCondition)
 	return false, nil
 }
 
 func lexComment(d rules.ScanState) (bool, error) {
+	if d.Token().Type == Comment {
+		appendText(d.Token(), string(d.Bytes()))
+	}
 	return false, nil
 }
 
+func lexCommentEOF(d rules.ScanState) (bool, error) {
+	d.Begin(initialCondition)
+	if d.Token().Type == Comment {
+		appendAfterComment(d, lexer.EOF, "")
+		return true, nil
+	}
+	*d.Token() = lexer.EOFToken(d.(*driver).s.Pos())
+	return true, nil
+}
+
 func lexParen(d rules.ScanState) (bool, error) {
 	setValue(d.Token(), Punct, string(d.Bytes()))
 	return true, nil
@@ -260,7 +315,7 @@ func lexBracketClose(d rules.ScanState) (bool, error) {
 	l := d.(*driver)
 	l.Begin(initialCondition)
 	tok.Value = tok.Value[0 : len(tok.Value)-l.bracket]
-	if tok.Type == BracketComment {
+	if tok.Type == BracketComment && !l.comments {
 		return false, nil
 	}
 	return true, nil
@@ -277,8 +332,9 @@ func lexBracketReset(d rules.ScanState) (bool, error) {
 }
 
 func lexBracketEOF(d rules.ScanState) (bool, error) {
+	err := newError(d, d.Token().Value, "unterminated bracket with text: %s", d.Token().Value)
 	d.Begin(initialCondition)
-	return true, lexer.Errorf(d.Token().Pos, "unterminated bracket with text: %s", d.Token().Value)
+	return true, err
 }
 
 func lexUnquoted(d rules.ScanState) (bool, error) {
@@ -319,8 +375,9 @@ func lexEndQuote(d rules.ScanState) (bool, error) {
 }
 
 func lexQuotedEOF(d rules.ScanState) (bool, error) {
+	err := newError(d, d.Token().Value, "unterminated string with value: %q", d.Token().Value)
 	d.Begin(initialCondition)
-	return true, lexer.Errorf(d.Token().Pos, "unterminated string with value: %q", d.Token().Value)
+	return true, err
 }
 
 func lexSpace(d rules.ScanState) (bool, error) {
@@ -330,7 +387,7 @@ func lexSpace(d rules.ScanState) (bool, error) {
 
 func lexUnexpected(d rules.ScanState) (bool, error) {
 	rn, _ := utf8.DecodeRune(d.Bytes())
-	return true, lexer.Errorf(d.Token().Pos, "invalid token %q", rn)
+	return true, newError(d, string(d.Bytes()), "invalid token %q", rn)
 }
 
 func lexEOF(d rules.ScanState) (bool, error) {
@@ -362,6 +419,41 @@ func lexArgument(d rules.ScanState) (bool, error) {
 	return true, nil
 }
 
+// newError returns an Error at the position of the current token.
+func newError(d rules.ScanState, text, format string, args ...interface{}) *Error {
+	return &Error{
+		Pos:       d.Token().Pos,
+		Text:      text,
+		Condition: d.(*driver).s.Condition(),
+		Msg:       fmt.Sprintf(format, args...),
+	}
+}
+
+// invalidUTF8Error returns an error positioned at the first invalid UTF-8 byte within tok.
+func invalidUTF8Error(tok lexer.Token, cond rules.StartCondition) *Error {
+	pos, value := tok.Pos, tok.Value
+	for len(value) > 0 {
+		r, width := utf8.DecodeRuneInString(value)
+		if r == utf8.RuneError && width == 1 {
+			break
+		}
+		pos.Offset += width
+		if r == '\n' {
+			pos.Line++
+			pos.Column = 1
+		} else {
+			pos.Column++
+		}
+		value = value[width:]
+	}
+	return &Error{
+		Pos:       pos,
+		Text:      value[:1],
+		Condition: cond,
+		Msg:       fmt.Sprintf("invalid UTF-8 byte %#x", value[0]),
+	}
+}
+
 func setValue(t *lexer.Token, kind rune, value string) {
 	t.Type = kind
 	t.Value = value
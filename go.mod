@@ -1,6 +1,6 @@
 module github.com/kythe/llvmbzlgen
 
-go 1.12
+go 1.16
 
 require (
 	bitbucket.org/creachadair/stringset v0.0.9
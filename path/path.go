@@ -19,7 +19,10 @@ package path
 
 import (
 	"path/filepath"
+	"sort"
 	"strings"
+
+	"github.com/kythe/llvmbzlgen/writer"
 )
 
 // Path is a slice of string segments, representing a filesystem path.
@@ -63,6 +66,55 @@ func (p Path) LessThan(o Path) bool {
 	return false
 }
 
+// HasPrefix returns true if prefix is a whole-segment prefix of the path.
+// Absolute paths are never prefixed by relative paths or vice versa.
+func (p Path) HasPrefix(prefix Path) bool {
+	if len(prefix) > len(p) {
+		return false
+	}
+	for i := range prefix {
+		if p[i] != prefix[i] {
+			return false
+		}
+	}
+	return true
+}
+
+// TrimPrefix returns the path without the provided whole-segment prefix and true,
+// or the unmodified path and false if the prefix is not present.
+func (p Path) TrimPrefix(prefix Path) (Path, bool) {
+	if !p.HasPrefix(prefix) {
+		return p, false
+	}
+	return p[len(prefix):], true
+}
+
+// Clean returns the shortest path equivalent to p, collapsing "." and ".." segments.
+// Leading ".." segments are retained in relative paths and dropped from absolute paths.
+// For any path, New(p.String()) is equal to p.Clean().
+func (p Path) Clean() Path {
+	var clean Path
+	abs := len(p) > 0 && p[0] == "/"
+	if abs {
+		clean, p = Path{"/"}, p[1:]
+	}
+	for _, seg := range p {
+		switch {
+		case seg == "" || seg == ".":
+		case seg != "..":
+			clean = append(clean, seg)
+		case len(clean) > 0 && clean[len(clean)-1] != ".." && clean[len(clean)-1] != "/":
+			clean = clean[:len(clean)-1]
+		case !abs:
+			clean = append(clean, seg)
+		}
+	}
+	if len(clean) == 0 {
+		return nil
+	}
+	return clean
+}
+
 // String returns the properly platform-delimited form of the path.
 func (p Path) String() string {
 	if len(p) == 0 {
@@ -71,6 +123,78 @@ func (p Path) String() string {
 	return filepath.Join([]string(p)...)
 }
 
+// MarshalStarlark implements writer.Marshaler, encoding the path as a '/'-delimited string
+// regardless of the platform separator.
+func (p Path) MarshalStarlark() ([]byte, error) {
+	return writer.Marshal(p.slashString())
+}
+
+// slashString returns the '/'-delimited form of the path, as used by io/fs.
+func (p Path) slashString() string {
+	switch {
+	case len(p) == 0:
+		return "."
+	case p[0] == "/":
+		return "/" + strings.Join(p[1:], "/")
+	default:
+		return strings.Join(p, "/")
+	}
+}
+
+// Equal returns true if a and b refer to the same path once cleaned.
+func Equal(a, b Path) bool {
+	a, b = a.Clean(), b.Clean()
+	if len(a) != len(b) {
+		return false
+	}
+	for i := range a {
+		if a[i] != b[i] {
+			return false
+		}
+	}
+	return true
+}
+
+// PathSet is a set of paths, keyed by their String() form.
+// The zero value is an empty set ready for use.
+type PathSet struct {
+	paths map[string]Path
+}
+
+// Add inserts the path into the set, returning false if an equal path was already present.
+func (s *PathSet) Add(p Path) bool {
+	if s.paths == nil {
+		s.paths = make(map[string]Path)
+	}
+	key := p.String()
+	if _, ok := s.paths[key]; ok {
+		return false
+	}
+	s.paths[key] = p.Clean()
+	return true
+}
+
+// Contains returns true if a path equal to p is in the set.
+func (s *PathSet) Contains(p Path) bool {
+	_, ok := s.paths[p.String()]
+	return ok
+}
+
+// Len returns the number of paths in the set.
+func (s *PathSet) Len() int {
+	return len(s.paths)
+}
+
+// Slice returns the cleaned paths in the set, in lexicographic order.
+func (s *PathSet) Slice() []Path {
+	paths := make([]Path, 0, len(s.paths))
+	for _, p := range s.paths {
+		paths = append(paths, p)
+	}
+	sort.Slice(paths, func(i, j int) bool { return paths[i].LessThan(paths[j]) })
+	return paths
+}
+
 // Append appends additional elements to the end of path, disregarding
 // the leading '/' on appended elements.
 func Append(p Path, ps ...Path) Path {
@@ -90,11 +214,10 @@ func AppendString(p Path, elem ...string) Path {
 }
 
 // Join joins any number of paths and returns the result.
+// Unlike Append, the result never shares storage with p, so sibling paths joined to
+// a common parent, as during Walk, do not overwrite one another.
 func Join(p Path, ps ...Path) Path {
-	if len(ps) == 0 {
-		return p[:]
-	}
-	return Append(p[:], ps...)
+	return Append(append(Path(nil), p...), ps...)
 }
 
 // JoinString joins path and any number of additional string elements, returning the result.
@@ -17,9 +17,12 @@
 package path
 
 import (
+	"io/fs"
 	"testing"
+	"testing/fstest"
 
 	"github.com/google/go-cmp/cmp"
+	"github.com/kythe/llvmbzlgen/writer"
 )
 
 func TestStripCommonRoot(t *testing.T) {
@@ -126,6 +129,55 @@ func TestWalkPath(t *testing.T) {
 	}
 }
 
+// reversedFS is an fs.ReadDirFS which lists directory entries in reverse order.
+type reversedFS struct {
+	fstest.MapFS
+}
+
+// ReadDir implements fs.ReadDirFS for reversedFS.
+func (r reversedFS) ReadDir(name string) ([]fs.DirEntry, error) {
+	entries, err := r.MapFS.ReadDir(name)
+	for i, j := 0, len(entries)-1; i < j; i, j = i+1, j-1 {
+		entries[i], entries[j] = entries[j], entries[i]
+	}
+	return entries, err
+}
+
+func TestSubdirectoriesSorted(t *testing.T) {
+	fsys := reversedFS{fstest.MapFS{
+		"root/a/x/CMakeLists.txt": {},
+		"root/a/y/CMakeLists.txt": {},
+		"root/b/CMakeLists.txt":   {},
+		"root/c/z/CMakeLists.txt": {},
+		"root/CMakeLists.txt":     {},
+	}}
+	var visited, retained []Path
+	err := Walk(New("root"), PreVisitor(func(dir Path) ([]Path, error) {
+		visited = append(visited, append(Path(nil), dir...))
+		retained = append(retained, dir)
+		return Subdirectories(fsys, dir)
+	}))
+	if err != nil {
+		t.Fatal("Unexpected error walking: ", err)
+	}
+	expected := []Path{
+		{"root"},
+		{"root", "a"},
+		{"root", "a", "x"},
+		{"root", "a", "y"},
+		{"root", "b"},
+		{"root", "c"},
+		{"root", "c", "z"},
+	}
+	if diff := cmp.Diff(expected, visited); diff != "" {
+		t.Errorf("Unexpected traversal:\n%s", diff)
+	}
+	// Paths passed to the visitor remain valid after their siblings are visited.
+	if diff := cmp.Diff(expected, retained); diff != "" {
+		t.Errorf("Unexpected retained paths:\n%s", diff)
+	}
+}
+
 func TestPathLen(t *testing.T) {
 	type test struct {
 		input    string
@@ -143,3 +195,139 @@ func TestPathLen(t *testing.T) {
 		}
 	}
 }
+
+func TestPathPrefix(t *testing.T) {
+	type test struct {
+		path, prefix string
+		expected     bool
+		trimmed      string
+	}
+	tests := []test{
+		{"/a/b/c", "/a/b", true, "c"},
+		{"/a/b/c", "/a/b/c", true, "."},
+		{"/a/b/c", "/", true, "a/b/c"},
+		{"a/b/c", ".", true, "a/b/c"},
+		{"a/b/c", "a", true, "b/c"},
+		// Only whole-segments allowed.
+		{"/a/bb", "/a/b", false, "/a/bb"},
+		{"/a/b", "/a/b/c", false, "/a/b"},
+		// Absolute and relative roots do not match.
+		{"/a/b/c", "a/b", false, "/a/b/c"},
+		{"a/b/c", "/a/b", false, "a/b/c"},
+	}
+	for _, test := range tests {
+		path, prefix := New(test.path), New(test.prefix)
+		if actual := path.HasPrefix(prefix); actual != test.expected {
+			t.Errorf("%s.HasPrefix(%s) = %v; want %v", path, prefix, actual, test.expected)
+		}
+		trimmed, ok := path.TrimPrefix(prefix)
+		if ok != test.expected || trimmed.String() != test.trimmed {
+			t.Errorf("%s.TrimPrefix(%s) = %s, %v; want %s, %v", path, prefix, trimmed, ok, test.trimmed, test.expected)
+		}
+	}
+}
+
+func TestPathClean(t *testing.T) {
+	tests := []struct {
+		input    Path
+		expected Path
+	}{
+		{nil, nil},
+		{Path{"."}, nil},
+		{Path{"a", ".", "b"}, Path{"a", "b"}},
+		{Path{"a", "..", "b"}, Path{"b"}},
+		{Path{"a", "b", "..", ".."}, nil},
+		{Path{"..", "a"}, Path{"..", "a"}},
+		{Path{"a", "..", "..", "b"}, Path{"..", "b"}},
+		{Path{"/", ".."}, Path{"/"}},
+		{Path{"/", "a", "..", "..", "b"}, Path{"/", "b"}},
+		{Path{"/", ".", "a", "", "b", "."}, Path{"/", "a", "b"}},
+		{Join(New("/a/b"), New("../c")), Path{"/", "a", "c"}},
+		{AppendString(New("a"), "..", "..", "b"), Path{"..", "b"}},
+	}
+	for _, test := range tests {
+		clean := test.input.Clean()
+		if diff := cmp.Diff(test.expected, clean); diff != "" {
+			t.Errorf("Unexpected Clean(%#v):\n%s", test.input, diff)
+		}
+		if diff := cmp.Diff(New(test.input.String()), clean); diff != "" {
+			t.Errorf("New(%#v.String()) differs from Clean():\n%s", test.input, diff)
+		}
+		if diff := cmp.Diff(clean, clean.Clean()); diff != "" {
+			t.Errorf("Clean(%#v) is not idempotent:\n%s", test.input, diff)
+		}
+	}
+}
+
+func TestEqual(t *testing.T) {
+	tests := []struct {
+		a, b     Path
+		expected bool
+	}{
+		{New("a/b/c"), Path{"a", "b", "c"}, true},
+		{New("a/b/../c"), JoinString(New("a"), "c"), true},
+		{Path{"a", ".", "b"}, New("a/b/"), true},
+		{nil, New("."), true},
+		{New("/a/b"), New("a/b"), false},
+		{New("a/b"), New("a/b/c"), false},
+		{New("a/b"), New("a/c"), false},
+	}
+	for _, test := range tests {
+		if actual := Equal(test.a, test.b); actual != test.expected {
+			t.Errorf("Equal(%#v, %#v) = %v, expected %v", test.a, test.b, actual, test.expected)
+		}
+		if actual := Equal(test.b, test.a); actual != test.expected {
+			t.Errorf("Equal(%#v, %#v) = %v, expected %v", test.b, test.a, actual, test.expected)
+		}
+	}
+}
+
+func TestPathSet(t *testing.T) {
+	var set PathSet
+	if set.Contains(New("a")) {
+		t.Error("Empty set unexpectedly contains a")
+	}
+	for _, p := range []Path{New("b/c"), New("a"), Path{"b", "c"}, New("b/./c"), New("/a"), New("x/../a")} {
+		set.Add(p)
+	}
+	if set.Add(New("a")) {
+		t.Error("Add of existing path returned true")
+	}
+	if !set.Contains(Path{"b", ".", "c"}) {
+		t.Error("Expected set to contain b/c")
+	}
+	if set.Contains(New("c")) {
+		t.Error("Set unexpectedly contains c")
+	}
+	expected := []Path{{"/", "a"}, {"a"}, {"b", "c"}}
+	if diff := cmp.Diff(expected, set.Slice()); diff != "" {
+		t.Errorf("Unexpected set contents:\n%s", diff)
+	}
+	if set.Len() != len(expected) {
+		t.Errorf("Expected Len() of %d, found %d", len(expected), set.Len())
+	}
+}
+
+func TestMarshalStarlark(t *testing.T) {
+	tests := []struct {
+		path     Path
+		expected string
+	}{
+		{New("a/b/c"), `"a/b/c"`},
+		{New("/a/b"), `"/a/b"`},
+		{New("/"), `"/"`},
+		{nil, `"."`},
+		// Segments are always joined with '/', never the platform separator.
+		{Path{"a", "b", "c"}, `"a/b/c"`},
+	}
+	for _, test := range tests {
+		out, err := writer.Marshal(test.path)
+		if err != nil {
+			t.Errorf("Marshal(%#v) failed: %v", test.path, err)
+			continue
+		}
+		if string(out) != test.expected {
+			t.Errorf("Marshal(%#v) = %s, expected %s", test.path, out, test.expected)
+		}
+	}
+}
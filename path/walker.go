@@ -16,6 +16,11 @@
 
 package path
 
+import (
+	"io/fs"
+	"sort"
+)
+
 // Visitor is an interface which visit on the provided path.
 type Visitor interface {
 	Enter(dir Path) ([]Path, error) // Preorder, returns the paths of children to visit. Children must be relative to dir.
@@ -45,3 +50,22 @@ func Walk(root Path, visit Visitor) error {
 	}
 	return visit.Leave(root)
 }
+
+// Subdirectories returns the names of the immediate subdirectories of dir within fsys,
+// sorted by LessThan so that traversals derived from the listing are deterministic
+// regardless of the order in which fsys returns entries.
+// It is suitable for use as a PreVisitor, e.g. PreVisitor(func(dir Path) ([]Path, error) { return Subdirectories(fsys, dir) }).
+func Subdirectories(fsys fs.FS, dir Path) ([]Path, error) {
+	entries, err := fs.ReadDir(fsys, dir.slashString())
+	if err != nil {
+		return nil, err
+	}
+	var children []Path
+	for _, entry := range entries {
+		if entry.IsDir() {
+			children = append(children, Path{entry.Name()})
+		}
+	}
+	sort.Slice(children, func(i, j int) bool { return children[i].LessThan(children[j]) })
+	return children, nil
+}
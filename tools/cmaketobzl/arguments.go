@@ -0,0 +1,92 @@
+/*
+ * Copyright 2019 The Kythe Authors. All rights reserved.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *   http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package main
+
+import (
+	"fmt"
+
+	"github.com/alecthomas/participle/lexer"
+)
+
+// arguments parses the evaluated arguments of a command, reporting uniform errors
+// which include the name and position of the command.
+type arguments struct {
+	cmd    string
+	pos    lexer.Position
+	values []string
+}
+
+// newArguments returns arguments for parsing the evaluated values of the named command at pos.
+func newArguments(cmd string, pos lexer.Position, values []string) *arguments {
+	return &arguments{cmd, pos, values}
+}
+
+// errorf returns an error describing a problem with the command's arguments.
+func (a *arguments) errorf(format string, args ...interface{}) error {
+	return fmt.Errorf("%s() at %s: %s", a.cmd, a.pos, fmt.Sprintf(format, args...))
+}
+
+// Require removes and returns the leading n arguments, or an error if fewer remain.
+func (a *arguments) Require(n int) ([]string, error) {
+	if len(a.values) < n {
+		return nil, a.errorf("requires %d or more arguments, found %d", n, len(a.values))
+	}
+	head := a.values[:n]
+	a.values = a.values[n:]
+	return head, nil
+}
+
+// Optional removes the trailing keyword and returns true if it is the final argument.
+func (a *arguments) Optional(keyword string) bool {
+	if len(a.values) > 0 && a.values[len(a.values)-1] == keyword {
+		a.values = a.values[:len(a.values)-1]
+		return true
+	}
+	return false
+}
+
+// Keyword removes the final occurrence of keyword and the arguments which follow it, returning those arguments
+// and true. Returns an error if the keyword is followed by fewer than min or more than max arguments.
+func (a *arguments) Keyword(keyword string, min, max int) ([]string, bool, error) {
+	for i := len(a.values) - 1; i >= 0; i-- {
+		if a.values[i] != keyword {
+			continue
+		}
+		tail := a.values[i+1:]
+		if len(tail) < min || len(tail) > max {
+			return nil, false, a.errorf("%s requires between %d and %d arguments, found %d", keyword, min, max, len(tail))
+		}
+		a.values = a.values[:i]
+		return tail, true, nil
+	}
+	return nil, false, nil
+}
+
+// Remaining removes and returns any remaining arguments.
+func (a *arguments) Remaining() []string {
+	rest := a.values
+	a.values = nil
+	return rest
+}
+
+// Done returns an error if any arguments remain.
+func (a *arguments) Done() error {
+	if len(a.values) > 0 {
+		return a.errorf("unexpected extra arguments %q", a.values)
+	}
+	return nil
+}
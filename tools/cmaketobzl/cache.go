@@ -0,0 +1,78 @@
+/*
+ * Copyright 2019 The Kythe Authors. All rights reserved.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *   http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"os"
+	"regexp"
+	"strings"
+
+	"github.com/kythe/llvmbzlgen/cmakelib/bindings"
+)
+
+// cacheEntryPattern matches a KEY:TYPE=VALUE line of a CMakeCache.txt file, where the key may be quoted
+// and the type omitted.
+var cacheEntryPattern = regexp.MustCompile(`^(?:"([^"]*)"|([^":=]+))(?::([^=]*))?=(.*)$`)
+
+// ReadCache reads CMakeCache.txt-formatted entries from r into the CACHE scope of vars.
+// Blank lines, '#' comments and '//' documentation lines are ignored.
+// Values enclosed in matching single or double quotes have the quotes removed and
+// ;-lists are stored as-is.
+func ReadCache(r io.Reader, vars *bindings.Mapping) error {
+	s := bufio.NewScanner(r)
+	for line := 1; s.Scan(); line++ {
+		text := strings.TrimSpace(s.Text())
+		if text == "" || strings.HasPrefix(text, "#") || strings.HasPrefix(text, "//") {
+			continue
+		}
+		m := cacheEntryPattern.FindStringSubmatch(text)
+		if m == nil {
+			return fmt.Errorf("line %d: invalid cache entry: %s", line, text)
+		}
+		key, typ, value := m[1]+m[2], m[3], m[4]
+		if len(value) >= 2 && (value[0] == '\'' || value[0] == '"') && value[len(value)-1] == value[0] {
+			value = value[1 : len(value)-1]
+		}
+		vars.SetCacheTyped(key, typ, value)
+	}
+	return s.Err()
+}
+
+// LoadCache configures the evaluator to seed its CACHE scope from the named CMakeCache.txt file,
+// as read by ReadCache. Errors reading the file cause walk to fail.
+func LoadCache(path string) Option {
+	return func(e *eval) {
+		if err := loadCache(path, e.v); err != nil && e.optErr == nil {
+			e.optErr = err
+		}
+	}
+}
+
+func loadCache(path string, vars *bindings.Mapping) error {
+	f, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	if err := ReadCache(f, vars); err != nil {
+		return fmt.Errorf("%s: %v", path, err)
+	}
+	return nil
+}
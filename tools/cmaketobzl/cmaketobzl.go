@@ -17,26 +17,38 @@
 package main
 
 import (
+	"bytes"
 	"flag"
 	"fmt"
 	"io"
+	"io/fs"
 	"log"
 	"os"
 	"path"
+	"path/filepath"
 	"regexp"
+	"sort"
 	"strconv"
 	"strings"
 
-	"go/constant"
-	"go/token"
-	"go/types"
-
 	"github.com/kythe/llvmbzlgen/cmakelib/ast"
 	"github.com/kythe/llvmbzlgen/cmakelib/bindings"
+	"github.com/kythe/llvmbzlgen/cmakelib/lexer"
 	bzlpath "github.com/kythe/llvmbzlgen/path"
 	"github.com/kythe/llvmbzlgen/writer"
 )
 
+var (
+	parallelism  = flag.Int("parallelism", 1, "Number of subdirectories to evaluate concurrently.")
+	outputFormat = flag.String("output_format", "starlark", "Output format, one of starlark or json.")
+	macroName    = flag.String("macro_name", "generated_cmake_targets", "Name of the generated Starlark macro.")
+	macroPerRoot = flag.Bool("macro_per_root", false, "Write one macro per input path, named after its path relative to the common root, rather than a single macro.")
+	cacheFile    = flag.String("cache", "", "CMakeCache.txt file from which to seed the CACHE variables.")
+	commandsFile = flag.String("commands_file", "", "File listing the commands to print, one name or pattern per line.")
+	pathsFrom    = flag.String("paths_from", "", "File listing additional input paths, one per line, or - to read them from stdin.")
+	printGrammar = flag.Bool("grammar", false, "Print the grammar of the CMakeLists parser and exit.")
+)
+
 // blockCounter counts active blocks of the given name for matching
 // paired CMake commands.
 type blockCounter struct {
@@ -54,6 +66,8 @@ func newCounter(begin string) *blockCounter {
 // Count increments the internal counter if text matches the begin delimiter,
 // decrements it if it matches the end delimiter and returns true if text
 // matched a delimiter or the current count is greater than zero.
+// Branches, such as elseif and else, neither match nor change the count, so are counted
+// as part of the enclosing block.
 func (bc *blockCounter) Count(text string) bool {
 	matched := true
 	if text == bc.begin {
@@ -66,31 +80,337 @@ func (bc *blockCounter) Count(text string) bool {
 	return matched || bc.count > 0
 }
 
+// assignmentWriter is implemented by writers which support writing variable assignments.
+type assignmentWriter interface {
+	WriteAssignment(name string, value interface{}) error
+}
+
+// positionWriter is implemented by writers which record the source position of commands.
+type positionWriter interface {
+	WriteCommandAt(pos writer.Position, cmd string, args ...interface{}) error
+}
+
+// positionAssignmentWriter is implemented by writers which record the source position of assignments.
+type positionAssignmentWriter interface {
+	WriteAssignmentAt(pos writer.Position, name string, value interface{}) error
+}
+
+// commentWriter is implemented by writers which support writing comments.
+type commentWriter interface {
+	WriteComment(text string) error
+}
+
+// comprehensionWriter is implemented by writers which support writing list comprehensions.
+type comprehensionWriter interface {
+	WriteComprehension(cmd string, varName string, items []string, fixedArgs ...string) error
+}
+
+// writeCommandAt writes the command to w, including its position if supported.
+func writeCommandAt(w writer.Writer, pos writer.Position, cmd string, args ...interface{}) error {
+	if pw, ok := w.(positionWriter); ok {
+		return pw.WriteCommandAt(pos, cmd, args...)
+	}
+	return w.WriteCommand(cmd, args...)
+}
+
+// writeAssignment writes the assignment to w, or the equivalent set() command if unsupported.
+func writeAssignment(w writer.Writer, name string, value interface{}) error {
+	if aw, ok := w.(assignmentWriter); ok {
+		return aw.WriteAssignment(name, value)
+	}
+	return w.WriteCommand("set", name, value)
+}
+
+// writeAssignmentAt writes the assignment to w as writeAssignment does, including its position if supported.
+func writeAssignmentAt(w writer.Writer, pos writer.Position, name string, value interface{}) error {
+	if pw, ok := w.(positionAssignmentWriter); ok {
+		return pw.WriteAssignmentAt(pos, name, value)
+	}
+	return writeAssignment(w, name, value)
+}
+
+// writeComprehension writes the comprehension to w, or the equivalent commands if unsupported.
+func writeComprehension(w writer.Writer, cmd string, varName string, items []string, fixedArgs ...string) error {
+	if cw, ok := w.(comprehensionWriter); ok {
+		return cw.WriteComprehension(cmd, varName, items, fixedArgs...)
+	}
+	for _, item := range items {
+		args := append(append([]string(nil), fixedArgs...), item)
+		if err := w.WriteCommand(cmd, writer.ArgumentLiterals(args)); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// writeComment writes the comment to w, if supported.
+func writeComment(w writer.Writer, text string) error {
+	if cw, ok := w.(commentWriter); ok {
+		return cw.WriteComment(text)
+	}
+	return nil
+}
+
+// osFS is an fs.FS which opens files from the host filesystem.
+// Unlike os.DirFS, it accepts both absolute and relative paths.
+type osFS struct{}
+
+// Open implements fs.FS for osFS.
+func (osFS) Open(name string) (fs.File, error) {
+	return os.Open(name)
+}
+
+// Stats summarizes an evaluation.
+type Stats struct {
+	CommandsEmitted    int // The number of commands and assignments written.
+	DirectoriesEntered int // The number of directories evaluated.
+	PathsExcluded      int // The number of subdirectories skipped by ExcludePaths.
+	UnknownCommands    int // The number of commands which were neither evaluated, printed nor recursed into.
+}
+
+// add adds the counts from o to s.
+func (s *Stats) add(o Stats) {
+	s.CommandsEmitted += o.CommandsEmitted
+	s.DirectoriesEntered += o.DirectoriesEntered
+	s.PathsExcluded += o.PathsExcluded
+	s.UnknownCommands += o.UnknownCommands
+}
+
+// String returns a one-line summary of the statistics.
+func (s Stats) String() string {
+	return fmt.Sprintf("%d commands emitted, %d directories entered, %d paths excluded, %d unknown commands",
+		s.CommandsEmitted, s.DirectoriesEntered, s.PathsExcluded, s.UnknownCommands)
+}
+
+// VersionRange is a minimum and optional maximum CMake version.
+type VersionRange struct {
+	Min string
+	Max string // The empty string if unbounded.
+}
+
 type eval struct {
 	p *ast.Parser
 	o options
 
-	w    *writer.StarlarkWriter
-	v    *bindings.Mapping
-	root bzlpath.Path
-	path bzlpath.Path
+	w     writer.Writer
+	v     *bindings.Mapping
+	root  bzlpath.Path
+	path  bzlpath.Path
+	props map[propertyKey]string
+	last  []string // The name and arguments of the most recently printed command, if any.
+
+	configured [][]string // The outputs of configure_file() commands in each entered directory.
+	stats      Stats
+
+	requiredVersion VersionRange
+	commands        map[string]*commandDefinition // User-defined functions and macros.
+	callDepth       int
+	loopDepth       int         // The number of enclosing loops within the current file or function.
+	flow            controlFlow // Set by break(), continue() and return() to stop evaluating commands.
+
+	workers chan struct{} // Semaphore limiting concurrent subdirectory evaluation, if enabled.
+	warning error         // The first warning reported in strict mode, if any.
+	evalErr error         // The first error evaluating command arguments, if any.
+	optErr  error         // The first error applying options, if any, returned by walk.
 }
 
 type options struct {
-	macroName   string
-	shouldPrint func(string) bool
-	shouldAdd   func(string) bool
-	excludePath func(string) bool
+	macroName     string
+	projectRoot   string
+	maxIterations int
+	parallelism   int
+	shouldPrint   func(string) bool
+	printIf       func(string, []string) bool
+	messages      func(string, string)
+	comprehend    bool
+	evalForeach   bool
+	resolveSubdir func(string, string) (string, bool)
+	onEnter       func(bzlpath.Path) error
+	onLeave       func(bzlpath.Path) error
+	macroPerRoot  bool
+	parseCache    *ParseCache
+	rewrite       func(string, []string) (string, []string, bool)
+	transformName func(string) string
+	assign        func(string) bool
+	shouldAdd     func(string) bool
+	recurseWhen   func(string, []string, *bindings.Mapping) bool
+	excludePath   func(string) bool
+	fsys          fs.FS
+	pkgMarkers    []string
+	annotate      bool
+	cacheDocs     bool
+	dedupe        bool
+	logger        Logger
+	setValues     valueRendering
+	fileGroups    bool
+	strict        bool
+	undefinedVars bool
+}
+
+// valueRendering determines how the values of printed set() commands are written.
+type valueRendering int
+
+const (
+	renderArguments valueRendering = iota // Values are written as separate arguments.
+	renderList                            // Values are written as a single list.
+	renderJoined                          // Values are written as a single ;-delimited string.
+)
+
+// Logger receives diagnostics from the evaluator at the given level, e.g. "warning".
+// The message and arguments are formatted as by fmt.Sprintf.
+type Logger func(level, msg string, args ...interface{})
+
+// defaultLogger writes all diagnostics to the standard logger.
+func defaultLogger(level, msg string, args ...interface{}) {
+	log.Printf(msg, args...)
 }
 
 // Option is a configuration option for the CMake evaluator.
 type Option func(*eval)
 
+// MacroName configures the name of the Starlark macro written by the evaluator.
+// Names which are not valid Starlark identifiers are rejected and cause walk to fail.
+func MacroName(name string) Option {
+	return func(e *eval) {
+		if _, err := writer.IdentName(name); err != nil {
+			if e.optErr == nil {
+				e.optErr = fmt.Errorf("invalid macro name: %v", err)
+			}
+			return
+		}
+		e.o.macroName = name
+	}
+}
+
+// ProjectRoot configures the prefix of the project-rooted absolute paths formed by the evaluator,
+// such as CMAKE_CURRENT_SOURCE_DIR, which defaults to "/root".
+// Roots which are not clean absolute paths, or which are "/", are rejected and cause walk to fail.
+func ProjectRoot(root string) Option {
+	return func(e *eval) {
+		if !path.IsAbs(root) || path.Clean(root) != root || root == "/" {
+			if e.optErr == nil {
+				e.optErr = fmt.Errorf("invalid project root: %q must be a clean absolute path other than /", root)
+			}
+			return
+		}
+		e.o.projectRoot = root
+	}
+}
+
+// MacroPerRoot configures the evaluator to write a separate macro for each of the walked paths,
+// named after its path relative to the common root of the walked paths, rather than a single macro named by MacroName.
+// Walking paths whose names would conflict is an error.
+func MacroPerRoot(perRoot bool) Option {
+	return func(e *eval) { e.o.macroPerRoot = perRoot }
+}
+
+// CacheParses configures the evaluator to retrieve parsed files from c, parsing only those
+// whose contents are not already present.
+func CacheParses(c *ParseCache) Option {
+	return func(e *eval) { e.o.parseCache = c }
+}
+
+// StrictMode configures the evaluator to treat warnings as errors, aborting evaluation at the
+// command which caused the first warning rather than reporting it to the logger.
+func StrictMode(strict bool) Option {
+	return func(e *eval) { e.o.strict = strict }
+}
+
+// UndefinedVariableErrors configures the evaluator to abort evaluation at the first ${} reference
+// to a variable which is unset, rather than set to the empty string, reporting the position of the reference.
+func UndefinedVariableErrors(fail bool) Option {
+	return func(e *eval) { e.o.undefinedVars = fail }
+}
+
+// Logging configures the evaluator to report diagnostics using l rather than the standard logger.
+func Logging(l Logger) Option {
+	return func(e *eval) { e.o.logger = l }
+}
+
 // PrintCommands configures the evaluator to print commands on the StarlarkWriter for which the supplied predicate returns true.
 func PrintCommands(p func(string) bool) Option {
 	return func(e *eval) { e.o.shouldPrint = p }
 }
 
+// PrintCommandsIf configures the evaluator to also print commands for which the supplied predicate,
+// given the command name and its evaluated arguments, returns true.
+// A command is printed if either this or the PrintCommands predicate matches.
+func PrintCommandsIf(p func(name string, args []string) bool) Option {
+	return func(e *eval) { e.o.printIf = p }
+}
+
+// CaptureMessages configures the evaluator to invoke f with the mode and text of each message() command.
+// Messages without a mode keyword are reported with the default NOTICE mode.
+// When evaluating in parallel, f is invoked in source order once the evaluation completes.
+func CaptureMessages(f func(mode, text string)) Option {
+	return func(e *eval) { e.o.messages = f }
+}
+
+// ForeachComprehensions configures the evaluator to print a foreach() block whose body is a single printed command,
+// varying only in its final argument, as a list comprehension rather than skipping the block.
+func ForeachComprehensions(enabled bool) Option {
+	return func(e *eval) { e.o.comprehend = enabled }
+}
+
+// EmitCacheDocs configures the evaluator to precede each printed set() of a CACHE variable with
+// a comment containing its documentation string, if supported by the writer.
+func EmitCacheDocs(enable bool) Option {
+	return func(e *eval) { e.o.cacheDocs = enable }
+}
+
+// AnnotateCommands configures the evaluator to precede each printed command with a comment
+// naming the directory from which it originated, if supported by the writer.
+func AnnotateCommands(annotate bool) Option {
+	return func(e *eval) { e.o.annotate = annotate }
+}
+
+// SuppressDuplicateCommands configures the evaluator to omit printed commands which are identical
+// to the immediately preceding command in the same directory.
+func SuppressDuplicateCommands(suppress bool) Option {
+	return func(e *eval) { e.o.dedupe = suppress }
+}
+
+// SetValuesAsLists configures printed set() commands and assignments to render multiple values
+// as a single list. By default, set() commands write each value as a separate argument and
+// assignments use a list.
+func SetValuesAsLists() Option {
+	return func(e *eval) { e.o.setValues = renderList }
+}
+
+// SetValuesJoined configures printed set() commands and assignments to render multiple values
+// as a single ;-delimited string, as CMake stores them.
+func SetValuesJoined() Option {
+	return func(e *eval) { e.o.setValues = renderJoined }
+}
+
+// ConfigureFileGroups configures the evaluator to write a filegroup command listing the outputs
+// of each of the configure_file() commands in a directory upon leaving it.
+// The filegroup is named for the project-relative directory, e.g. "lib_Support_configured_files".
+func ConfigureFileGroups(enable bool) Option {
+	return func(e *eval) { e.o.fileGroups = enable }
+}
+
+// RewriteCommand configures the evaluator to transform printed commands using the provided function.
+// The function receives the command name and evaluated arguments and returns the name and arguments to write
+// or false if the command should be omitted entirely.
+func RewriteCommand(f func(name string, args []string) (string, []string, bool)) Option {
+	return func(e *eval) { e.o.rewrite = f }
+}
+
+// TransformCommandName configures the evaluator to write printed commands under the name returned by f,
+// which is applied after any RewriteCommand. The result must be a valid Starlark identifier.
+func TransformCommandName(f func(name string) string) Option {
+	return func(e *eval) { e.o.transformName = f }
+}
+
+// EmitAssignments configures the evaluator to write printed set() commands for variables matching
+// the provided predicate as Starlark assignments rather than commands.
+// Variables with multiple values are assigned a list.
+// The command is first subject to any RewriteCommand and duplicate suppression, as for other commands.
+func EmitAssignments(p func(name string) bool) Option {
+	return func(e *eval) { e.o.assign = p }
+}
+
 // RecurseCommands configures the evaluator to recurse into the subdirectory
 // specified by the first argument to the command when the provided predicate returns true.
 // By default only "add_subdirectory" is handled this way.
@@ -98,11 +418,76 @@ func RecurseCommands(p func(string) bool) Option {
 	return func(e *eval) { e.o.shouldAdd = p }
 }
 
+// RecurseWhen configures the evaluator to consult the provided predicate before recursing into the
+// subdirectory named by a command selected by RecurseCommands. The predicate receives the command name,
+// its evaluated arguments and the current variable bindings, and returns false to skip the subdirectory.
+func RecurseWhen(p func(name string, args []string, vars *bindings.Mapping) bool) Option {
+	return func(e *eval) { e.o.recurseWhen = p }
+}
+
+// EvaluateForeach configures the evaluator to evaluate the body of a foreach() block once for each item,
+// rather than skipping the block. Blocks printed as comprehensions by ForeachComprehensions are not evaluated.
+func EvaluateForeach(enabled bool) Option {
+	return func(e *eval) { e.o.evalForeach = enabled }
+}
+
+// ResolveSubdirectory configures the evaluator to map the argument of each directory command, given the
+// project-relative current directory, to the directory which is actually evaluated.
+// Subdirectories for which resolve returns false are skipped.
+func ResolveSubdirectory(resolve func(current, arg string) (string, bool)) Option {
+	return func(e *eval) { e.o.resolveSubdir = resolve }
+}
+
+// OnEnterDirectory configures the evaluator to call enter with the project-relative path of each directory
+// before it is evaluated. An error from enter prevents the directory and its subtree from being
+// evaluated and is returned from the traversal.
+// With Parallelism greater than one, enter may be called concurrently for separate subtrees.
+func OnEnterDirectory(enter func(dir bzlpath.Path) error) Option {
+	return func(e *eval) { e.o.onEnter = enter }
+}
+
+// OnLeaveDirectory configures the evaluator to call leave with the project-relative path of each directory
+// after it and its subtree have been evaluated.
+// With Parallelism greater than one, leave may be called concurrently for separate subtrees.
+func OnLeaveDirectory(leave func(dir bzlpath.Path) error) Option {
+	return func(e *eval) { e.o.onLeave = leave }
+}
+
 // ExcludePaths configures the evaluator to omit particular paths entirely during traversal.
+// The predicate is called with both the subdirectory argument as written and the project-relative
+// path of the subdirectory, which is omitted if either matches.
 func ExcludePaths(p func(string) bool) Option {
 	return func(e *eval) { e.o.excludePath = p }
 }
 
+// PackageMarkers configures the names of the files which mark a directory as the root of a Bazel package,
+// as reported by CurrentPackage. The default is BUILD and BUILD.bazel.
+func PackageMarkers(markers []string) Option {
+	return func(e *eval) { e.o.pkgMarkers = markers }
+}
+
+// FileSystem configures the evaluator to read CMakeLists.txt files from fsys rather than the host filesystem.
+// Paths are joined with forward slashes and must be valid for fsys.
+func FileSystem(fsys fs.FS) Option {
+	return func(e *eval) { e.o.fsys = fsys }
+}
+
+// MaxLoopIterations configures the maximum number of iterations a single while() loop may execute
+// before evaluation is aborted with an error.
+func MaxLoopIterations(n int) Option {
+	return func(e *eval) { e.o.maxIterations = n }
+}
+
+// Parallelism configures the evaluator to evaluate subdirectories concurrently using up to n workers.
+// Sibling subdirectories are assumed to be independent: variables set in PARENT_SCOPE or the CACHE
+// and properties set by a subdirectory are not visible to the remainder of its parent or to its siblings.
+// Output is identical to serial evaluation otherwise.
+// Diagnostics are reported to the Logging callback from the calling goroutine, in source order,
+// once evaluation completes, so the callback need not be safe for concurrent use.
+func Parallelism(n int) Option {
+	return func(e *eval) { e.o.parallelism = n }
+}
+
 // DefineVars configures the evaluator to predefine the specified variables.
 func DefineVars(vars map[string]string) Option {
 	return func(e *eval) {
@@ -112,20 +497,130 @@ func DefineVars(vars map[string]string) Option {
 	}
 }
 
+// EnvOverrides configures the evaluator to resolve the specified environment variables,
+// as referenced by $ENV{VAR} or tested by if(DEFINED ENV{VAR}), from vars rather than the host environment.
+func EnvOverrides(vars map[string]string) Option {
+	return func(e *eval) {
+		for k, v := range vars {
+			e.v.SetEnv(k, v)
+		}
+	}
+}
+
+// DefineVarsExpanded configures the evaluator to predefine the specified variables, evaluating each
+// value as a quoted CMake argument so that references such as ${VAR} and $ENV{VAR} are expanded.
+// Unescaped double quotes within a value are taken literally.
+// Environment references are resolved at definition time as during evaluation, so are subject to
+// any preceding EnvOverrides.
+// Variables are defined in sorted key order, so a value may only refer to the specified variables
+// whose keys sort before its own; later keys are not yet defined and expand to the empty string.
+// Values which cannot be parsed are reported as an error by walk.
+func DefineVarsExpanded(vars map[string]string) Option {
+	return func(e *eval) {
+		keys := make([]string, 0, len(vars))
+		for k := range vars {
+			keys = append(keys, k)
+		}
+		sort.Strings(keys)
+		for _, k := range keys {
+			value, err := e.expandValue(vars[k])
+			if err != nil {
+				if e.optErr == nil {
+					e.optErr = fmt.Errorf("unable to expand %s=%q: %v", k, vars[k], err)
+				}
+				continue
+			}
+			e.v.Set(k, value)
+		}
+	}
+}
+
+// expandValue evaluates value as a quoted CMake argument against the current bindings.
+func (e *eval) expandValue(value string) (string, error) {
+	arg, err := ast.ParseQuoted(value)
+	if err != nil {
+		return "", err
+	}
+	ctx := &ast.EvalContext{Bindings: e.v}
+	expanded := arg.EvalIn(ctx)
+	if err := ctx.Err(); err != nil {
+		return "", err
+	}
+	return expanded[0], nil
+}
+
 // Matching compiles the provided pattern and returns a predicate for matching strings.
 func Matching(pat string) func(string) bool {
 	return regexp.MustCompile(pat).MatchString
 }
 
-// NewEvaluator returns a new CMake evaluator instance.
-func NewEvaluator(w io.Writer, opts ...Option) *eval {
+// Glob compiles the provided doublestar-style glob and returns a predicate for matching /-delimited paths.
+// A "*" matches any sequence of characters other than "/", "**" matches any sequence including "/",
+// "?" matches any single character other than "/" and "[...]" matches a character class, negated by
+// a leading "!" or "^". Other characters match themselves. The whole path must match.
+func Glob(pattern string) func(string) bool {
+	re := regexp.MustCompile(globToRegexp(pattern))
+	return func(p string) bool {
+		return re.MatchString(filepath.ToSlash(p))
+	}
+}
+
+// globToRegexp translates the glob pattern into an equivalent anchored regular expression.
+func globToRegexp(pattern string) string {
+	var b strings.Builder
+	b.WriteString("^")
+	for i := 0; i < len(pattern); i++ {
+		switch c := pattern[i]; c {
+		case '*':
+			if strings.HasPrefix(pattern[i:], "**/") {
+				// Match zero or more leading directories.
+				b.WriteString("(?:.*/)?")
+				i += 2
+			} else if strings.HasPrefix(pattern[i:], "**") {
+				b.WriteString(".*")
+				i++
+			} else {
+				b.WriteString("[^/]*")
+			}
+		case '?':
+			b.WriteString("[^/]")
+		case '[':
+			end := strings.IndexByte(pattern[i+1:], ']')
+			if end < 0 {
+				b.WriteString(`\[`)
+				continue
+			}
+			class := pattern[i+1 : i+1+end]
+			if strings.HasPrefix(class, "!") {
+				class = "^" + class[1:]
+			}
+			b.WriteString("[" + strings.Replace(class, `\`, `\\`, -1) + "]")
+			i += end + 1
+		default:
+			b.WriteString(regexp.QuoteMeta(string(c)))
+		}
+	}
+	b.WriteString("$")
+	return b.String()
+}
+
+// NewEvaluator returns a new CMake evaluator instance writing output to w.
+func NewEvaluator(w writer.Writer, opts ...Option) *eval {
 	e := &eval{
-		p: ast.NewParser(),
-		w: writer.NewStarlarkWriter(w),
-		v: bindings.New(),
+		p:     ast.NewParser(),
+		w:     w,
+		v:     bindings.New(),
+		props: make(map[propertyKey]string),
+
+		commands: make(map[string]*commandDefinition),
 		o: options{
-			macroName: "generated_cmake_targets",
-			shouldAdd: func(n string) bool { return n == "add_subdirectory" },
+			macroName:     "generated_cmake_targets",
+			projectRoot:   "/root",
+			maxIterations: 10000,
+			shouldAdd:     func(n string) bool { return n == "add_subdirectory" },
+			fsys:          osFS{},
+			pkgMarkers:    []string{"BUILD", "BUILD.bazel"},
+			logger:        defaultLogger,
 		},
 	}
 	for _, o := range opts {
@@ -141,31 +636,127 @@ func (e *eval) parse(input io.Reader) (*ast.CMakeFile, error) {
 	return e.p.Parse(input)
 }
 
-// parse parses the provided path into a CMakeFile AST.
+// parseFile parses the provided path into a CMakeFile AST, with positions referring to path.
 func (e *eval) parseFile(path string) (*ast.CMakeFile, error) {
-	input, err := os.Open(path)
+	input, err := e.o.fsys.Open(path)
 	if err != nil {
 		return nil, err
 	}
 	defer input.Close()
-	return e.parse(input)
+	if e.o.parseCache == nil {
+		return e.parse(lexer.NamedReader(input, path))
+	}
+	data, err := io.ReadAll(input)
+	if err != nil {
+		return nil, err
+	}
+	return e.o.parseCache.parse(path, data, func() (*ast.CMakeFile, error) {
+		return e.parse(lexer.NamedReader(bytes.NewReader(data), path))
+	})
 }
 
-// walk evaluates all of the provided CMakeLists.txt files into the body of a single Starlark macro..
+// walk evaluates all of the provided CMakeLists.txt files into the body of a single Starlark macro,
+// or one macro per path if so configured.
 func (e *eval) walk(paths []bzlpath.Path) error {
-	if err := e.w.BeginMacro(e.o.macroName); err != nil {
-		return err
+	if e.optErr != nil {
+		return e.optErr
+	}
+	if e.o.parallelism > 1 && e.workers == nil {
+		return e.walkParallel(paths)
 	}
 	root, paths := bzlpath.SplitCommonRoot(paths)
-	e.root = root
-	for _, p := range paths {
-		if err := e.AddSubdirectory(p.String()); err != nil {
+	// Without a meaningful common root, each tree is evaluated under its own.
+	separate := len(paths) > 1 && (len(root) == 0 || (len(root) == 1 && root[0] == "/"))
+	if !separate {
+		e.root = root
+	}
+	var names []string
+	if e.o.macroPerRoot {
+		var err error
+		if names, err = e.rootMacroNames(root, paths); err != nil {
+			return err
+		}
+	} else if err := e.w.BeginMacro(e.o.macroName); err != nil {
+		return err
+	}
+	for i, p := range paths {
+		if e.o.macroPerRoot {
+			if err := e.w.BeginMacro(names[i]); err != nil {
+				return err
+			}
+		}
+		if separate {
+			if len(root) > 0 {
+				p = bzlpath.Join(root, p)
+			}
+			if err := e.walkRoot(p); err != nil {
+				return err
+			}
+		} else if err := e.addSubdirectory(p.String()); err != nil {
 			return err
 		}
+		if e.o.macroPerRoot {
+			if err := e.w.EndMacro(); err != nil {
+				return err
+			}
+		}
+	}
+	if e.o.macroPerRoot {
+		return nil
 	}
 	return e.w.EndMacro()
 }
 
+// rootMacroNames returns the names of the macros for the trees at paths, relative to root, when using MacroPerRoot,
+// or an error if any two trees would be written to macros of the same name.
+func (e *eval) rootMacroNames(root bzlpath.Path, paths []bzlpath.Path) ([]string, error) {
+	names := make([]string, len(paths))
+	seen := make(map[string]bzlpath.Path, len(paths))
+	for i, p := range paths {
+		names[i] = e.rootMacroName(root, p)
+		if prev, ok := seen[names[i]]; ok {
+			return nil, fmt.Errorf("macro name %q of %s conflicts with that of %s", names[i], bzlpath.Join(root, p), bzlpath.Join(root, prev))
+		}
+		seen[names[i]] = p
+	}
+	return names, nil
+}
+
+// rootMacroName returns the name of the macro for the tree at p when using MacroPerRoot,
+// derived from its segments relative to root, or from the final segment of root if p is root itself.
+func (e *eval) rootMacroName(root, p bzlpath.Path) string {
+	if p, root = p.Clean(), root.Clean(); len(p) == 0 && len(root) > 0 {
+		p = root[len(root)-1:]
+	}
+	var segments []string
+	for _, s := range p {
+		if s != "/" && s != ".." {
+			segments = append(segments, s)
+		}
+	}
+	if len(segments) == 0 {
+		return e.o.macroName
+	}
+	name := nonIdentChars.ReplaceAllString(strings.Join(segments, "_"), "_")
+	if name[0] >= '0' && name[0] <= '9' {
+		name = "_" + name
+	}
+	return name
+}
+
+// walkRoot evaluates the CMakeLists.txt in root as a top-level file, within a directory context of root itself.
+func (e *eval) walkRoot(root bzlpath.Path) error {
+	if err := e.w.PushDirectory(root.String()); err != nil {
+		return err
+	}
+	e.root = root
+	if err := e.addSubdirectory("."); err != nil {
+		return err
+	}
+	_, err := e.w.PopDirectory()
+	return err
+}
+
 // dispatchFunc is a function which handles the current command, updates the
 // remaining list of commands and returns a dispatchFunc suitable for processing that remainder.
 type dispatchFunc func(*commandList) (dispatchFunc, error)
@@ -195,11 +786,31 @@ func (e *eval) shouldPrint(name string) bool {
 	return e.o.shouldPrint != nil && e.o.shouldPrint(name)
 }
 
+// shouldPrintCommand returns true if the command given by name should be included in the Starlark output,
+// based on either its name or evaluated arguments.
+func (e *eval) shouldPrintCommand(name string, cmd *ast.CommandInvocation) bool {
+	return e.shouldPrint(name) || (e.o.printIf != nil && e.o.printIf(name, e.evalArgs(cmd)))
+}
+
 // shouldAdd retruns true if the command given by name should be recursed into.
 func (e *eval) shouldAdd(name string) bool {
 	return e.o.shouldAdd != nil && e.o.shouldAdd(name)
 }
 
+// recurseWhen returns true if the directory command given by name and args should be recursed into.
+func (e *eval) recurseWhen(name string, args []string) bool {
+	return e.o.recurseWhen == nil || e.o.recurseWhen(name, args, e.v)
+}
+
+// resolveSubdirectory returns the directory to evaluate for the directory command argument dir,
+// or false if it should be skipped.
+func (e *eval) resolveSubdirectory(dir string) (string, bool) {
+	if e.o.resolveSubdir == nil {
+		return dir, true
+	}
+	return e.o.resolveSubdir(e.CurrentDirectory(), dir)
+}
+
 // excludePath returns true if the path given by dirpath should be skipped.
 func (e *eval) excludePath(dirpath string) bool {
 	return e.o.excludePath != nil && e.o.excludePath(dirpath)
@@ -208,37 +819,94 @@ func (e *eval) excludePath(dirpath string) bool {
 // dispatch evaluates the next command from cmds and returns a new dispatchFunc for handling the remainder.
 func (e *eval) dispatch(cmds *commandList) (dispatchFunc, error) {
 	name := strings.ToLower(string(cmds.Head().Name))
-	if e.shouldPrint(name) {
-		e.PrintCommand(cmds.Head())
+	printed := e.shouldPrintCommand(name, cmds.Head())
+	if printed {
+		if err := e.PrintCommand(cmds.Head()); err != nil {
+			return nil, err
+		}
+	}
+
+	if def, ok := e.commands[name]; ok {
+		if err := e.invokeCommand(cmds.Head(), def); err != nil {
+			return nil, err
+		}
+		cmds.Advance()
+		return e.dispatch, nil
 	}
 
 	switch name {
 	// TODO(shahms): Actually process these.
-	case "if", "function", "foreach", "macro":
+	case "foreach":
+		if e.o.comprehend || e.o.evalForeach {
+			return e.foreachCommand(cmds)
+		}
+		fallthrough
+	case "if":
 		counter := newCounter(name)
 		for counter.Count(name) && cmds.Advance() {
-			name = string(cmds.Head().Name)
+			name = strings.ToLower(cmds.Head().Name)
 		}
 		return e.dispatch, nil
+	case "function", "macro":
+		return e.defineCommand(cmds)
+	case "while":
+		return e.whileCommand(cmds)
+	case "break", "continue", "return":
+		return e.controlCommand(name, cmds.Head())
 	case "string":
-		e.stringCommand(cmds.Head().Arguments.Eval(e.v))
+		e.stringCommand(e.evalArgs(cmds.Head()))
 	case "math":
-		e.mathCommand(cmds.Head().Arguments.Eval(e.v))
+		e.mathCommand(e.evalArgs(cmds.Head()))
+	case "list":
+		e.listCommand(e.evalArgs(cmds.Head()))
 	case "set":
-		e.setVariable(cmds.Head().Arguments.Eval(e.v))
+		e.setVariable(cmds.Head())
 	case "unset":
-		e.unsetVariable(cmds.Head().Arguments.Eval(e.v))
+		e.unsetVariable(e.evalArgs(cmds.Head()))
 	case "project":
-		e.setProject(cmds.Head().Arguments.Eval(e.v))
+		e.setProject(e.evalArgs(cmds.Head()))
+	case "set_property":
+		e.setProperty(e.evalArgs(cmds.Head()))
+	case "get_property":
+		e.getProperty(e.evalArgs(cmds.Head()))
+	case "mark_as_advanced":
+		// Only affects the display of cache variables, so intentionally ignored.
+	case "cmake_minimum_required":
+		e.minimumRequired(e.evalArgs(cmds.Head()))
+	case "cmake_policy":
+		// Policies only select between legacy and current behavior, so are intentionally ignored.
+	case "configure_file":
+		e.configureFile(e.evalArgs(cmds.Head()))
+	case "include_directories":
+		e.includeDirectories(e.evalArgs(cmds.Head()))
+	case "target_include_directories":
+		e.targetIncludeDirectories(e.evalArgs(cmds.Head()))
+	case "add_definitions":
+		e.addDefinitions(e.evalArgs(cmds.Head()))
+	case "add_compile_definitions":
+		e.addCompileDefinitions(e.evalArgs(cmds.Head()))
+	case "file":
+		e.fileCommand(e.evalArgs(cmds.Head()))
+	case "message":
+		e.messageCommand(e.evalArgs(cmds.Head()))
+	default:
+		if !printed && !e.shouldAdd(name) {
+			e.stats.UnknownCommands++
+		}
 	}
 
 	if e.shouldAdd(name) {
-		args := cmds.Head().Arguments.Eval(e.v)
-		if len(args) != 1 {
+		// The optional binary directory and EXCLUDE_FROM_ALL arguments are irrelevant here
+		// and only the source directory is used.
+		// See https://cmake.org/cmake/help/latest/command/add_subdirectory.html
+		args := e.evalArgs(cmds.Head())
+		if len(args) == 0 || len(args) > 3 {
 			return nil, fmt.Errorf("invalid number of arguments to directory command %s", cmds.Head().Pos)
 		}
-		if !e.excludePath(args[0]) {
-			if err := e.AddSubdirectory(cmds.Head().Arguments.Eval(e.v)[0]); err != nil {
+		if excluded := e.excludePath(args[0]) || e.excludePath(e.subdirectoryPath(args[0])); excluded {
+			e.stats.PathsExcluded++
+		} else if dir, ok := e.resolveSubdirectory(args[0]); ok && e.recurseWhen(name, args) {
+			if err := e.addSubdirectory(dir); err != nil {
 				return nil, err
 			}
 		}
@@ -247,24 +915,182 @@ func (e *eval) dispatch(cmds *commandList) (dispatchFunc, error) {
 	return e.dispatch, nil
 }
 
+// whileCommand evaluates the body of the while() block at the head of cmds until its condition is false.
+// See https://cmake.org/cmake/help/latest/command/while.html
+func (e *eval) whileCommand(cmds *commandList) (dispatchFunc, error) {
+	head := cmds.Head()
+	body, err := blockBody(cmds)
+	if err != nil {
+		return nil, err
+	}
+	for i := 0; ; i++ {
+		ok, err := e.evalCondition(e.evalArgs(head))
+		if err != nil {
+			return nil, fmt.Errorf("invalid while condition at %s: %v", head.Pos, err)
+		}
+		if !ok {
+			return e.dispatch, nil
+		}
+		if i >= e.o.maxIterations {
+			return nil, fmt.Errorf("while loop at %s exceeded %d iterations", head.Pos, e.o.maxIterations)
+		}
+		if done, err := e.evalLoopBody(body); err != nil || done {
+			return e.dispatch, err
+		}
+	}
+}
+
+// controlFlow is the pending effect of a break(), continue() or return() command.
+type controlFlow int
+
+const (
+	flowNormal controlFlow = iota
+	flowBreak
+	flowContinue
+	flowReturn
+)
+
+// controlCommand handles break(), continue() and return(), stopping evaluation of the enclosing
+// block until the loop, function or file to which the command applies.
+// See https://cmake.org/cmake/help/latest/command/break.html
+// https://cmake.org/cmake/help/latest/command/continue.html
+// and https://cmake.org/cmake/help/latest/command/return.html
+func (e *eval) controlCommand(name string, cmd *ast.CommandInvocation) (dispatchFunc, error) {
+	switch {
+	case name == "return":
+		e.flow = flowReturn
+	case e.loopDepth == 0:
+		e.warnf("Ignoring %s() outside of a loop at %s", name, cmd.Pos)
+		return e.dispatch, nil
+	case name == "break":
+		e.flow = flowBreak
+	default:
+		e.flow = flowContinue
+	}
+	return nil, nil
+}
+
+// evalLoopBody evaluates a single iteration of a loop body and returns true if the loop should stop,
+// either due to break() or return().
+func (e *eval) evalLoopBody(body commandList) (bool, error) {
+	e.loopDepth++
+	defer func() { e.loopDepth-- }()
+	if err := e.evalCommands(body); err != nil {
+		return true, err
+	}
+	switch e.flow {
+	case flowBreak:
+		e.flow = flowNormal
+		return true, nil
+	case flowContinue:
+		e.flow = flowNormal
+	case flowReturn:
+		return true, nil
+	}
+	return false, nil
+}
+
+// blockBody removes the block beginning at the head of cmds through its matching end command
+// and returns the commands contained therein.
+func blockBody(cmds *commandList) (commandList, error) {
+	head := cmds.Head()
+	counter := newCounter(strings.ToLower(head.Name))
+	counter.Count(counter.begin)
+	start := *cmds
+	for n := 1; cmds.Advance(); n++ {
+		if counter.Count(strings.ToLower(cmds.Head().Name)); counter.count == 0 {
+			cmds.Advance()
+			return start[1:n], nil
+		}
+	}
+	return nil, fmt.Errorf("missing %s() for %s() at %s", counter.end, counter.begin, head.Pos)
+}
+
+// setArguments are the parsed arguments of a set() command.
+type setArguments struct {
+	name   string
+	values []string
+	parent bool     // True if the variable is set in PARENT_SCOPE.
+	cache  []string // The arguments following CACHE, if any: the type, doc string and optional FORCE.
+}
+
+// parseSet parses the evaluated arguments of a set() command, following the rules of
+// https://cmake.org/cmake/help/latest/command/set.html#command:set
+func parseSet(args *arguments) (*setArguments, error) {
+	name, err := args.Require(1)
+	if err != nil {
+		return nil, err
+	}
+	parent := args.Optional("PARENT_SCOPE")
+	cache, _, err := args.Keyword("CACHE", 2, 3)
+	if err != nil {
+		return nil, err
+	}
+	return &setArguments{name[0], args.Remaining(), parent, cache}, nil
+}
+
 // setVariable sets the value of the variable designated by the remained, following the rules of
 // https://cmake.org/cmake/help/latest/command/set.html#command:set
-func (e *eval) setVariable(args []string) {
-	if len(args) == 0 {
-		log.Println("Cannot set a variable without a name")
+func (e *eval) setVariable(cmd *ast.CommandInvocation) {
+	args, err := parseSet(newArguments("set", cmd.Pos, e.evalArgs(cmd)))
+	if err != nil {
+		e.warnf("%v", err)
 		return
 	}
-	key, args := args[0], args[1:len(args)]
+	key, value := args.name, strings.Join(args.values, ";")
 	switch {
-	case len(args) > 0 && args[len(args)-1] == "PARENT_SCOPE":
-		e.v.SetParent(key, strings.Join(args[0:len(args)-1], ";"))
-	case len(args) >= 3 && args[len(args)-3] == "CACHE":
-		e.v.SetCache(key, strings.Join(args[:len(args)-3], ";"))
-	case len(args) >= 4 && args[len(args)-4] == "CACHE": // FORCE
-		e.v.SetCache(key, strings.Join(args[:len(args)-4], ";"))
+	case len(args.values) == 0 && args.cache == nil:
+		// set(<variable>) without a value unsets the variable.
+		if args.parent {
+			e.unsetVariable([]string{key, "PARENT_SCOPE"})
+		} else {
+			e.unsetVariable([]string{key})
+		}
+	case args.parent:
+		e.setParent(key, value)
+	case args.cache != nil:
+		e.v.SetCache(key, value)
 	default:
-		e.v.Set(key, strings.Join(args, ";"))
+		e.v.Set(key, value)
+	}
+}
+
+// setParent sets the variable in the parent scope, if there is one.
+func (e *eval) setParent(key, value string) {
+	if e.v.Depth() == 0 {
+		e.warnf("Attempt to set %s in PARENT_SCOPE at root", key)
+		return
+	}
+	e.v.SetParent(key, value)
+}
+
+// evalArgs returns the values of the arguments to cmd, recording the first reference to an undefined variable
+// if so configured. Other evaluation errors are ignored, as by ast.ArgumentList.Eval.
+func (e *eval) evalArgs(cmd *ast.CommandInvocation) []string {
+	ctx := ast.NewEvalContext(e.v)
+	ctx.UndefinedVarErrors = e.o.undefinedVars
+	args := cmd.Arguments.EvalIn(ctx)
+	for _, err := range ctx.Errors {
+		if _, ok := err.(*ast.UndefinedError); ok && e.evalErr == nil {
+			e.evalErr = err
+		}
+	}
+	return args
+}
+
+// warnf reports a warning to the configured logger or, in strict mode, records it to be returned as an error.
+func (e *eval) warnf(msg string, args ...interface{}) {
+	if e.o.strict {
+		if e.warning == nil {
+			e.warning = fmt.Errorf(msg, args...)
+		}
+		return
+	}
+	if r, ok := e.w.(*recorder); ok {
+		r.log(e.o.logger, "warning", msg, args...)
+		return
 	}
+	e.o.logger("warning", msg, args...)
 }
 
 // unsetVariable unsets the value of the variable designated by the remained, following the rules of
@@ -272,16 +1098,71 @@ func (e *eval) setVariable(args []string) {
 func (e *eval) unsetVariable(args []string) {
 	switch {
 	case len(args) == 0:
-		log.Println("Cannot unset a variable without a name")
+		e.warnf("Cannot unset a variable without a name")
 	case len(args) == 1:
-		e.v.Set(args[0], "")
+		e.v.Unset(args[0])
 	case len(args) == 2 && args[1] == "PARENT_SCOPE":
-		e.v.SetParent(args[0], "")
+		if e.v.Depth() == 0 {
+			e.warnf("Attempt to unset %s in PARENT_SCOPE at root", args[0])
+		} else {
+			e.v.UnsetParent(args[0])
+		}
 	case len(args) == 2 && args[1] == "CACHE":
-		e.v.SetCache(args[0], "")
+		e.v.UnsetCache(args[0])
 	default:
-		log.Println("Ignoring invalid unset command")
+		e.warnf("Ignoring invalid unset command")
+	}
+}
+
+// configureFile records the output of a configure_file() command for the current directory's filegroup.
+// See https://cmake.org/cmake/help/latest/command/configure_file.html
+func (e *eval) configureFile(args []string) {
+	if !e.o.fileGroups || len(e.configured) == 0 {
+		return
+	}
+	if len(args) < 2 {
+		e.warnf("Ignoring configure_file without an output")
+		return
 	}
+	e.configured[len(e.configured)-1] = append(e.configured[len(e.configured)-1], args[1])
+}
+
+// writeFileGroup writes a filegroup of the configure_file() outputs in the current directory, if any.
+func (e *eval) writeFileGroup() error {
+	if len(e.configured) == 0 || len(e.configured[len(e.configured)-1]) == 0 {
+		return nil
+	}
+	name := "configured_files"
+	if dir := e.CurrentDirectory(); dir != "." {
+		name = nonIdentChars.ReplaceAllString(dir, "_") + "_" + name
+	}
+	srcs := e.configured[len(e.configured)-1]
+	return e.w.WriteCommand("filegroup", writer.Kwarg("name", name), writer.Kwarg("srcs", srcs))
+}
+
+// nonIdentChars matches the characters which may not appear in a Starlark identifier.
+var nonIdentChars = regexp.MustCompile(`[^A-Za-z0-9_]+`)
+
+// minimumRequired records the required CMake version.
+// See https://cmake.org/cmake/help/latest/command/cmake_minimum_required.html
+func (e *eval) minimumRequired(args []string) {
+	if len(args) < 2 || args[0] != "VERSION" {
+		e.warnf("Ignoring cmake_minimum_required without a VERSION")
+		return
+	}
+	var r VersionRange
+	if i := strings.Index(args[1], "..."); i >= 0 {
+		r.Min, r.Max = args[1][:i], args[1][i+len("..."):]
+	} else {
+		r.Min = args[1]
+	}
+	e.requiredVersion = r
+	e.v.Set("CMAKE_MINIMUM_REQUIRED_VERSION", r.Min)
+}
+
+// RequiredVersion returns the version range from the most recent cmake_minimum_required command.
+func (e *eval) RequiredVersion() VersionRange {
+	return e.requiredVersion
 }
 
 // setProject sets the name of the project and corresponding CMake variables.
@@ -333,12 +1214,12 @@ func (e *eval) stringCommand(args []string) {
 	case "SUBSTRING":
 		begin, err := strconv.Atoi(args[2])
 		if err != nil {
-			log.Println("Invalid integer: ", err)
+			e.warnf("Invalid integer: %v", err)
 			begin = 0
 		}
 		length, err := strconv.Atoi(args[3])
 		if err != nil {
-			log.Println("Invalid integer: ", err)
+			e.warnf("Invalid integer: %v", err)
 			length = 0
 		}
 		end := begin + length
@@ -351,21 +1232,46 @@ func (e *eval) stringCommand(args []string) {
 	}
 }
 
-// mathCommand evaluates the arguments as https://cmake.org/cmake/help/latest/command/math.html
-func (e *eval) mathCommand(args []string) {
-	switch args[0] {
-	case "EXPR":
-		tv, err := types.Eval(token.NewFileSet(), nil, token.NoPos, args[2])
-		if err != nil {
-			log.Fatal("Unable to evaluate expression: ", err)
-		}
-		value, ok := constant.Int64Val(tv.Value)
-		if !ok {
-			log.Fatal("Unable to evaluate expression as int64")
-		}
-		// TODO(shahms): support OUTPUT_FORMAT
-		e.v.Set(args[1], strconv.FormatInt(value, 10))
+// messageModes are the mode keywords recognized as the first argument to message().
+var messageModes = map[string]bool{
+	"FATAL_ERROR":    true,
+	"SEND_ERROR":     true,
+	"WARNING":        true,
+	"AUTHOR_WARNING": true,
+	"DEPRECATION":    true,
+	"NOTICE":         true,
+	"STATUS":         true,
+	"VERBOSE":        true,
+	"DEBUG":          true,
+	"TRACE":          true,
+	"CHECK_START":    true,
+	"CHECK_PASS":     true,
+	"CHECK_FAIL":     true,
+}
+
+// messageCommand evaluates the arguments as https://cmake.org/cmake/help/latest/command/message.html
+// In strict mode, a FATAL_ERROR message aborts evaluation.
+func (e *eval) messageCommand(args []string) {
+	mode := "NOTICE"
+	if len(args) > 0 && messageModes[args[0]] {
+		mode, args = args[0], args[1:]
+	}
+	text := strings.Join(args, "")
+	if mode == "FATAL_ERROR" && e.o.strict && e.warning == nil {
+		e.warning = fmt.Errorf("message(FATAL_ERROR): %s", text)
+	}
+	if e.o.messages == nil {
+		return
+	}
+	if r, ok := e.w.(*recorder); ok {
+		// Defer the callback until replay so messages are reported in source order.
+		r.record(func(writer.Writer) error {
+			e.o.messages(mode, text)
+			return nil
+		})
+		return
 	}
+	e.o.messages(mode, text)
 }
 
 // setProjectVersion sets the project version related variables.
@@ -396,31 +1302,65 @@ func (e *eval) AddSubdirectory(dirpath string) error {
 	if err := e.enterDirectory(dirpath); err != nil {
 		return err
 	}
-	file, err := e.parseFile(path.Join(e.root.String(), e.path.String(), "CMakeLists.txt"))
+	file, err := e.parseFile(path.Join(filepath.ToSlash(e.root.String()), e.CurrentDirectory(), "CMakeLists.txt"))
 	if err != nil {
 		return err
 	}
 
-	cmds := commandList(file.Commands)
+	// Loops in the parent directory do not extend into the subdirectory, which return() exits.
+	loopDepth := e.loopDepth
+	e.loopDepth = 0
+	err = e.evalCommands(commandList(file.Commands))
+	e.loopDepth, e.flow = loopDepth, flowNormal
+	if err != nil {
+		return err
+	}
+	return e.exitDirectory(dirpath)
+}
+
+// evalCommands dispatches each of the provided commands in turn.
+func (e *eval) evalCommands(cmds commandList) error {
 	dispatch := e.dispatch
-	for {
-		dispatch, err := dispatch(&cmds)
-		if err != nil {
+	for len(cmds) > 0 && dispatch != nil && e.flow == flowNormal {
+		pos := cmds.Head().Pos
+		var err error
+		if dispatch, err = dispatch(&cmds); err != nil {
 			return err
 		}
-		if len(cmds) == 0 || dispatch == nil {
-			break
+		if e.warning != nil {
+			return fmt.Errorf("%s: %v", pos, e.warning)
+		}
+		if e.evalErr != nil {
+			return e.evalErr
 		}
-
 	}
-	return e.exitDirectory(dirpath)
+	return nil
+}
+
+// CacheSnapshot returns a copy of the non-empty CACHE variables set during evaluation.
+// When evaluating in parallel, variables cached by concurrently evaluated subdirectories are not included.
+func (e *eval) CacheSnapshot() map[string]string {
+	return e.v.CacheValues()
+}
+
+// Stats returns statistics summarizing the evaluation so far.
+func (e *eval) Stats() Stats {
+	return e.stats
 }
 
 // ProjectRoot returns the path prefix for forming project-rooted absolute paths.
 func (e *eval) ProjectRoot() string {
-	// Use a fixed prefix so that paths formed by simple string concatenation don't
+	// The prefix is never "/" so that paths formed by simple string concatenation don't
 	// start with '//' which is often treated specially.
-	return "/root"
+	return e.o.projectRoot
+}
+
+// subdirectoryPath returns the project-relative path of the subdirectory dir of the current directory.
+func (e *eval) subdirectoryPath(dir string) string {
+	if path.IsAbs(dir) {
+		return path.Clean(dir)
+	}
+	return path.Join(e.CurrentDirectory(), dir)
 }
 
 // CurrentDirectory returns the relative, project-rooted path currently being traversed.
@@ -428,6 +1368,28 @@ func (e *eval) CurrentDirectory() string {
 	return path.Join(e.path...)
 }
 
+// CurrentPackage returns the project-relative path of the Bazel package containing the current directory,
+// which is the nearest enclosing directory containing one of the PackageMarkers, or false if there is none.
+func (e *eval) CurrentPackage() (string, bool) {
+	return e.PackageOf(e.CurrentDirectory())
+}
+
+// PackageOf returns the project-relative path of the Bazel package containing the project-relative directory dir,
+// or false if there is none.
+func (e *eval) PackageOf(dir string) (string, bool) {
+	for dir = path.Clean(dir); ; dir = path.Dir(dir) {
+		for _, marker := range e.o.pkgMarkers {
+			p := path.Join(filepath.ToSlash(e.root.String()), dir, marker)
+			if info, err := fs.Stat(e.o.fsys, p); err == nil && !info.IsDir() {
+				return dir, true
+			}
+		}
+		if dir == "." || dir == "/" {
+			return "", false
+		}
+	}
+}
+
 // isTopLevel returns true in a top-level CMakeLists.txt file.
 func (e *eval) isTopLevel() bool {
 	return e.v.Depth() == 0 || path.Join(e.ProjectRoot(), e.CurrentDirectory()) == e.ProjectRoot()
@@ -435,11 +1397,21 @@ func (e *eval) isTopLevel() bool {
 
 // enterDirectory pushes a new directory onto the stack, setting up necessary state, etc.
 func (e *eval) enterDirectory(dirpath string) error {
+	if e.o.onEnter != nil {
+		if err := e.o.onEnter(bzlpath.New(path.Join(e.CurrentDirectory(), dirpath))); err != nil {
+			return err
+		}
+	}
 	if err := e.w.PushDirectory(dirpath); err != nil {
 		return err
 	}
 	e.v.Push()
+	parent := path.Join(e.ProjectRoot(), e.CurrentDirectory())
 	e.path = append(e.path, dirpath)
+	e.inheritIncludes(parent)
+	e.inheritDefinitions(parent)
+	e.configured = append(e.configured, nil)
+	e.stats.DirectoriesEntered++
 	e.v.Set("CMAKE_CURRENT_SOURCE_DIR", path.Join(e.ProjectRoot(), e.CurrentDirectory()))
 	e.v.Set("CMAKE_CURRENT_BINARY_DIR", path.Join(e.ProjectRoot(), e.CurrentDirectory()))
 	return nil
@@ -447,6 +1419,16 @@ func (e *eval) enterDirectory(dirpath string) error {
 
 // exitDirectory pops the most recently entered directory off the stack.
 func (e *eval) exitDirectory(path string) error {
+	if err := e.writeFileGroup(); err != nil {
+		return err
+	}
+	if e.o.onLeave != nil {
+		if err := e.o.onLeave(bzlpath.New(e.CurrentDirectory())); err != nil {
+			return err
+		}
+	}
+	e.configured = e.configured[:len(e.configured)-1]
+	e.last = nil
 	e.v.Pop()
 	e.path = e.path[:len(e.path)-1]
 	tail, err := e.w.PopDirectory()
@@ -458,20 +1440,156 @@ func (e *eval) exitDirectory(path string) error {
 
 // PrintCommand writes the given command to the configured StarlarkWriter.
 func (e *eval) PrintCommand(command *ast.CommandInvocation) error {
-	return e.w.WriteCommand(strings.ToLower(string(command.Name)), writer.ArgumentLiterals(command.Arguments.Eval(e.v)))
+	name, args := strings.ToLower(string(command.Name)), e.evalArgs(command)
+	pos := writer.Position{
+		Filename: command.Pos.Filename,
+		Line:     command.Pos.Line,
+		Column:   command.Pos.Column,
+	}
+	if e.o.rewrite != nil {
+		var ok bool
+		if name, args, ok = e.o.rewrite(name, args); !ok {
+			return nil
+		}
+	}
+	if e.isDuplicate(name, args) {
+		return nil
+	}
+	emitted := name
+	if e.o.transformName != nil {
+		emitted = e.o.transformName(name)
+		if _, err := writer.IdentName(emitted); err != nil {
+			return fmt.Errorf("%s: command name %q transformed from %q: %v", command.Pos, emitted, name, err)
+		}
+	}
+	if err := e.annotate(); err != nil {
+		return err
+	}
+	var set *setArguments
+	if name == "set" {
+		// Malformed set() commands, which are not evaluated, are printed verbatim.
+		set, _ = parseSet(newArguments(name, command.Pos, args))
+	}
+	if err := e.writeCacheDoc(set); err != nil {
+		return err
+	}
+	e.stats.CommandsEmitted++
+	if set != nil && e.o.assign != nil && e.o.assign(set.name) {
+		return e.printAssignment(pos, set.name, set.values)
+	}
+	if set != nil && e.o.setValues != renderArguments {
+		rendered := []interface{}{set.name, e.renderValues(set.values)}
+		if opts := args[1+len(set.values):]; len(opts) > 0 {
+			rendered = append(rendered, writer.ArgumentLiterals(opts))
+		}
+		return writeCommandAt(e.w, pos, emitted, rendered...)
+	}
+	return writeCommandAt(e.w, pos, emitted, writer.ArgumentLiterals(args))
+}
+
+// renderValues returns the values of a set() command as configured for printing.
+func (e *eval) renderValues(values []string) interface{} {
+	switch {
+	case len(values) == 1:
+		return values[0]
+	case e.o.setValues == renderJoined:
+		return strings.Join(values, ";")
+	}
+	return values
+}
+
+// isDuplicate records the command and returns true if duplicate commands are suppressed and it
+// is identical to the previously printed command.
+func (e *eval) isDuplicate(name string, args []string) bool {
+	if !e.o.dedupe {
+		return false
+	}
+	cmd := append([]string{name}, args...)
+	if len(cmd) == len(e.last) {
+		dup := true
+		for i := range cmd {
+			dup = dup && cmd[i] == e.last[i]
+		}
+		if dup {
+			return true
+		}
+	}
+	e.last = cmd
+	return false
+}
+
+// annotate writes a comment naming the current directory, if so configured.
+func (e *eval) annotate() error {
+	if !e.o.annotate {
+		return nil
+	}
+	return writeComment(e.w, "from "+e.CurrentDirectory())
+}
+
+// writeCacheDoc writes the documentation string of a set() of a CACHE variable as a comment, if so configured.
+func (e *eval) writeCacheDoc(set *setArguments) error {
+	if !e.o.cacheDocs || set == nil || set.cache == nil {
+		return nil
+	}
+	if doc := set.cache[1]; doc != "" {
+		return writeComment(e.w, doc)
+	}
+	return nil
+}
+
+// printAssignment writes an assignment of values to the named variable at pos to the configured writer.
+func (e *eval) printAssignment(pos writer.Position, name string, values []string) error {
+	return writeAssignmentAt(e.w, pos, name, e.renderValues(values))
 }
 
 func main() {
 	flag.Parse()
-	eval := NewEvaluator(os.Stdout,
+	if *printGrammar {
+		fmt.Println(ast.Grammar())
+		return
+	}
+	var output writer.Writer
+	switch *outputFormat {
+	case "starlark":
+		output = writer.NewStarlarkWriter(os.Stdout)
+	case "json":
+		output = writer.NewJSONWriter(os.Stdout)
+	default:
+		log.Fatalf("Unknown output format: %s", *outputFormat)
+	}
+	shouldPrint := Matching("^(" + strings.Join([]string{
+		"configure_file", "set",
+		"add_llvm_library", "add_llvm_component_library", "add_clang_library", "add_llvm_target",
+		"add_tablegen", "tablegen", "clang_diag_gen", "clang_tablegen", "add_public_tablegen_target",
+	}, "|") + ")$")
+	if *commandsFile != "" {
+		var err error
+		if shouldPrint, err = LoadCommands(*commandsFile); err != nil {
+			log.Fatal(err)
+		}
+	}
+	opts := []Option{
+		MacroName(*macroName),
+		MacroPerRoot(*macroPerRoot),
+		Parallelism(*parallelism),
 		ExcludePaths(Matching(`(^|/)(unittests|examples|cmake)($|/)`)),
 		RecurseCommands(Matching(`add(_\w+)?_subdirectory`)),
-		PrintCommands(Matching("^("+strings.Join([]string{
-			"configure_file", "set",
-			"add_llvm_library", "add_llvm_component_library", "add_clang_library", "add_llvm_target",
-			"add_tablegen", "tablegen", "clang_diag_gen", "clang_tablegen", "add_public_tablegen_target",
-		}, "|")+")$")))
-	if err := eval.walk(bzlpath.ToPaths(flag.Args())); err != nil {
+		PrintCommands(shouldPrint),
+	}
+	if *cacheFile != "" {
+		opts = append(opts, LoadCache(*cacheFile))
+	}
+	paths := bzlpath.ToPaths(flag.Args())
+	if *pathsFrom != "" {
+		more, err := LoadPaths(*pathsFrom)
+		if err != nil {
+			log.Fatal(err)
+		}
+		paths = append(paths, more...)
+	}
+	eval := NewEvaluator(output, opts...)
+	if err := eval.walk(paths); err != nil {
 		log.Fatal(err)
 	}
+	log.Print(eval.Stats())
 }
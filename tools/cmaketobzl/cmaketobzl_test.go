@@ -0,0 +1,2031 @@
+/*
+ * Copyright 2019 The Kythe Authors. All rights reserved.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *   http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/fs"
+	"io/ioutil"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+	"testing"
+	"testing/fstest"
+
+	"github.com/alecthomas/participle/lexer"
+	"github.com/google/go-cmp/cmp"
+
+	"github.com/kythe/llvmbzlgen/cmakelib/bindings"
+	bzlpath "github.com/kythe/llvmbzlgen/path"
+	"github.com/kythe/llvmbzlgen/writer"
+)
+
+// evalString parses and evaluates input as the body of a CMakeLists.txt file.
+func evalString(e *eval, input string) error {
+	file, err := e.p.ParseString(input)
+	if err != nil {
+		return err
+	}
+	return e.evalCommands(commandList(file.Commands))
+}
+
+// evalMacro evaluates input into the body of a single Starlark macro and returns the result.
+func evalMacro(input string, opts ...Option) (string, error) {
+	var b strings.Builder
+	e := NewEvaluator(writer.NewStarlarkWriter(&b), opts...)
+	if err := e.w.BeginMacro("x"); err != nil {
+		return "", err
+	}
+	if err := evalString(e, input); err != nil {
+		return "", err
+	}
+	if err := e.w.EndMacro(); err != nil {
+		return "", err
+	}
+	return b.String(), nil
+}
+
+func TestWhileLoop(t *testing.T) {
+	e := NewEvaluator(writer.NewStarlarkWriter(ioutil.Discard))
+	input := "set(COUNT 0)\n" +
+		"while(COUNT LESS 3)\n" +
+		"  math(EXPR COUNT \"${COUNT} + 1\")\n" +
+		"  set(SEEN \"${SEEN}${COUNT}\")\n" +
+		"endwhile()\n" +
+		"set(AFTER done)\n"
+	if err := evalString(e, input); err != nil {
+		t.Fatal("Unexpected error evaluating loop: ", err)
+	}
+	for key, expected := range map[string]string{"COUNT": "3", "SEEN": "123", "AFTER": "done"} {
+		if actual := e.v.Get(key); actual != expected {
+			t.Errorf("Expected %s=%#v found %#v", key, expected, actual)
+		}
+	}
+}
+
+func TestMathExpr(t *testing.T) {
+	tests := map[string]string{
+		`math(EXPR X "1 + 2 * 3")`:                        "7",
+		`math(EXPR X "(1 + 2) * 3")`:                      "9",
+		`math(EXPR X "1 + 2 << 1")`:                       "6",
+		`math(EXPR X "6 & 3 | 8 ^ 1")`:                    "11",
+		`math(EXPR X "-7 / 2 + 7 % 4")`:                   "0",
+		`math(EXPR X "~0 + 0x10")`:                        "15",
+		`math(EXPR X "${A}*(${B}-1)")`:                    "12",
+		`math(EXPR X "255" OUTPUT_FORMAT HEXADECIMAL)`:    "0xff",
+		`math(EXPR X "0x10 >> 2" OUTPUT_FORMAT DECIMAL)`:  "4",
+		`math(EXPR X "1 / 0")`:                            "unset",
+		`math(EXPR X "(1 + 2")`:                           "unset",
+		`math(EXPR X "1 +")`:                              "unset",
+		`math(EXPR X "1" OUTPUT_FORMAT OCTAL)`:            "unset",
+		`math(EXPR X "1 2")`:                              "unset",
+		`math(EXPR X "9223372036854775807 + 1")`:          "-9223372036854775808",
+		`math(EXPR X "-1" OUTPUT_FORMAT HEXADECIMAL)`:     "0xffffffffffffffff",
+		`math(EXPR X "((2 * (3 + 4)) - 10) % 3 ^ ~(~5)")`: "4",
+		`math(EXPR X "2 * 3 & 4 - 1 | 16 >> 1 << 1")`:     "18",
+	}
+	for input, expected := range tests {
+		e := NewEvaluator(writer.NewStarlarkWriter(ioutil.Discard))
+		if err := evalString(e, "set(X unset)\nset(A 4)\nset(B 4)\n"+input+"\n"); err != nil {
+			t.Errorf("Unexpected error evaluating %#v: %v", input, err)
+		} else if actual := e.v.Get("X"); actual != expected {
+			t.Errorf("Expected %#v to produce %#v, found %#v", input, expected, actual)
+		}
+	}
+}
+
+func TestListCommand(t *testing.T) {
+	tests := []struct {
+		input, variable, expected string
+	}{
+		{`list(SORT X)`, "X", "B;C;a;b;c"},
+		{`list(SORT X ORDER DESCENDING)`, "X", "c;b;a;C;B"},
+		{`list(SORT X CASE INSENSITIVE)`, "X", "a;B;b;c;C"},
+		{`list(SORT X COMPARE NATURAL)`, "X", "c;B;a;C;b"},
+		{`list(REVERSE X)`, "X", "b;C;a;B;c"},
+		{"list(SORT X)\nlist(REVERSE X)", "X", "c;b;a;C;B"},
+		{`list(REMOVE_DUPLICATES D)`, "D", "x;y;z"},
+		{`list(REVERSE D)`, "D", "y;z;x;y;x"},
+		{`list(SORT E)`, "E", ""},
+	}
+	for _, test := range tests {
+		e := NewEvaluator(writer.NewStarlarkWriter(ioutil.Discard))
+		if err := evalString(e, "set(X c B a C b)\nset(D x y x z y)\nset(E \"\")\n"+test.input+"\n"); err != nil {
+			t.Errorf("Unexpected error evaluating %#v: %v", test.input, err)
+		} else if actual := e.v.Get(test.variable); actual != test.expected {
+			t.Errorf("Expected %#v to produce %#v, found %#v", test.input, test.expected, actual)
+		}
+	}
+
+	e := NewEvaluator(writer.NewStarlarkWriter(ioutil.Discard))
+	if err := evalString(e, "list(SORT UNDEFINED)\nlist(REMOVE_DUPLICATES UNDEFINED)\n"); err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	if e.v.IsSet("UNDEFINED") {
+		t.Errorf("Expected list() to leave UNDEFINED unset, found %#v", e.v.Get("UNDEFINED"))
+	}
+}
+
+func TestBlockCounter(t *testing.T) {
+	cmds := []string{
+		"if", "set",
+		"elseif", "if", "set", "elseif", "set", "else", "endif",
+		"elseif", "if", "if", "else", "endif", "elseif", "endif",
+		"elseif", "set",
+		"else", "set",
+		"endif", "set", "elseif",
+	}
+	counter := newCounter("if")
+	end := -1
+	for i, cmd := range cmds {
+		if !counter.Count(cmd) {
+			end = i
+			break
+		}
+	}
+	if end != 21 {
+		t.Errorf("Expected the block to end before command 21, found %d", end)
+	}
+}
+
+func TestSkipIfChain(t *testing.T) {
+	input := "if(A)\n" +
+		"  set(X 1)\n" +
+		"elseif(B)\n" +
+		"  if(C)\n" +
+		"    set(X 2)\n" +
+		"  elseif(D)\n" +
+		"    set(X 3)\n" +
+		"  else()\n" +
+		"  endif()\n" +
+		"elseif(E)\n" +
+		"  if(F)\n" +
+		"  elseif(G)\n" +
+		"    if(H)\n" +
+		"    endif()\n" +
+		"  endif()\n" +
+		"elseif(I)\n" +
+		"  set(X 4)\n" +
+		"else()\n" +
+		"  set(X 5)\n" +
+		"endif()\n" +
+		"set(AFTER z)\n" +
+		"if(J)\n" +
+		"  set(X 6)\n" +
+		"endif()\n" +
+		"set(LAST y)\n"
+	e := NewEvaluator(writer.NewStarlarkWriter(ioutil.Discard))
+	if err := evalString(e, input); err != nil {
+		t.Fatal("Unexpected error: ", err)
+	}
+	if e.v.IsSet("X") {
+		t.Errorf("Expected X to remain unset, found %#v", e.v.Get("X"))
+	}
+	if actual := e.v.Get("AFTER") + e.v.Get("LAST"); actual != "zy" {
+		t.Errorf("Expected AFTER and LAST to be set after the skipped blocks, found %#v", actual)
+	}
+}
+
+func TestWhileLoopLimit(t *testing.T) {
+	e := NewEvaluator(writer.NewStarlarkWriter(ioutil.Discard), MaxLoopIterations(5))
+	input := "set(COUNT 0)\n" +
+		"while(TRUE)\n" +
+		"  math(EXPR COUNT \"${COUNT} + 1\")\n" +
+		"endwhile()\n"
+	if err := evalString(e, input); err == nil {
+		t.Error("Expected error from non-terminating loop")
+	}
+	if actual := e.v.Get("COUNT"); actual != "5" {
+		t.Errorf("Expected COUNT=%#v found %#v", "5", actual)
+	}
+}
+
+func TestRewriteCommand(t *testing.T) {
+	rewrite := RewriteCommand(func(name string, args []string) (string, []string, bool) {
+		switch name {
+		case "add_llvm_library":
+			return "llvm_library", args, true
+		case "add_clang_library":
+			return name, args[1:], true
+		case "tablegen":
+			return "", nil, false
+		}
+		return name, args, true
+	})
+	tests := map[string]string{
+		"set(NAME Support)\nadd_llvm_library(LLVM${NAME} a.cpp)": `ctx.llvm_library(ctx, "LLVMSupport", "a.cpp")`,
+		"add_clang_library(clangBasic a.cpp b.cpp)":              `ctx.add_clang_library(ctx, "a.cpp", "b.cpp")`,
+		"tablegen(LLVM Attributes.inc -gen-attrs)":               ``,
+	}
+	for input, command := range tests {
+		output, err := evalMacro(input, rewrite, PrintCommands(Matching(`^(add_\w+_library|tablegen)$`)))
+		if err != nil {
+			t.Fatalf("Unexpected error evaluating %#v: %v", input, err)
+		}
+		expected := "def x(ctx):\n"
+		if command != "" {
+			expected += "    " + command + "\n"
+		}
+		expected += "    return ctx\n"
+		if diff := cmp.Diff(expected, output); diff != "" {
+			t.Errorf("Unexpected output for %#v:\n%s", input, diff)
+		}
+	}
+}
+
+func TestPrintCommandsIf(t *testing.T) {
+	input := "set(LIB_SOURCES a.cpp b.cpp)\n" +
+		"set(OTHER c)\n" +
+		"configure_file(x.in x.out)\n" +
+		"add_llvm_library(LLVMFoo)\n"
+	sources := func(name string, args []string) bool {
+		return name == "set" && len(args) > 0 && strings.HasSuffix(args[0], "_SOURCES")
+	}
+	output, err := evalMacro(input, PrintCommands(Matching("^configure_file$")), PrintCommandsIf(sources))
+	if err != nil {
+		t.Fatal("Unexpected error evaluating input: ", err)
+	}
+	expected := "def x(ctx):\n" +
+		"    ctx.set(ctx, \"LIB_SOURCES\", \"a.cpp\", \"b.cpp\")\n" +
+		"    ctx.configure_file(ctx, \"x.in\", \"x.out\")\n" +
+		"    return ctx\n"
+	if diff := cmp.Diff(expected, output); diff != "" {
+		t.Errorf("Unexpected output:\n%s", diff)
+	}
+}
+
+func TestForeachComprehensions(t *testing.T) {
+	input := "set(TARGETS X86 ARM)\n" +
+		"foreach(t ${TARGETS} AArch64)\n" +
+		"  add_llvm_target(LLVM${t}CodeGen ${t})\n" +
+		"endforeach()\n" +
+		"foreach(lib IN LISTS TARGETS ITEMS Mips)\n" +
+		"  configure_file(lib.in ${lib})\n" +
+		"endforeach()\n"
+	output, err := evalMacro(input, PrintCommands(Matching("^(configure_file|add_llvm_target)$")), ForeachComprehensions(true))
+	if err != nil {
+		t.Fatal("Unexpected error evaluating input: ", err)
+	}
+	// The first loop varies in more than its final argument, so is skipped.
+	expected := "def x(ctx):\n" +
+		"    [ctx.configure_file(ctx, \"lib.in\", lib) for lib in [\"X86\", \"ARM\", \"Mips\"]]\n" +
+		"    return ctx\n"
+	if diff := cmp.Diff(expected, output); diff != "" {
+		t.Errorf("Unexpected output:\n%s", diff)
+	}
+
+	output, err = evalMacro(input, PrintCommands(Matching("^configure_file$")), ForeachComprehensions(false))
+	if err != nil {
+		t.Fatal("Unexpected error evaluating input: ", err)
+	}
+	if expected := "def x(ctx):\n    return ctx\n"; output != expected {
+		t.Errorf("Expected foreach to be skipped, found:\n%s", output)
+	}
+
+	// Loop variables which would shadow the macro's ctx parameter are renamed.
+	output, err = evalMacro("foreach(CTX a b)\n  configure_file(lib.in ${CTX})\nendforeach()\n",
+		PrintCommands(Matching("^configure_file$")), ForeachComprehensions(true))
+	if err != nil {
+		t.Fatal("Unexpected error evaluating input: ", err)
+	}
+	expected = "def x(ctx):\n" +
+		"    [ctx.configure_file(ctx, \"lib.in\", ctx_) for ctx_ in [\"a\", \"b\"]]\n" +
+		"    return ctx\n"
+	if diff := cmp.Diff(expected, output); diff != "" {
+		t.Errorf("Unexpected output:\n%s", diff)
+	}
+}
+
+func TestEvaluateForeach(t *testing.T) {
+	input := "set(TARGETS X86 ARM)\n" +
+		"foreach(t ${TARGETS} AArch64)\n" +
+		"  add_llvm_target(LLVM${t}CodeGen ${t})\n" +
+		"endforeach()\n" +
+		"foreach(i RANGE 1 5 2)\n" +
+		"  set(SEEN \"${SEEN}${i}\")\n" +
+		"endforeach()\n"
+	var b strings.Builder
+	e := NewEvaluator(writer.NewStarlarkWriter(&b), EvaluateForeach(true), PrintCommands(Matching("^add_llvm_target$")))
+	if err := e.w.BeginMacro("x"); err != nil {
+		t.Fatal(err)
+	}
+	if err := evalString(e, input); err != nil {
+		t.Fatal("Unexpected error evaluating input: ", err)
+	}
+	if err := e.w.EndMacro(); err != nil {
+		t.Fatal(err)
+	}
+	expected := "def x(ctx):\n" +
+		"    ctx.add_llvm_target(ctx, \"LLVMX86CodeGen\", \"X86\")\n" +
+		"    ctx.add_llvm_target(ctx, \"LLVMARMCodeGen\", \"ARM\")\n" +
+		"    ctx.add_llvm_target(ctx, \"LLVMAArch64CodeGen\", \"AArch64\")\n" +
+		"    return ctx\n"
+	if diff := cmp.Diff(expected, b.String()); diff != "" {
+		t.Errorf("Unexpected output:\n%s", diff)
+	}
+	if actual := e.v.Get("SEEN"); actual != "135" {
+		t.Errorf("Expected SEEN=%#v found %#v", "135", actual)
+	}
+	if e.v.IsSet("t") || e.v.IsSet("i") {
+		t.Error("Expected loop variables to be unset after their loops")
+	}
+}
+
+func TestLoopControlFlow(t *testing.T) {
+	tests := []struct {
+		input    string
+		expected map[string]string
+	}{{
+		// break() terminates a foreach early.
+		"foreach(x a b c)\n  set(SEEN \"${SEEN}${x}\")\n  break()\n  set(AFTER yes)\nendforeach()\nset(DONE yes)\n",
+		map[string]string{"SEEN": "a", "AFTER": "", "DONE": "yes"},
+	}, {
+		// continue() skips the remainder of each iteration.
+		"foreach(x a b c)\n  set(SEEN \"${SEEN}${x}\")\n  continue()\n  set(AFTER yes)\nendforeach()\n",
+		map[string]string{"SEEN": "abc", "AFTER": ""},
+	}, {
+		"set(COUNT 0)\nwhile(TRUE)\n  math(EXPR COUNT \"${COUNT} + 1\")\n  break()\nendwhile()\n",
+		map[string]string{"COUNT": "1"},
+	}, {
+		// break() applies only to the innermost loop.
+		"foreach(x a b)\n  foreach(y 1 2)\n    set(SEEN \"${SEEN}${x}${y}\")\n    break()\n  endforeach()\nendforeach()\n",
+		map[string]string{"SEEN": "a1b1"},
+	}, {
+		// break() within a macro applies to the loop in which the macro is called.
+		"macro(stop)\n  break()\nendmacro()\nforeach(x a b)\n  set(SEEN \"${SEEN}${x}\")\n  stop()\nendforeach()\n",
+		map[string]string{"SEEN": "a"},
+	}, {
+		// return() exits the function, including any loops within it, but not the caller.
+		"function(first)\n  foreach(x a b)\n    set(R ${x} PARENT_SCOPE)\n    return()\n  endforeach()\n  set(R never PARENT_SCOPE)\nendfunction()\n" +
+			"first()\nset(DONE yes)\n",
+		map[string]string{"R": "a", "DONE": "yes"},
+	}, {
+		"set(A 1)\nreturn()\nset(B 2)\n",
+		map[string]string{"A": "1", "B": ""},
+	}}
+	for _, test := range tests {
+		e := NewEvaluator(writer.NewStarlarkWriter(ioutil.Discard), EvaluateForeach(true), StrictMode(true))
+		if err := evalString(e, test.input); err != nil {
+			t.Errorf("Unexpected error evaluating %#v: %v", test.input, err)
+			continue
+		}
+		for key, expected := range test.expected {
+			if actual := e.v.Get(key); actual != expected {
+				t.Errorf("Expected %s=%#v evaluating %#v, found %#v", key, expected, test.input, actual)
+			}
+		}
+	}
+
+	e := NewEvaluator(writer.NewStarlarkWriter(ioutil.Discard), StrictMode(true))
+	if err := evalString(e, "break()\n"); err == nil {
+		t.Error("Expected error from break() outside of a loop")
+	}
+	e = NewEvaluator(writer.NewStarlarkWriter(ioutil.Discard), StrictMode(true))
+	if err := evalString(e, "function(f)\n  break()\nendfunction()\nwhile(TRUE)\n  f()\nendwhile()\n"); err == nil {
+		t.Error("Expected error from break() in a function called from a loop")
+	}
+}
+
+func TestTransformCommandName(t *testing.T) {
+	rewrite := RewriteCommand(func(name string, args []string) (string, []string, bool) {
+		return strings.Replace(name, "llvm", "clang", 1), args, true
+	})
+	strip := TransformCommandName(func(name string) string {
+		return strings.TrimPrefix(name, "add_")
+	})
+	output, err := evalMacro("add_llvm_library(LLVMSupport a.cpp)\nset(X y)\n", rewrite, strip, PrintCommands(Matching(`^(add_\w+|set)$`)))
+	if err != nil {
+		t.Fatal("Unexpected error: ", err)
+	}
+	expected := "def x(ctx):\n" +
+		"    ctx.clang_library(ctx, \"LLVMSupport\", \"a.cpp\")\n" +
+		"    ctx.set(ctx, \"X\", \"y\")\n" +
+		"    return ctx\n"
+	if diff := cmp.Diff(expected, output); diff != "" {
+		t.Errorf("Unexpected output:\n%s", diff)
+	}
+
+	invalid := TransformCommandName(func(name string) string {
+		return "llvm-" + name
+	})
+	_, err = evalMacro("add_llvm_library(LLVMSupport a.cpp)\n", invalid, PrintCommands(Matching(`^add_`)))
+	if expected := `1:1: command name "llvm-add_llvm_library" transformed from "add_llvm_library": invalid Starlark identifier: llvm-add_llvm_library`; err == nil || err.Error() != expected {
+		t.Errorf("Expected error %#v, found %v", expected, err)
+	}
+}
+
+func TestEmitAssignments(t *testing.T) {
+	input := "set(SCALAR value)\n" +
+		"set(LIST a b c)\n" +
+		"set(CACHED x y CACHE STRING \"doc\")\n" +
+		"set(OTHER value)\n"
+	output, err := evalMacro(input, PrintCommands(Matching("^set$")), EmitAssignments(Matching(`^(SCALAR|LIST|CACHED)$`)))
+	if err != nil {
+		t.Fatal("Unexpected error evaluating input: ", err)
+	}
+	expected := "def x(ctx):\n" +
+		"    SCALAR = \"value\"\n" +
+		"    LIST = [\"a\", \"b\", \"c\"]\n" +
+		"    CACHED = [\"x\", \"y\"]\n" +
+		"    ctx.set(ctx, \"OTHER\", \"value\")\n" +
+		"    return ctx\n"
+	if diff := cmp.Diff(expected, output); diff != "" {
+		t.Errorf("Unexpected output:\n%s", diff)
+	}
+}
+
+func TestEmitAssignmentsWithHooks(t *testing.T) {
+	input := "set(SCALAR value)\n" +
+		"set(SCALAR value)\n" +
+		"set(DROPPED value)\n" +
+		"set(RENAMED value)\n"
+	rewrite := RewriteCommand(func(name string, args []string) (string, []string, bool) {
+		switch args[0] {
+		case "DROPPED":
+			return name, args, false
+		case "RENAMED":
+			return name, append([]string{"SCALAR"}, args[1:]...), true
+		}
+		return name, args, true
+	})
+	transform := TransformCommandName(func(name string) string { return "cmake_" + name })
+	output, err := evalMacro(input, PrintCommands(Matching("^set$")),
+		EmitAssignments(Matching("^SCALAR$")), rewrite, SuppressDuplicateCommands(true), transform)
+	if err != nil {
+		t.Fatal("Unexpected error evaluating input: ", err)
+	}
+	expected := "def x(ctx):\n" +
+		"    SCALAR = \"value\"\n" +
+		"    return ctx\n"
+	if diff := cmp.Diff(expected, output); diff != "" {
+		t.Errorf("Unexpected output:\n%s", diff)
+	}
+
+	// Malformed set() commands do not bind the variable, so are printed verbatim rather than assigned.
+	output, err = evalMacro("set(SCALAR a CACHE STRING)\n", PrintCommands(Matching("^set$")), EmitAssignments(Matching("^SCALAR$")))
+	if err != nil {
+		t.Fatal("Unexpected error evaluating input: ", err)
+	}
+	expected = "def x(ctx):\n" +
+		"    ctx.set(ctx, \"SCALAR\", \"a\", \"CACHE\", \"STRING\")\n" +
+		"    return ctx\n"
+	if diff := cmp.Diff(expected, output); diff != "" {
+		t.Errorf("Unexpected output:\n%s", diff)
+	}
+
+	invalid := TransformCommandName(func(name string) string { return "not valid" })
+	if _, err := evalMacro(input, PrintCommands(Matching("^set$")), EmitAssignments(Matching("^SCALAR$")), invalid); err == nil {
+		t.Error("Expected error for invalid transformed command name")
+	}
+}
+
+func TestProperties(t *testing.T) {
+	e := NewEvaluator(writer.NewStarlarkWriter(ioutil.Discard))
+	input := "set(UNSET stale)\n" +
+		"get_property(UNSET GLOBAL PROPERTY MISSING)\n" +
+		"set_property(GLOBAL PROPERTY FOO bar)\n" +
+		"get_property(GLOBAL_VALUE GLOBAL PROPERTY FOO)\n" +
+		"get_property(IS_SET GLOBAL PROPERTY FOO SET)\n" +
+		"get_property(NOT_SET GLOBAL PROPERTY MISSING SET)\n" +
+		"set_property(TARGET a b PROPERTY SOURCES x.cpp)\n" +
+		"set_property(TARGET a APPEND PROPERTY SOURCES y.cpp)\n" +
+		"get_property(TARGET_A TARGET a PROPERTY SOURCES)\n" +
+		"get_property(TARGET_B TARGET b PROPERTY SOURCES)\n" +
+		"set_property(DIRECTORY PROPERTY LABEL dir)\n" +
+		"get_property(DIR_VALUE DIRECTORY /root PROPERTY LABEL)\n" +
+		"set(CACHED value CACHE STRING \"doc\")\n" +
+		"mark_as_advanced(CACHED)\n" +
+		"get_property(CACHE_VALUE CACHE CACHED PROPERTY VALUE)\n"
+	if err := evalString(e, input); err != nil {
+		t.Fatal("Unexpected error evaluating input: ", err)
+	}
+	expected := map[string]string{
+		"UNSET":        "",
+		"GLOBAL_VALUE": "bar",
+		"IS_SET":       "1",
+		"NOT_SET":      "0",
+		"TARGET_A":     "x.cpp;y.cpp",
+		"TARGET_B":     "x.cpp",
+		"DIR_VALUE":    "dir",
+		"CACHE_VALUE":  "value",
+	}
+	for key, value := range expected {
+		if actual := e.v.Get(key); actual != value {
+			t.Errorf("Expected %s=%#v found %#v", key, value, actual)
+		}
+	}
+}
+
+func TestIncludeDirectories(t *testing.T) {
+	fsys := fstest.MapFS{
+		"llvm/CMakeLists.txt": {Data: []byte("include_directories(AFTER include ${CMAKE_CURRENT_SOURCE_DIR}/include)\n" +
+			"include_directories(BEFORE SYSTEM /usr/include/../include)\n" +
+			"add_subdirectory(lib)\n")},
+		"llvm/lib/CMakeLists.txt": {Data: []byte("include_directories(./Support/)\n" +
+			"target_include_directories(LLVMSupport PRIVATE private PUBLIC ../include INTERFACE iface)\n")},
+	}
+	for _, parallelism := range []int{1, 4} {
+		e := NewEvaluator(writer.NewStarlarkWriter(ioutil.Discard), FileSystem(fsys), Parallelism(parallelism))
+		if err := e.walk(bzlpath.ToPaths([]string{"llvm"})); err != nil {
+			t.Fatal("Unexpected error walking tree: ", err)
+		}
+		expected := []string{"/usr/include", "/root/include"}
+		if diff := cmp.Diff(expected, e.IncludeDirectories(".")); diff != "" {
+			t.Errorf("Unexpected root include directories with parallelism %d:\n%s", parallelism, diff)
+		}
+		// Subdirectories inherit the includes of their parent.
+		expected = []string{"/usr/include", "/root/include", "/root/lib/Support"}
+		if diff := cmp.Diff(expected, e.IncludeDirectories("lib")); diff != "" {
+			t.Errorf("Unexpected lib include directories with parallelism %d:\n%s", parallelism, diff)
+		}
+		expected = []string{"/root/lib/private", "/root/include", "/root/lib/iface"}
+		if diff := cmp.Diff(expected, e.TargetIncludeDirectories("LLVMSupport")); diff != "" {
+			t.Errorf("Unexpected target include directories with parallelism %d:\n%s", parallelism, diff)
+		}
+	}
+}
+
+func TestCompileDefinitions(t *testing.T) {
+	fsys := fstest.MapFS{
+		"llvm/CMakeLists.txt": {Data: []byte("add_definitions(-DNDEBUG /D_GNU_SOURCE -Wall)\n" +
+			"add_subdirectory(lib)\n" +
+			"add_compile_definitions(LATE=1)\n")},
+		"llvm/lib/CMakeLists.txt": {Data: []byte("add_compile_definitions(-DSUPPORT \"NAME=${CMAKE_CURRENT_SOURCE_DIR}\")\n")},
+	}
+	for _, parallelism := range []int{1, 4} {
+		e := NewEvaluator(writer.NewStarlarkWriter(ioutil.Discard), FileSystem(fsys), Parallelism(parallelism))
+		if err := e.walk(bzlpath.ToPaths([]string{"llvm"})); err != nil {
+			t.Fatal("Unexpected error walking tree: ", err)
+		}
+		expected := []string{"NDEBUG", "_GNU_SOURCE", "LATE=1"}
+		if diff := cmp.Diff(expected, e.CompileDefinitions(".")); diff != "" {
+			t.Errorf("Unexpected root definitions with parallelism %d:\n%s", parallelism, diff)
+		}
+		// Subdirectories inherit the definitions of their parent at the point they are added.
+		expected = []string{"NDEBUG", "_GNU_SOURCE", "SUPPORT", "NAME=/root/lib"}
+		if diff := cmp.Diff(expected, e.CompileDefinitions("lib")); diff != "" {
+			t.Errorf("Unexpected lib definitions with parallelism %d:\n%s", parallelism, diff)
+		}
+	}
+}
+
+func TestDirectoryCallbacks(t *testing.T) {
+	fsys := fstest.MapFS{
+		"llvm/CMakeLists.txt":                  {Data: []byte("add_subdirectory(lib)\nadd_subdirectory(tools)\n")},
+		"llvm/lib/CMakeLists.txt":              {Data: []byte("add_subdirectory(Support)\nadd_subdirectory(IR)\n")},
+		"llvm/lib/Support/CMakeLists.txt":      {Data: []byte("add_subdirectory(Unix)\n")},
+		"llvm/lib/Support/Unix/CMakeLists.txt": {Data: []byte("")},
+		"llvm/lib/IR/CMakeLists.txt":           {Data: []byte("")},
+		"llvm/tools/CMakeLists.txt":            {Data: []byte("")},
+	}
+	var events []string
+	enter := OnEnterDirectory(func(dir bzlpath.Path) error {
+		events = append(events, "enter "+path.Join(dir...))
+		return nil
+	})
+	leave := OnLeaveDirectory(func(dir bzlpath.Path) error {
+		events = append(events, "leave "+path.Join(dir...))
+		return nil
+	})
+	e := NewEvaluator(writer.NewStarlarkWriter(ioutil.Discard), FileSystem(fsys), enter, leave)
+	if err := e.walk(bzlpath.ToPaths([]string{"llvm"})); err != nil {
+		t.Fatal("Unexpected error walking tree: ", err)
+	}
+	expected := []string{
+		"enter ",
+		"enter lib",
+		"enter lib/Support",
+		"enter lib/Support/Unix",
+		"leave lib/Support/Unix",
+		"leave lib/Support",
+		"enter lib/IR",
+		"leave lib/IR",
+		"leave lib",
+		"enter tools",
+		"leave tools",
+		"leave ",
+	}
+	if diff := cmp.Diff(expected, events); diff != "" {
+		t.Errorf("Unexpected directory events:\n%s", diff)
+	}
+
+	// An error entering a directory aborts the traversal of its subtree.
+	events = nil
+	abort := errors.New("abort")
+	enter = OnEnterDirectory(func(dir bzlpath.Path) error {
+		if path.Join(dir...) == "lib/Support" {
+			return abort
+		}
+		events = append(events, "enter "+path.Join(dir...))
+		return nil
+	})
+	e = NewEvaluator(writer.NewStarlarkWriter(ioutil.Discard), FileSystem(fsys), enter, leave)
+	if err := e.walk(bzlpath.ToPaths([]string{"llvm"})); !errors.Is(err, abort) {
+		t.Errorf("Expected %v walking tree, got: %v", abort, err)
+	}
+	expected = []string{"enter ", "enter lib"}
+	if diff := cmp.Diff(expected, events); diff != "" {
+		t.Errorf("Unexpected directory events after error:\n%s", diff)
+	}
+}
+
+func TestCaptureOutput(t *testing.T) {
+	fsys := fstest.MapFS{
+		"llvm/CMakeLists.txt":             {Data: []byte("add_subdirectory(lib)\nconfigure_file(top.in top.out)\n")},
+		"llvm/lib/CMakeLists.txt":         {Data: []byte("add_subdirectory(Support)\n")},
+		"llvm/lib/Support/CMakeLists.txt": {Data: []byte("set(NAME Support)\nadd_llvm_library(LLVM${NAME} a.cpp)\n")},
+	}
+	w := writer.NewCaptureWriter(nil)
+	e := NewEvaluator(w, FileSystem(fsys), PrintCommands(Matching(`^(configure_file|add_llvm_library)$`)))
+	if err := e.walk(bzlpath.ToPaths([]string{"llvm"})); err != nil {
+		t.Fatal("Unexpected error walking tree: ", err)
+	}
+	var actual []writer.EmittedCommand
+	for _, cmd := range w.Commands() {
+		cmd.Pos = writer.Position{}
+		actual = append(actual, cmd)
+	}
+	expected := []writer.EmittedCommand{{
+		Macro: "generated_cmake_targets",
+		Name:  "add_llvm_library",
+		Args:  []interface{}{"LLVMSupport", "a.cpp"},
+		Dir:   []string{".", "lib", "Support"},
+	}, {
+		Macro: "generated_cmake_targets",
+		Name:  "configure_file",
+		Args:  []interface{}{"top.in", "top.out"},
+		Dir:   []string{"."},
+	}}
+	if diff := cmp.Diff(expected, actual); diff != "" {
+		t.Errorf("Unexpected commands:\n%s", diff)
+	}
+}
+
+func TestCurrentPackage(t *testing.T) {
+	fsys := fstest.MapFS{
+		"llvm/CMakeLists.txt":                  {Data: []byte("add_subdirectory(lib)\nconfigure_file(top.in top.out)\n")},
+		"llvm/lib/CMakeLists.txt":              {Data: []byte("add_subdirectory(Support)\nconfigure_file(lib.in lib.out)\n")},
+		"llvm/lib/BUILD.bazel":                 {Data: []byte("")},
+		"llvm/lib/Support/CMakeLists.txt":      {Data: []byte("add_subdirectory(Unix)\n")},
+		"llvm/lib/Support/BUILD":               {Mode: fs.ModeDir},
+		"llvm/lib/Support/Unix/CMakeLists.txt": {Data: []byte("configure_file(unix.in unix.out)\n")},
+	}
+	packages := map[string]string{}
+	var e *eval
+	e = NewEvaluator(writer.NewStarlarkWriter(ioutil.Discard), FileSystem(fsys),
+		PrintCommandsIf(func(name string, args []string) bool {
+			if name != "configure_file" {
+				return false
+			}
+			if pkg, ok := e.CurrentPackage(); ok {
+				packages[args[1]] = pkg
+			} else {
+				packages[args[1]] = "<none>"
+			}
+			return false
+		}))
+	if err := e.walk(bzlpath.ToPaths([]string{"llvm"})); err != nil {
+		t.Fatal("Unexpected error walking tree: ", err)
+	}
+	// A directory named BUILD does not mark a package.
+	expected := map[string]string{
+		"top.out":  "<none>",
+		"lib.out":  "lib",
+		"unix.out": "lib",
+	}
+	if diff := cmp.Diff(expected, packages); diff != "" {
+		t.Errorf("Unexpected packages:\n%s", diff)
+	}
+
+	e = NewEvaluator(writer.NewStarlarkWriter(ioutil.Discard), FileSystem(fsys), PackageMarkers([]string{"CMakeLists.txt"}))
+	if err := e.walk(bzlpath.ToPaths([]string{"llvm"})); err != nil {
+		t.Fatal("Unexpected error walking tree: ", err)
+	}
+	if pkg, ok := e.PackageOf("lib/Support/Unix"); !ok || pkg != "lib/Support/Unix" {
+		t.Errorf("Expected package %#v, found %#v", "lib/Support/Unix", pkg)
+	}
+	if pkg, ok := e.PackageOf("lib/Target"); !ok || pkg != "lib" {
+		t.Errorf("Expected package %#v, found %#v", "lib", pkg)
+	}
+}
+
+func TestJSONOutput(t *testing.T) {
+	root := writeTree(t, map[string]string{
+		"CMakeLists.txt": "add_subdirectory(lib)\n",
+		"lib/CMakeLists.txt": "set(NAME Support)\n\nconfigure_file(a.in a.out)\n  add_llvm_library(LLVM${NAME} a.cpp)\n" +
+			"\n\tset(SOURCES\n\t\ta.cpp b.cpp)\n",
+	})
+	defer os.RemoveAll(root)
+	var b strings.Builder
+	e := NewEvaluator(writer.NewJSONWriter(&b), PrintCommands(Matching(`^(configure_file|add_llvm_library|set)$`)),
+		EmitAssignments(Matching("^SOURCES$")))
+	if err := e.walk(bzlpath.ToPaths([]string{root})); err != nil {
+		t.Fatal("Unexpected error walking tree: ", err)
+	}
+	var actual []writer.JSONCommand
+	for _, line := range strings.Split(strings.TrimSpace(b.String()), "\n") {
+		var cmd writer.JSONCommand
+		if err := json.Unmarshal([]byte(line), &cmd); err != nil {
+			t.Fatalf("Unexpected error decoding %#v: %v", line, err)
+		}
+		actual = append(actual, cmd)
+	}
+	file := filepath.Join(root, "lib", "CMakeLists.txt")
+	expected := []writer.JSONCommand{{
+		Macro:     "generated_cmake_targets",
+		Name:      "set",
+		Args:      []interface{}{"NAME", "Support"},
+		Directory: []string{".", "lib"},
+		File:      file,
+		Line:      1,
+		Column:    1,
+	}, {
+		Macro:     "generated_cmake_targets",
+		Name:      "configure_file",
+		Args:      []interface{}{"a.in", "a.out"},
+		Directory: []string{".", "lib"},
+		File:      file,
+		Line:      3,
+		Column:    1,
+	}, {
+		Macro:     "generated_cmake_targets",
+		Name:      "add_llvm_library",
+		Args:      []interface{}{"LLVMSupport", "a.cpp"},
+		Directory: []string{".", "lib"},
+		File:      file,
+		Line:      4,
+		Column:    3,
+	}, {
+		Macro:     "generated_cmake_targets",
+		Name:      "set",
+		Args:      []interface{}{"SOURCES", []interface{}{"a.cpp", "b.cpp"}},
+		Directory: []string{".", "lib"},
+		File:      file,
+		Line:      6,
+		Column:    2,
+	}}
+	if diff := cmp.Diff(expected, actual); diff != "" {
+		t.Errorf("Unexpected output:\n%s", diff)
+	}
+}
+
+// callRecorder is a writer.Writer which records the sequence of calls made to it.
+type callRecorder struct {
+	calls []string
+	dirs  []string
+}
+
+func (c *callRecorder) BeginMacro(name string) error {
+	c.calls = append(c.calls, "BeginMacro("+name+")")
+	return nil
+}
+
+func (c *callRecorder) EndMacro() error {
+	c.calls = append(c.calls, "EndMacro()")
+	return nil
+}
+
+func (c *callRecorder) PushDirectory(path string) error {
+	c.calls = append(c.calls, "PushDirectory("+path+")")
+	c.dirs = append(c.dirs, path)
+	return nil
+}
+
+func (c *callRecorder) PopDirectory() (string, error) {
+	c.calls = append(c.calls, "PopDirectory()")
+	return pop(&c.dirs), nil
+}
+
+func (c *callRecorder) WriteCommand(cmd string, args ...interface{}) error {
+	c.calls = append(c.calls, fmt.Sprintf("WriteCommand(%s, %v)", cmd, args))
+	return nil
+}
+
+func TestWriterInterface(t *testing.T) {
+	root := writeTree(t, map[string]string{
+		"CMakeLists.txt":     "add_subdirectory(lib)\nset(X y)\n",
+		"lib/CMakeLists.txt": "configure_file(a.in a.out)\n",
+	})
+	defer os.RemoveAll(root)
+	var calls callRecorder
+	e := NewEvaluator(&calls, PrintCommands(Matching(`^(configure_file|set)$`)), EmitAssignments(Matching("^X$")))
+	if err := e.walk(bzlpath.ToPaths([]string{root})); err != nil {
+		t.Fatal("Unexpected error walking tree: ", err)
+	}
+	expected := []string{
+		"BeginMacro(generated_cmake_targets)",
+		"PushDirectory(.)",
+		"PushDirectory(lib)",
+		"WriteCommand(configure_file, [[a.in a.out]])",
+		"PopDirectory()",
+		"WriteCommand(set, [X y])",
+		"PopDirectory()",
+		"EndMacro()",
+	}
+	if diff := cmp.Diff(expected, calls.calls); diff != "" {
+		t.Errorf("Unexpected calls:\n%s", diff)
+	}
+}
+
+// writeTree writes the provided files beneath a new temporary directory and returns its path.
+func writeTree(t *testing.T, files map[string]string) string {
+	root, err := ioutil.TempDir("", "cmaketobzl")
+	if err != nil {
+		t.Fatal("Unable to create temporary directory: ", err)
+	}
+	for name, content := range files {
+		path := filepath.Join(root, name)
+		if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+			t.Fatal("Unable to create directory: ", err)
+		}
+		if err := ioutil.WriteFile(path, []byte(content), 0644); err != nil {
+			t.Fatal("Unable to write file: ", err)
+		}
+	}
+	return root
+}
+
+func TestParallelMatchesSerial(t *testing.T) {
+	files := map[string]string{
+		"llvm/CMakeLists.txt": "project(LLVM LANGUAGES C CXX)\n" +
+			"set(LIBS Support)\n" +
+			"add_subdirectory(lib)\n" +
+			"add_subdirectory(empty)\n" +
+			"add_subdirectory(tools)\n" +
+			"configure_file(config.h.cmake config.h)\n",
+		"llvm/lib/CMakeLists.txt": "foreach(lib ${LIBS})\nendforeach()\n" +
+			"add_subdirectory(Support)\n" +
+			"add_subdirectory(Empty)\n" +
+			"add_subdirectory(TableGen)\n",
+		"llvm/lib/Support/CMakeLists.txt":  "add_llvm_library(LLVM${LIBS} a.cpp b.cpp)\n",
+		"llvm/lib/Empty/CMakeLists.txt":    "set(UNUSED value)\n",
+		"llvm/lib/TableGen/CMakeLists.txt": "add_llvm_library(LLVMTableGen c.cpp)\n",
+		"llvm/empty/CMakeLists.txt":        "set(UNUSED value)\n",
+		"llvm/tools/CMakeLists.txt":        "add_subdirectory(opt)\nconfigure_file(tools.in tools.out)\n",
+		"llvm/tools/opt/CMakeLists.txt":    "add_llvm_library(opt ${PROJECT_NAME})\n",
+		"clang/CMakeLists.txt":             "add_clang_library(clangBasic d.cpp)\n",
+	}
+	root := writeTree(t, files)
+	defer os.RemoveAll(root)
+	paths := bzlpath.ToPaths([]string{filepath.Join(root, "llvm"), filepath.Join(root, "clang")})
+
+	walk := func(opts ...Option) string {
+		var b strings.Builder
+		opts = append(opts, PrintCommands(Matching(`^(configure_file|add_\w+_library)$`)))
+		if err := NewEvaluator(writer.NewStarlarkWriter(&b), opts...).walk(paths); err != nil {
+			t.Fatal("Unexpected error walking tree: ", err)
+		}
+		return b.String()
+	}
+	expected := walk()
+	for _, n := range []int{2, 4, 16} {
+		if diff := cmp.Diff(expected, walk(Parallelism(n))); diff != "" {
+			t.Errorf("Unexpected parallel output with %d workers:\n%s", n, diff)
+		}
+	}
+}
+
+func TestAddSubdirectoryArguments(t *testing.T) {
+	tests := map[string]string{
+		"add_subdirectory(sub)\n":                                          "sub",
+		"add_subdirectory(sub bin)\n":                                      "sub",
+		"add_subdirectory(sub EXCLUDE_FROM_ALL)\n":                         "sub",
+		"add_subdirectory(sub ${CMAKE_BINARY_DIR}/bin EXCLUDE_FROM_ALL)\n": "sub",
+	}
+	for input, subdir := range tests {
+		root := writeTree(t, map[string]string{
+			"CMakeLists.txt":     input,
+			"sub/CMakeLists.txt": "configure_file(a.in a.out)\n",
+		})
+		var b strings.Builder
+		err := NewEvaluator(writer.NewStarlarkWriter(&b), PrintCommands(Matching("^configure_file$"))).walk(bzlpath.ToPaths([]string{root}))
+		os.RemoveAll(root)
+		if err != nil {
+			t.Errorf("Unexpected error evaluating %#v: %v", input, err)
+			continue
+		}
+		expected := "def generated_cmake_targets(ctx):\n" +
+			"    ctx = ctx.push_directory(ctx, \"" + subdir + "\")\n" +
+			"    ctx.configure_file(ctx, \"a.in\", \"a.out\")\n" +
+			"    ctx = ctx.pop_directory(ctx)\n" +
+			"    return ctx\n"
+		if diff := cmp.Diff(expected, b.String()); diff != "" {
+			t.Errorf("Unexpected output for %#v:\n%s", input, diff)
+		}
+	}
+}
+
+func TestFileSystem(t *testing.T) {
+	fsys := fstest.MapFS{
+		"llvm/CMakeLists.txt":     {Data: []byte("set(NAME Support)\nadd_subdirectory(lib)\n")},
+		"llvm/lib/CMakeLists.txt": {Data: []byte("add_llvm_library(LLVM${NAME} a.cpp)\n")},
+	}
+	var b strings.Builder
+	e := NewEvaluator(writer.NewStarlarkWriter(&b), FileSystem(fsys), PrintCommands(Matching("^add_llvm_library$")))
+	if err := e.walk(bzlpath.ToPaths([]string{"llvm"})); err != nil {
+		t.Fatal("Unexpected error walking tree: ", err)
+	}
+	expected := "def generated_cmake_targets(ctx):\n" +
+		"    ctx = ctx.push_directory(ctx, \"lib\")\n" +
+		"    ctx.add_llvm_library(ctx, \"LLVMSupport\", \"a.cpp\")\n" +
+		"    ctx = ctx.pop_directory(ctx)\n" +
+		"    return ctx\n"
+	if diff := cmp.Diff(expected, b.String()); diff != "" {
+		t.Errorf("Unexpected output:\n%s", diff)
+	}
+
+	e = NewEvaluator(writer.NewStarlarkWriter(ioutil.Discard), FileSystem(fsys))
+	if err := e.walk(bzlpath.ToPaths([]string{"clang"})); err == nil {
+		t.Error("Expected error walking missing directory")
+	}
+}
+
+func TestCaseInsensitiveCommands(t *testing.T) {
+	fsys := fstest.MapFS{
+		"llvm/CMakeLists.txt": {Data: []byte("SET(NAME Support)\n" +
+			"If(NAME)\n" +
+			"  configure_file(skipped.in skipped.out)\n" +
+			"ENDIF()\n" +
+			"Add_Subdirectory(lib)\n")},
+		"llvm/lib/CMakeLists.txt": {Data: []byte("Add_LLVM_Library(LLVM${NAME} A.cpp)\n")},
+	}
+	var b strings.Builder
+	e := NewEvaluator(writer.NewStarlarkWriter(&b), FileSystem(fsys), PrintCommands(Matching("^(add_llvm_library|configure_file)$")))
+	if err := e.walk(bzlpath.ToPaths([]string{"llvm"})); err != nil {
+		t.Fatal("Unexpected error walking tree: ", err)
+	}
+	// Command names are printed in their canonical lowercase form, while arguments retain their case.
+	expected := "def generated_cmake_targets(ctx):\n" +
+		"    ctx = ctx.push_directory(ctx, \"lib\")\n" +
+		"    ctx.add_llvm_library(ctx, \"LLVMSupport\", \"A.cpp\")\n" +
+		"    ctx = ctx.pop_directory(ctx)\n" +
+		"    return ctx\n"
+	if diff := cmp.Diff(expected, b.String()); diff != "" {
+		t.Errorf("Unexpected output:\n%s", diff)
+	}
+}
+
+func TestParseFilePositions(t *testing.T) {
+	fsys := fstest.MapFS{
+		"root/CMakeLists.txt": {Data: []byte("project(x)\nset(\n")},
+	}
+	e := NewEvaluator(writer.NewStarlarkWriter(ioutil.Discard), FileSystem(fsys))
+	_, err := e.parseFile("root/CMakeLists.txt")
+	if err == nil || !strings.HasPrefix(err.Error(), "root/CMakeLists.txt:") {
+		t.Errorf("Expected error located in root/CMakeLists.txt, found %v", err)
+	}
+}
+
+func TestAnnotateCommands(t *testing.T) {
+	fsys := fstest.MapFS{
+		"CMakeLists.txt":             {Data: []byte("add_subdirectory(lib)\nconfigure_file(top.in top.out)\n")},
+		"lib/CMakeLists.txt":         {Data: []byte("add_subdirectory(Support)\n")},
+		"lib/Support/CMakeLists.txt": {Data: []byte("configure_file(a.in a.out)\n")},
+	}
+	var b strings.Builder
+	e := NewEvaluator(writer.NewStarlarkWriter(&b), FileSystem(fsys), AnnotateCommands(true), PrintCommands(Matching("^configure_file$")))
+	if err := e.walk(bzlpath.ToPaths([]string{"."})); err != nil {
+		t.Fatal("Unexpected error walking tree: ", err)
+	}
+	expected := "def generated_cmake_targets(ctx):\n" +
+		"    ctx = ctx.push_directory(ctx, \"lib/Support\")\n" +
+		"    # from lib/Support\n" +
+		"    ctx.configure_file(ctx, \"a.in\", \"a.out\")\n" +
+		"    ctx = ctx.pop_directory(ctx)\n" +
+		"    ctx = ctx.push_directory(ctx, \".\")\n" +
+		"    # from .\n" +
+		"    ctx.configure_file(ctx, \"top.in\", \"top.out\")\n" +
+		"    ctx = ctx.pop_directory(ctx)\n" +
+		"    return ctx\n"
+	if diff := cmp.Diff(expected, b.String()); diff != "" {
+		t.Errorf("Unexpected output:\n%s", diff)
+	}
+}
+
+func TestParentScope(t *testing.T) {
+	fsys := fstest.MapFS{
+		"llvm/CMakeLists.txt": {Data: []byte("set(X before)\nadd_subdirectory(lib)\nmessage(\"X=${X} Y=${Y}\")\n")},
+		"llvm/lib/CMakeLists.txt": {Data: []byte("message(\"lib X=${X}\")\n" +
+			"set(X v PARENT_SCOPE)\nset(Y leaked)\nmessage(\"lib X=${X} Y=${Y}\")\n")},
+	}
+	// Subdirectories evaluated in parallel do not propagate PARENT_SCOPE, so only serial evaluation is tested.
+	var messages []string
+	e := NewEvaluator(writer.NewStarlarkWriter(ioutil.Discard), FileSystem(fsys),
+		CaptureMessages(func(_, text string) { messages = append(messages, text) }))
+	if err := e.walk(bzlpath.ToPaths([]string{"llvm"})); err != nil {
+		t.Fatal("Unexpected error walking tree: ", err)
+	}
+	// PARENT_SCOPE does not affect the child's own scope, while the child's scope is discarded on exit.
+	expected := []string{"lib X=before", "lib X=before Y=leaked", "X=v Y="}
+	if diff := cmp.Diff(expected, messages); diff != "" {
+		t.Errorf("Unexpected messages:\n%s", diff)
+	}
+}
+
+func TestProjectRoot(t *testing.T) {
+	fsys := fstest.MapFS{
+		"llvm/CMakeLists.txt":     {Data: []byte("add_subdirectory(lib)\n")},
+		"llvm/lib/CMakeLists.txt": {Data: []byte("include_directories(include)\nmessage(\"${CMAKE_SOURCE_DIR} ${CMAKE_CURRENT_SOURCE_DIR} ${CMAKE_CURRENT_BINARY_DIR}\")\n")},
+	}
+	var messages []string
+	e := NewEvaluator(writer.NewStarlarkWriter(ioutil.Discard), FileSystem(fsys), ProjectRoot("/src/llvm-project"),
+		CaptureMessages(func(_, text string) { messages = append(messages, text) }))
+	if err := e.walk(bzlpath.ToPaths([]string{"llvm"})); err != nil {
+		t.Fatal("Unexpected error walking tree: ", err)
+	}
+	expected := []string{"/src/llvm-project /src/llvm-project/lib /src/llvm-project/lib"}
+	if diff := cmp.Diff(expected, messages); diff != "" {
+		t.Errorf("Unexpected messages:\n%s", diff)
+	}
+	if diff := cmp.Diff([]string{"/src/llvm-project/lib/include"}, e.IncludeDirectories("lib")); diff != "" {
+		t.Errorf("Unexpected include directories:\n%s", diff)
+	}
+
+	for _, root := range []string{"relative", "/", "//root", "/root/", "/root/../x"} {
+		e := NewEvaluator(writer.NewStarlarkWriter(ioutil.Discard), FileSystem(fsys), ProjectRoot(root))
+		if err := e.walk(bzlpath.ToPaths([]string{"llvm"})); err == nil {
+			t.Errorf("Expected error walking with project root %#v", root)
+		}
+	}
+}
+
+func TestEmitCacheDocs(t *testing.T) {
+	input := "set(PLAIN value)\n" +
+		"set(CACHED ON CACHE BOOL \"Enable the thing.\")\n" +
+		"set(FORCED a b CACHE STRING \"Forced\nover two lines.\" FORCE)\n" +
+		"set(UNDOCUMENTED x CACHE INTERNAL \"\")\n"
+	output, err := evalMacro(input, EmitCacheDocs(true), PrintCommands(Matching("^set$")))
+	if err != nil {
+		t.Fatal("Unexpected error: ", err)
+	}
+	expected := "def x(ctx):\n" +
+		"    ctx.set(ctx, \"PLAIN\", \"value\")\n" +
+		"    # Enable the thing.\n" +
+		"    ctx.set(ctx, \"CACHED\", \"ON\", \"CACHE\", \"BOOL\", \"Enable the thing.\")\n" +
+		"    # Forced\n" +
+		"    # over two lines.\n" +
+		"    ctx.set(ctx, \"FORCED\", \"a\", \"b\", \"CACHE\", \"STRING\", \"\"\"Forced\nover two lines.\"\"\", \"FORCE\")\n" +
+		"    ctx.set(ctx, \"UNDOCUMENTED\", \"x\", \"CACHE\", \"INTERNAL\", \"\")\n" +
+		"    return ctx\n"
+	if diff := cmp.Diff(expected, output); diff != "" {
+		t.Errorf("Unexpected output:\n%s", diff)
+	}
+
+	output, err = evalMacro(input, EmitAssignments(Matching("^CACHED$")), EmitCacheDocs(true), PrintCommands(Matching("^set$")))
+	if err != nil {
+		t.Fatal("Unexpected error: ", err)
+	}
+	if expected := "    # Enable the thing.\n    CACHED = \"ON\"\n"; !strings.Contains(output, expected) {
+		t.Errorf("Expected output to contain %#v:\n%s", expected, output)
+	}
+
+	output, err = evalMacro(input, PrintCommands(Matching("^set$")))
+	if err != nil {
+		t.Fatal("Unexpected error: ", err)
+	}
+	if strings.Contains(output, "#") {
+		t.Errorf("Unexpected comments without EmitCacheDocs:\n%s", output)
+	}
+}
+
+func TestReadCommands(t *testing.T) {
+	input := "# Commands to print.\n" +
+		"\n" +
+		"configure_file\n" +
+		"  add_\\w+_library   # Any library.\n" +
+		"\t\n" +
+		"set # Trailing comment.\n"
+	p, err := ReadCommands(strings.NewReader(input))
+	if err != nil {
+		t.Fatal("Unexpected error reading commands: ", err)
+	}
+	tests := map[string]bool{
+		"configure_file":      true,
+		"add_llvm_library":    true,
+		"add_clang_library":   true,
+		"set":                 true,
+		"add_library":         false,
+		"configure_file_more": false,
+		"unset":               false,
+		"":                    false,
+	}
+	for name, expected := range tests {
+		if actual := p(name); actual != expected {
+			t.Errorf("Unexpected match for %#v: %v != %v", name, actual, expected)
+		}
+	}
+
+	if _, err := ReadCommands(strings.NewReader("set\nadd_(\n")); err == nil {
+		t.Error("Expected error reading invalid pattern")
+	}
+}
+
+func TestReadPaths(t *testing.T) {
+	input := "# Trees to evaluate.\n" +
+		"\n" +
+		"llvm\n" +
+		"  clang/lib/  \n" +
+		"\t\n" +
+		"  # Indented comment.\n" +
+		"/abs/path/./lld\n" +
+		"dir#with#hashes\n"
+	paths, err := ReadPaths(strings.NewReader(input))
+	if err != nil {
+		t.Fatal("Unexpected error reading paths: ", err)
+	}
+	expected := []bzlpath.Path{
+		{"llvm"},
+		{"clang", "lib"},
+		{"/", "abs", "path", "lld"},
+		{"dir#with#hashes"},
+	}
+	if diff := cmp.Diff(expected, paths); diff != "" {
+		t.Errorf("Unexpected paths:\n%s", diff)
+	}
+}
+
+func TestSuppressDuplicateCommands(t *testing.T) {
+	fsys := fstest.MapFS{
+		"CMakeLists.txt": {Data: []byte("configure_file(a.in a.out)\nconfigure_file(a.in a.out)\n" +
+			"configure_file(b.in b.out)\nadd_subdirectory(sub)\nconfigure_file(b.in b.out)\n")},
+		"sub/CMakeLists.txt": {Data: []byte("configure_file(b.in b.out)\n")},
+	}
+	walk := func(opts ...Option) string {
+		var b strings.Builder
+		opts = append(opts, FileSystem(fsys), PrintCommands(Matching("^configure_file$")))
+		if err := NewEvaluator(writer.NewStarlarkWriter(&b), opts...).walk(bzlpath.ToPaths([]string{"."})); err != nil {
+			t.Fatal("Unexpected error walking tree: ", err)
+		}
+		return b.String()
+	}
+	expected := "def generated_cmake_targets(ctx):\n" +
+		"    ctx = ctx.push_directory(ctx, \".\")\n" +
+		"    ctx.configure_file(ctx, \"a.in\", \"a.out\")\n" +
+		"    ctx.configure_file(ctx, \"b.in\", \"b.out\")\n" +
+		"    ctx = ctx.push_directory(ctx, \"sub\")\n" +
+		"    ctx.configure_file(ctx, \"b.in\", \"b.out\")\n" +
+		"    ctx = ctx.pop_directory(ctx)\n" +
+		"    ctx.configure_file(ctx, \"b.in\", \"b.out\")\n" +
+		"    ctx = ctx.pop_directory(ctx)\n" +
+		"    return ctx\n"
+	if diff := cmp.Diff(expected, walk(SuppressDuplicateCommands(true))); diff != "" {
+		t.Errorf("Unexpected output:\n%s", diff)
+	}
+	if diff := cmp.Diff(expected, walk(SuppressDuplicateCommands(true), Parallelism(4))); diff != "" {
+		t.Errorf("Unexpected parallel output:\n%s", diff)
+	}
+	if actual := walk(); strings.Count(actual, "\"a.in\"") != 2 {
+		t.Errorf("Expected duplicate commands without suppression:\n%s", actual)
+	}
+}
+
+func TestRequiredVersion(t *testing.T) {
+	tests := map[string]VersionRange{
+		"cmake_minimum_required(VERSION 3.13.4)\n":                                  {Min: "3.13.4"},
+		"cmake_minimum_required(VERSION 3.4.3...3.15 FATAL_ERROR)\n":                {Min: "3.4.3", Max: "3.15"},
+		"cmake_minimum_required(VERSION 3.13)\ncmake_policy(VERSION 3.13...3.20)\n": {Min: "3.13"},
+		"cmake_policy(SET CMP0075 NEW)\n":                                           {},
+	}
+	for input, expected := range tests {
+		e := NewEvaluator(writer.NewStarlarkWriter(ioutil.Discard))
+		if err := evalString(e, input); err != nil {
+			t.Errorf("Unexpected error evaluating %#v: %v", input, err)
+			continue
+		}
+		if diff := cmp.Diff(expected, e.RequiredVersion()); diff != "" {
+			t.Errorf("Unexpected version for %#v:\n%s", input, diff)
+		}
+		if actual := e.v.Get("CMAKE_MINIMUM_REQUIRED_VERSION"); actual != expected.Min {
+			t.Errorf("Unexpected CMAKE_MINIMUM_REQUIRED_VERSION for %#v: %#v", input, actual)
+		}
+	}
+}
+
+func TestExcludePaths(t *testing.T) {
+	fsys := fstest.MapFS{
+		"CMakeLists.txt":                      {Data: []byte("add_subdirectory(unittests)\nadd_subdirectory(lib)\n")},
+		"unittests/CMakeLists.txt":            {Data: []byte("configure_file(unittests.in unittests.out)\n")},
+		"lib/CMakeLists.txt":                  {Data: []byte("add_subdirectory(Target)\nadd_subdirectory(unittests)\n")},
+		"lib/unittests/CMakeLists.txt":        {Data: []byte("configure_file(lib.in lib.out)\n")},
+		"lib/Target/CMakeLists.txt":           {Data: []byte("add_subdirectory(unittests)\n")},
+		"lib/Target/unittests/CMakeLists.txt": {Data: []byte("configure_file(target.in target.out)\n")},
+	}
+	tests := map[string][]string{
+		// Single segment patterns match the subdirectory argument.
+		`^unittests$`: nil,
+		// Path patterns match the project-relative path.
+		`^lib/Target/unittests$`:     {"unittests.in", "lib.in"},
+		`(^|/)Target/unittests($|/)`: {"unittests.in", "lib.in"},
+		`^lib/`:                      {"unittests.in"},
+		`^lib/Target$`:               {"unittests.in", "lib.in"},
+	}
+	for pattern, expected := range tests {
+		var calls callRecorder
+		e := NewEvaluator(&calls, FileSystem(fsys), ExcludePaths(Matching(pattern)), PrintCommands(Matching("^configure_file$")))
+		if err := e.walk(bzlpath.ToPaths([]string{"."})); err != nil {
+			t.Fatal("Unexpected error walking tree: ", err)
+		}
+		var actual []string
+		for _, call := range calls.calls {
+			if strings.HasPrefix(call, "WriteCommand(configure_file, [[") {
+				actual = append(actual, strings.Fields(strings.TrimPrefix(call, "WriteCommand(configure_file, [["))[0])
+			}
+		}
+		if diff := cmp.Diff(expected, actual); diff != "" {
+			t.Errorf("Unexpected commands excluding %#v:\n%s", pattern, diff)
+		}
+	}
+}
+
+func TestLogging(t *testing.T) {
+	var warnings []string
+	logger := func(level, msg string, args ...interface{}) {
+		warnings = append(warnings, level+": "+fmt.Sprintf(msg, args...))
+	}
+	e := NewEvaluator(writer.NewStarlarkWriter(ioutil.Discard), Logging(logger))
+	if err := evalString(e, "set()\nunset(A B C)\nset(X y PARENT_SCOPE)\nset_property(GLOBAL)\n"); err != nil {
+		t.Fatal("Unexpected error: ", err)
+	}
+	expected := []string{
+		"warning: set() at 1:1: requires 1 or more arguments, found 0",
+		"warning: Ignoring invalid unset command",
+		"warning: Attempt to set X in PARENT_SCOPE at root",
+		"warning: Ignoring set_property without a property name",
+	}
+	if diff := cmp.Diff(expected, warnings); diff != "" {
+		t.Errorf("Unexpected warnings:\n%s", diff)
+	}
+}
+
+func TestParallelLogging(t *testing.T) {
+	fsys := fstest.MapFS{
+		"CMakeLists.txt":     {Data: []byte("set()\nadd_subdirectory(a)\nadd_subdirectory(b)\nunset(A B C)\n")},
+		"a/CMakeLists.txt":   {Data: []byte("set_property(GLOBAL)\nadd_subdirectory(c)\n")},
+		"a/c/CMakeLists.txt": {Data: []byte("set_property(GLOBAL)\n")},
+		"b/CMakeLists.txt":   {Data: []byte("unset(A B C)\n")},
+	}
+	walk := func(opts ...Option) []string {
+		// The logger is not safe for concurrent use.
+		var warnings []string
+		logger := func(level, msg string, args ...interface{}) {
+			warnings = append(warnings, level+": "+fmt.Sprintf(msg, args...))
+		}
+		opts = append(opts, FileSystem(fsys), Logging(logger))
+		if err := NewEvaluator(writer.NewStarlarkWriter(ioutil.Discard), opts...).walk(bzlpath.ToPaths([]string{"."})); err != nil {
+			t.Fatal("Unexpected error walking tree: ", err)
+		}
+		return warnings
+	}
+	expected := walk()
+	if len(expected) != 5 {
+		t.Fatalf("Expected 5 warnings, found %d: %v", len(expected), expected)
+	}
+	for _, n := range []int{2, 4} {
+		if diff := cmp.Diff(expected, walk(Parallelism(n))); diff != "" {
+			t.Errorf("Unexpected warnings with %d workers:\n%s", n, diff)
+		}
+	}
+}
+
+func TestStrictMode(t *testing.T) {
+	var warnings []string
+	logger := func(level, msg string, args ...interface{}) {
+		warnings = append(warnings, level+": "+fmt.Sprintf(msg, args...))
+	}
+	input := "set(X y PARENT_SCOPE)\nset(AFTER z)\n"
+	e := NewEvaluator(writer.NewStarlarkWriter(ioutil.Discard), Logging(logger), StrictMode(false))
+	if err := evalString(e, input); err != nil {
+		t.Fatal("Unexpected error: ", err)
+	}
+	if diff := cmp.Diff([]string{"warning: Attempt to set X in PARENT_SCOPE at root"}, warnings); diff != "" {
+		t.Errorf("Unexpected warnings:\n%s", diff)
+	}
+	if actual := e.v.Get("AFTER"); actual != "z" {
+		t.Errorf("Expected AFTER=%#v found %#v", "z", actual)
+	}
+
+	warnings = nil
+	e = NewEvaluator(writer.NewStarlarkWriter(ioutil.Discard), Logging(logger), StrictMode(true))
+	err := evalString(e, input)
+	if expected := "1:1: Attempt to set X in PARENT_SCOPE at root"; err == nil || err.Error() != expected {
+		t.Errorf("Expected error %#v, found %v", expected, err)
+	}
+	if len(warnings) != 0 {
+		t.Errorf("Unexpected warnings in strict mode: %v", warnings)
+	}
+	if actual := e.v.Get("AFTER"); actual != "" {
+		t.Errorf("Expected evaluation to stop, found AFTER=%#v", actual)
+	}
+}
+
+func TestUndefinedVariableErrors(t *testing.T) {
+	input := "set(EMPTY \"\")\nset(A \"${EMPTY}\")\nset(B ${UNSET})\nset(AFTER z)\n"
+	e := NewEvaluator(writer.NewStarlarkWriter(ioutil.Discard), UndefinedVariableErrors(false))
+	if err := evalString(e, input); err != nil {
+		t.Fatal("Unexpected error: ", err)
+	}
+	if actual := e.v.Get("AFTER"); actual != "z" {
+		t.Errorf("Expected AFTER=%#v found %#v", "z", actual)
+	}
+
+	e = NewEvaluator(writer.NewStarlarkWriter(ioutil.Discard), UndefinedVariableErrors(true))
+	err := evalString(e, input)
+	if expected := `3:7: undefined variable "UNSET"`; err == nil || err.Error() != expected {
+		t.Errorf("Expected error %#v, found %v", expected, err)
+	}
+	if actual := e.v.Get("AFTER"); actual != "" {
+		t.Errorf("Expected evaluation to stop, found AFTER=%#v", actual)
+	}
+}
+
+func TestCaptureMessages(t *testing.T) {
+	var messages []string
+	capture := func(mode, text string) {
+		messages = append(messages, mode+": "+text)
+	}
+	input := "set(V value)\n" +
+		"message(STATUS \"Found ${V}\")\n" +
+		"message(no mode)\n" +
+		"message(FATAL_ERROR \"stop\")\n" +
+		"set(AFTER z)\n"
+	e := NewEvaluator(writer.NewStarlarkWriter(ioutil.Discard), CaptureMessages(capture), StrictMode(false))
+	if err := evalString(e, input); err != nil {
+		t.Fatal("Unexpected error: ", err)
+	}
+	expected := []string{"STATUS: Found value", "NOTICE: nomode", "FATAL_ERROR: stop"}
+	if diff := cmp.Diff(expected, messages); diff != "" {
+		t.Errorf("Unexpected messages:\n%s", diff)
+	}
+	if actual := e.v.Get("AFTER"); actual != "z" {
+		t.Errorf("Expected AFTER=%#v found %#v", "z", actual)
+	}
+
+	messages = nil
+	e = NewEvaluator(writer.NewStarlarkWriter(ioutil.Discard), CaptureMessages(capture), StrictMode(true))
+	err := evalString(e, input)
+	if expected := "4:1: message(FATAL_ERROR): stop"; err == nil || err.Error() != expected {
+		t.Errorf("Expected error %#v, found %v", expected, err)
+	}
+	if e.v.IsSet("AFTER") {
+		t.Error("Expected evaluation to stop after FATAL_ERROR")
+	}
+}
+
+func TestSetValuesAsLists(t *testing.T) {
+	input := "set(X a b c)\nset(Y a b CACHE STRING \"doc\")\nset(Z a)\n"
+	tests := []struct {
+		desc     string
+		opt      Option
+		expected string
+	}{
+		{"default", func(*eval) {}, "def x(ctx):\n" +
+			"    ctx.set(ctx, \"X\", \"a\", \"b\", \"c\")\n" +
+			"    ctx.set(ctx, \"Y\", \"a\", \"b\", \"CACHE\", \"STRING\", \"doc\")\n" +
+			"    Z = \"a\"\n" +
+			"    return ctx\n"},
+		{"SetValuesAsLists", SetValuesAsLists(), "def x(ctx):\n" +
+			"    ctx.set(ctx, \"X\", [\"a\", \"b\", \"c\"])\n" +
+			"    ctx.set(ctx, \"Y\", [\"a\", \"b\"], \"CACHE\", \"STRING\", \"doc\")\n" +
+			"    Z = \"a\"\n" +
+			"    return ctx\n"},
+		{"SetValuesJoined", SetValuesJoined(), "def x(ctx):\n" +
+			"    ctx.set(ctx, \"X\", \"a;b;c\")\n" +
+			"    ctx.set(ctx, \"Y\", \"a;b\", \"CACHE\", \"STRING\", \"doc\")\n" +
+			"    Z = \"a\"\n" +
+			"    return ctx\n"},
+	}
+	for _, test := range tests {
+		output, err := evalMacro(input, PrintCommands(Matching("^set$")), EmitAssignments(Matching("^Z$")), test.opt)
+		if err != nil {
+			t.Fatal("Unexpected error evaluating input: ", err)
+		}
+		if diff := cmp.Diff(test.expected, output); diff != "" {
+			t.Errorf("Unexpected output with %s:\n%s", test.desc, diff)
+		}
+	}
+
+	output, err := evalMacro("set(X a b c)\n", PrintCommands(Matching("^set$")), EmitAssignments(Matching("^X$")), SetValuesJoined())
+	if err != nil {
+		t.Fatal("Unexpected error evaluating input: ", err)
+	}
+	if diff := cmp.Diff("def x(ctx):\n    X = \"a;b;c\"\n    return ctx\n", output); diff != "" {
+		t.Errorf("Unexpected assignment output:\n%s", diff)
+	}
+}
+
+func TestUserDefinedCommands(t *testing.T) {
+	input := "macro(add_config name)\n" +
+		"  configure_file(${name}.in ${name}.out ${ARGN})\n" +
+		"endmacro()\n" +
+		"function(set_local name)\n" +
+		"  set(${name} ${ARGV1} PARENT_SCOPE)\n" +
+		"  set(LOCAL ${ARGC})\n" +
+		"endfunction()\n" +
+		"MACRO(set_in_caller)\n" +
+		"  set(FROM_MACRO ${ARGV0})\n" +
+		"ENDMACRO()\n" +
+		"add_config(config COPYONLY)\n" +
+		"set_local(RESULT value)\n" +
+		"Set_In_Caller(visible)\n" +
+		"configure_file(\"[${name}${ARGN}${LOCAL}]\" ${RESULT} ${FROM_MACRO})\n"
+	output, err := evalMacro(input, PrintCommands(Matching("^configure_file$")))
+	if err != nil {
+		t.Fatal("Unexpected error evaluating input: ", err)
+	}
+	expected := "def x(ctx):\n" +
+		"    ctx.configure_file(ctx, \"config.in\", \"config.out\", \"COPYONLY\")\n" +
+		"    ctx.configure_file(ctx, \"[]\", \"value\", \"visible\")\n" +
+		"    return ctx\n"
+	if diff := cmp.Diff(expected, output); diff != "" {
+		t.Errorf("Unexpected output:\n%s", diff)
+	}
+
+	if _, err := evalMacro("function(recurse)\n  recurse()\nendfunction()\nrecurse()\n"); err == nil {
+		t.Error("Expected error from unbounded recursion")
+	}
+}
+
+func TestArguments(t *testing.T) {
+	pos := lexer.Position{Line: 1, Column: 1}
+	args := newArguments("cmd", pos, []string{"NAME", "a", "b", "CACHE", "STRING", "doc", "PARENT_SCOPE"})
+	if head, err := args.Require(1); err != nil {
+		t.Error("Unexpected error: ", err)
+	} else if diff := cmp.Diff([]string{"NAME"}, head); diff != "" {
+		t.Errorf("Unexpected required arguments:\n%s", diff)
+	}
+	if !args.Optional("PARENT_SCOPE") {
+		t.Error("Expected trailing PARENT_SCOPE")
+	}
+	if args.Optional("PARENT_SCOPE") {
+		t.Error("Unexpected repeated PARENT_SCOPE")
+	}
+	if tail, ok, err := args.Keyword("CACHE", 2, 3); err != nil || !ok {
+		t.Errorf("Unexpected CACHE result: %v, %v", ok, err)
+	} else if diff := cmp.Diff([]string{"STRING", "doc"}, tail); diff != "" {
+		t.Errorf("Unexpected keyword arguments:\n%s", diff)
+	}
+	if err := args.Done(); err == nil {
+		t.Error("Expected error with arguments remaining")
+	} else if msg := "cmd() at 1:1: unexpected extra arguments [\"a\" \"b\"]"; err.Error() != msg {
+		t.Errorf("Unexpected error %#v != %#v", err.Error(), msg)
+	}
+	if diff := cmp.Diff([]string{"a", "b"}, args.Remaining()); diff != "" {
+		t.Errorf("Unexpected remaining arguments:\n%s", diff)
+	}
+	if err := args.Done(); err != nil {
+		t.Error("Unexpected error: ", err)
+	}
+
+	// Undersupply.
+	if _, err := newArguments("cmd", pos, []string{"a"}).Require(2); err == nil {
+		t.Error("Expected error requiring too many arguments")
+	} else if msg := "cmd() at 1:1: requires 2 or more arguments, found 1"; err.Error() != msg {
+		t.Errorf("Unexpected error %#v != %#v", err.Error(), msg)
+	}
+	if _, _, err := newArguments("cmd", pos, []string{"a", "CACHE", "STRING"}).Keyword("CACHE", 2, 3); err == nil {
+		t.Error("Expected error with too few keyword arguments")
+	}
+	// Oversupply.
+	if _, _, err := newArguments("cmd", pos, []string{"CACHE", "a", "b", "c", "d"}).Keyword("CACHE", 2, 3); err == nil {
+		t.Error("Expected error with too many keyword arguments")
+	}
+	if _, ok, err := newArguments("cmd", pos, []string{"a", "b"}).Keyword("CACHE", 2, 3); ok || err != nil {
+		t.Errorf("Unexpected result for missing keyword: %v, %v", ok, err)
+	}
+}
+
+func TestSetVariable(t *testing.T) {
+	var warnings []string
+	logger := func(level, msg string, args ...interface{}) {
+		warnings = append(warnings, fmt.Sprintf(msg, args...))
+	}
+	e := NewEvaluator(writer.NewStarlarkWriter(ioutil.Discard), Logging(logger))
+	input := "set(LIST a b c)\n" +
+		"set(CACHED x y CACHE STRING \"doc\" FORCE)\n" +
+		"set(INVALID x CACHE STRING)\n"
+	if err := evalString(e, input); err != nil {
+		t.Fatal("Unexpected error: ", err)
+	}
+	for key, value := range map[string]string{"LIST": "a;b;c", "CACHED": "x;y", "INVALID": ""} {
+		if actual := e.v.Get(key); actual != value {
+			t.Errorf("Expected %s=%#v found %#v", key, value, actual)
+		}
+	}
+	if actual := e.v.GetCache("CACHED"); actual != "x;y" {
+		t.Errorf("Unexpected cached value %#v", actual)
+	}
+	expected := []string{"set() at 3:1: CACHE requires between 2 and 3 arguments, found 1"}
+	if diff := cmp.Diff(expected, warnings); diff != "" {
+		t.Errorf("Unexpected warnings:\n%s", diff)
+	}
+}
+
+func TestDefined(t *testing.T) {
+	e := NewEvaluator(writer.NewStarlarkWriter(ioutil.Discard))
+	input := "set(EMPTY \"\")\n" +
+		"set(VALUE x)\n" +
+		"set(VALUE)\n" +
+		"set(CLEARED y)\n" +
+		"unset(CLEARED)\n"
+	if err := evalString(e, input); err != nil {
+		t.Fatal("Unexpected error: ", err)
+	}
+	for name, expected := range map[string]bool{"EMPTY": true, "VALUE": false, "CLEARED": false, "ABSENT": false} {
+		if actual, err := e.evalCondition([]string{"DEFINED", name}); err != nil {
+			t.Errorf("Unexpected error evaluating DEFINED %s: %v", name, err)
+		} else if actual != expected {
+			t.Errorf("Expected DEFINED %s to be %v", name, expected)
+		}
+	}
+}
+
+func TestDefinedEnvAndExists(t *testing.T) {
+	const env = "LLVMBZLGEN_TEST_DEFINED"
+	os.Unsetenv(env)
+	os.Unsetenv(env + "_UNSET")
+
+	fsys := fstest.MapFS{
+		"llvm/CMakeLists.txt":           {Data: []byte("add_subdirectory(lib)\n")},
+		"llvm/lib/CMakeLists.txt":       {Data: []byte("")},
+		"llvm/lib/Target/X86/README.md": {Data: []byte("")},
+	}
+	e := NewEvaluator(writer.NewStarlarkWriter(ioutil.Discard), FileSystem(fsys), EnvOverrides(map[string]string{env: ""}))
+	if err := e.walk(bzlpath.ToPaths([]string{"llvm"})); err != nil {
+		t.Fatal("Unexpected error walking tree: ", err)
+	}
+	// Conditions are evaluated from the root directory once the walk completes.
+	tests := []struct {
+		condition []string
+		expected  bool
+	}{
+		{[]string{"DEFINED", "ENV{" + env + "}"}, true},
+		{[]string{"DEFINED", "ENV{" + env + "_UNSET}"}, false},
+		{[]string{"NOT", "DEFINED", "ENV{" + env + "_UNSET}"}, true},
+		{[]string{"EXISTS", "/root/lib/CMakeLists.txt"}, true},
+		{[]string{"EXISTS", "lib/Target/X86"}, true},
+		{[]string{"EXISTS", "/root/lib/Target/ARM"}, false},
+		{[]string{"EXISTS", "/elsewhere"}, false},
+		{[]string{"IS_DIRECTORY", "/root/lib/Target"}, true},
+		{[]string{"IS_DIRECTORY", "/root/lib/CMakeLists.txt"}, false},
+		{[]string{"IS_DIRECTORY", "/root/missing"}, false},
+	}
+	for _, test := range tests {
+		if actual, err := e.evalCondition(test.condition); err != nil {
+			t.Errorf("Unexpected error evaluating %v: %v", test.condition, err)
+		} else if actual != test.expected {
+			t.Errorf("Expected %v to be %v", test.condition, test.expected)
+		}
+	}
+}
+
+func TestFileGlob(t *testing.T) {
+	fsys := fstest.MapFS{
+		"llvm/CMakeLists.txt": {Data: []byte("add_subdirectory(lib)\n")},
+		"llvm/lib/CMakeLists.txt": {Data: []byte("file(GLOB srcs *.cpp)\n" +
+			"file(GLOB_RECURSE all RELATIVE ${CMAKE_CURRENT_SOURCE_DIR} *.cpp *.h)\n" +
+			"file(GLOB entries LIST_DIRECTORIES false Support/*)\n" +
+			"file(GLOB none *.c)\n" +
+			"file(WRITE ${CMAKE_CURRENT_BINARY_DIR}/out.txt ignored)\n" +
+			"message(\"${srcs}\")\nmessage(\"${all}\")\nmessage(\"${entries}\")\nmessage(\"[${none}]\")\n")},
+		"llvm/lib/b.cpp":               {Data: []byte("")},
+		"llvm/lib/a.cpp":               {Data: []byte("")},
+		"llvm/lib/a.h":                 {Data: []byte("")},
+		"llvm/lib/Support/Path.cpp":    {Data: []byte("")},
+		"llvm/lib/Support/Unix/Path.h": {Data: []byte("")},
+	}
+	var messages []string
+	e := NewEvaluator(writer.NewStarlarkWriter(ioutil.Discard), FileSystem(fsys), StrictMode(true),
+		CaptureMessages(func(_, text string) { messages = append(messages, text) }))
+	if err := e.walk(bzlpath.ToPaths([]string{"llvm"})); err != nil {
+		t.Fatal("Unexpected error walking tree: ", err)
+	}
+	expected := []string{
+		"/root/lib/a.cpp;/root/lib/b.cpp",
+		"Support/Path.cpp;Support/Unix/Path.h;a.cpp;a.h;b.cpp",
+		"/root/lib/Support/Path.cpp",
+		"[]",
+	}
+	if diff := cmp.Diff(expected, messages); diff != "" {
+		t.Errorf("Unexpected glob results:\n%s", diff)
+	}
+}
+
+func TestDefineVarsExpanded(t *testing.T) {
+	const env = "LLVMBZLGEN_TEST_HOME"
+	os.Unsetenv(env)
+	e := NewEvaluator(writer.NewStarlarkWriter(ioutil.Discard), EnvOverrides(map[string]string{env: "/home/user"}), DefineVarsExpanded(map[string]string{
+		"A_ROOT":    "$ENV{" + env + "}/llvm",
+		"B_SRC":     "${A_ROOT}/lib",
+		"C_LIST":    "${B_SRC};two words",
+		"D_LATER":   "${E_LATER}",
+		"E_LATER":   "value",
+		"F_LITERAL": "\\${A_ROOT}",
+		"G_QUOTED":  `-DNAME="${A_ROOT}"`,
+		"H_ESCAPED": `say \"hi\"`,
+	}))
+	for key, expected := range map[string]string{
+		"A_ROOT":    "/home/user/llvm",
+		"B_SRC":     "/home/user/llvm/lib",
+		"C_LIST":    "/home/user/llvm/lib;two words",
+		"D_LATER":   "",
+		"E_LATER":   "value",
+		"F_LITERAL": "${A_ROOT}",
+		"G_QUOTED":  `-DNAME="/home/user/llvm"`,
+		"H_ESCAPED": `say "hi"`,
+	} {
+		if actual := e.v.Get(key); actual != expected {
+			t.Errorf("Expected %s=%#v found %#v", key, expected, actual)
+		}
+	}
+	if e.optErr != nil {
+		t.Errorf("Unexpected error: %v", e.optErr)
+	}
+
+	e = NewEvaluator(writer.NewStarlarkWriter(ioutil.Discard), DefineVarsExpanded(map[string]string{"UNTERMINATED": "${A_ROOT"}))
+	if err := e.walk(nil); err == nil || !strings.Contains(err.Error(), "UNTERMINATED") {
+		t.Errorf("Expected an error expanding UNTERMINATED, found %v", err)
+	}
+}
+
+func TestConfigureFileGroups(t *testing.T) {
+	fsys := fstest.MapFS{
+		"CMakeLists.txt": {Data: []byte("add_subdirectory(lib/Support)\n")},
+		"lib/Support/CMakeLists.txt": {Data: []byte(
+			"configure_file(config.h.in config.h)\n" +
+				"configure_file(${CMAKE_CURRENT_SOURCE_DIR}/abi.h.in ${CMAKE_CURRENT_BINARY_DIR}/abi.h @ONLY)\n")},
+	}
+	var b strings.Builder
+	e := NewEvaluator(writer.NewStarlarkWriter(&b), FileSystem(fsys), ConfigureFileGroups(true))
+	if err := e.walk(bzlpath.ToPaths([]string{"."})); err != nil {
+		t.Fatal("Unexpected error walking tree: ", err)
+	}
+	expected := "def generated_cmake_targets(ctx):\n" +
+		"    ctx = ctx.push_directory(ctx, \"lib/Support\")\n" +
+		"    ctx.filegroup(ctx, name = \"lib_Support_configured_files\", srcs = [\"config.h\", \"/root/lib/Support/abi.h\"])\n" +
+		"    ctx = ctx.pop_directory(ctx)\n" +
+		"    return ctx\n"
+	if diff := cmp.Diff(expected, b.String()); diff != "" {
+		t.Errorf("Unexpected output:\n%s", diff)
+	}
+}
+
+func TestGlob(t *testing.T) {
+	tests := []struct {
+		pattern string
+		matches []string
+		misses  []string
+	}{
+		{"*", []string{"lib", "a.cpp"}, []string{"lib/Support", "a/"}},
+		{"lib/*", []string{"lib/Support", "lib/IR"}, []string{"lib", "lib/Support/Unix"}},
+		{"*/test/*", []string{"clang/test/Sema"}, []string{"test/Sema", "a/b/test/c", "clang/test"}},
+		{"**/test", []string{"test", "clang/test", "a/b/test"}, []string{"clang/test/Sema", "contest"}},
+		{"**/unittests/**", []string{"unittests/ADT", "llvm/unittests/ADT/a.cpp"}, []string{"llvm/unittests"}},
+		{"lib/**", []string{"lib/", "lib/Support", "lib/Support/Unix"}, []string{"lib", "tools/lib/x"}},
+		{"lib/[A-C]*", []string{"lib/Analysis", "lib/CodeGen"}, []string{"lib/IR", "lib/analysis"}},
+		{"lib/[!A-C]?", []string{"lib/IR"}, []string{"lib/AB", "lib/IRx"}},
+		{"a.cpp", []string{"a.cpp"}, []string{"abcpp", "a/cpp"}},
+	}
+	for _, test := range tests {
+		glob := Glob(test.pattern)
+		for _, p := range test.matches {
+			if !glob(p) {
+				t.Errorf("Expected %#v to match %#v", test.pattern, p)
+			}
+		}
+		for _, p := range test.misses {
+			if glob(p) {
+				t.Errorf("Expected %#v not to match %#v", test.pattern, p)
+			}
+		}
+	}
+}
+
+func TestRecurseWhen(t *testing.T) {
+	fsys := fstest.MapFS{
+		"CMakeLists.txt":       {Data: []byte("set(LLVM_BUILD_TOOLS OFF)\nadd_subdirectory(lib)\nadd_subdirectory(tools)\n")},
+		"lib/CMakeLists.txt":   {Data: []byte("configure_file(lib.in lib.out)\n")},
+		"tools/CMakeLists.txt": {Data: []byte("configure_file(tools.in tools.out)\n")},
+	}
+	guarded := func(name string, args []string, vars *bindings.Mapping) bool {
+		return args[0] != "tools" || vars.Get("LLVM_BUILD_TOOLS") != "OFF"
+	}
+	var b strings.Builder
+	e := NewEvaluator(writer.NewStarlarkWriter(&b), FileSystem(fsys), RecurseWhen(guarded), PrintCommands(Matching("^configure_file$")))
+	if err := e.walk(bzlpath.ToPaths([]string{"."})); err != nil {
+		t.Fatal("Unexpected error walking tree: ", err)
+	}
+	expected := "def generated_cmake_targets(ctx):\n" +
+		"    ctx = ctx.push_directory(ctx, \"lib\")\n" +
+		"    ctx.configure_file(ctx, \"lib.in\", \"lib.out\")\n" +
+		"    ctx = ctx.pop_directory(ctx)\n" +
+		"    return ctx\n"
+	if diff := cmp.Diff(expected, b.String()); diff != "" {
+		t.Errorf("Unexpected output:\n%s", diff)
+	}
+}
+
+func TestResolveSubdirectory(t *testing.T) {
+	fsys := fstest.MapFS{
+		"llvm/CMakeLists.txt":            {Data: []byte("add_subdirectory(foo)\nadd_subdirectory(bar)\nadd_subdirectory(baz)\n")},
+		"llvm/vendor/foo/CMakeLists.txt": {Data: []byte("configure_file(foo.in foo.out)\n")},
+		"llvm/bar/CMakeLists.txt":        {Data: []byte("configure_file(bar.in bar.out)\n")},
+	}
+	var resolved []string
+	resolve := func(current, arg string) (string, bool) {
+		resolved = append(resolved, path.Join(current, arg))
+		switch arg {
+		case "foo":
+			return "vendor/foo", true
+		case "baz":
+			return "", false
+		}
+		return arg, true
+	}
+	var b strings.Builder
+	e := NewEvaluator(writer.NewStarlarkWriter(&b), FileSystem(fsys), ResolveSubdirectory(resolve), PrintCommands(Matching("^configure_file$")))
+	if err := e.walk(bzlpath.ToPaths([]string{"llvm"})); err != nil {
+		t.Fatal("Unexpected error walking tree: ", err)
+	}
+	expected := "def generated_cmake_targets(ctx):\n" +
+		"    ctx = ctx.push_directory(ctx, \"vendor/foo\")\n" +
+		"    ctx.configure_file(ctx, \"foo.in\", \"foo.out\")\n" +
+		"    ctx = ctx.pop_directory(ctx)\n" +
+		"    ctx = ctx.push_directory(ctx, \"bar\")\n" +
+		"    ctx.configure_file(ctx, \"bar.in\", \"bar.out\")\n" +
+		"    ctx = ctx.pop_directory(ctx)\n" +
+		"    return ctx\n"
+	if diff := cmp.Diff(expected, b.String()); diff != "" {
+		t.Errorf("Unexpected output:\n%s", diff)
+	}
+	if diff := cmp.Diff([]string{"foo", "bar", "baz"}, resolved); diff != "" {
+		t.Errorf("Unexpected resolved directories:\n%s", diff)
+	}
+}
+
+func TestCacheSnapshot(t *testing.T) {
+	e := NewEvaluator(writer.NewStarlarkWriter(ioutil.Discard))
+	input := "set(LLVM_TARGETS X86;ARM CACHE STRING \"Targets to build\")\n" +
+		"set(LLVM_ENABLE_ASSERTIONS ON CACHE BOOL \"Enable assertions\" FORCE)\n" +
+		"set(REGULAR value)\n"
+	if err := evalString(e, input); err != nil {
+		t.Fatal("Unexpected error: ", err)
+	}
+	expected := map[string]string{
+		"LLVM_TARGETS":           "X86;ARM",
+		"LLVM_ENABLE_ASSERTIONS": "ON",
+	}
+	if diff := cmp.Diff(expected, e.CacheSnapshot()); diff != "" {
+		t.Errorf("Unexpected cache:\n%s", diff)
+	}
+}
+
+func TestMacroName(t *testing.T) {
+	fsys := fstest.MapFS{
+		"CMakeLists.txt": {Data: []byte("configure_file(a.in a.out)\n")},
+	}
+	var b strings.Builder
+	e := NewEvaluator(writer.NewStarlarkWriter(&b), FileSystem(fsys), MacroName("llvm_support_targets"), PrintCommands(Matching("^configure_file$")))
+	if err := e.walk(bzlpath.ToPaths([]string{"."})); err != nil {
+		t.Fatal("Unexpected error walking tree: ", err)
+	}
+	if expected := "def llvm_support_targets(ctx):\n"; !strings.HasPrefix(b.String(), expected) {
+		t.Errorf("Expected output to begin with %#v, found:\n%s", expected, b.String())
+	}
+
+	b.Reset()
+	e = NewEvaluator(writer.NewStarlarkWriter(&b), FileSystem(fsys), MacroName("not-valid"))
+	if err := e.walk(bzlpath.ToPaths([]string{"."})); err == nil {
+		t.Error("Expected error walking with an invalid macro name")
+	}
+	if b.Len() != 0 {
+		t.Errorf("Unexpected output with an invalid macro name:\n%s", b.String())
+	}
+}
+
+func TestStats(t *testing.T) {
+	fsys := fstest.MapFS{
+		"CMakeLists.txt": {Data: []byte("set(A b)\nadd_subdirectory(lib)\nadd_subdirectory(unittests)\n" +
+			"include(CheckSymbolExists)\n")},
+		"lib/CMakeLists.txt": {Data: []byte("add_subdirectory(Support)\nconfigure_file(a.in a.out)\n" +
+			"configure_file(a.in a.out)\nadd_compile_options(-Wall)\n")},
+		"lib/Support/CMakeLists.txt": {Data: []byte("configure_file(b.in b.out)\n")},
+	}
+	expected := Stats{
+		CommandsEmitted:    3,
+		DirectoriesEntered: 3,
+		PathsExcluded:      1,
+		UnknownCommands:    2,
+	}
+	for _, parallelism := range []int{1, 4} {
+		e := NewEvaluator(writer.NewStarlarkWriter(ioutil.Discard), FileSystem(fsys), Parallelism(parallelism),
+			ExcludePaths(Matching("^unittests$")), PrintCommands(Matching("^configure_file$")))
+		if err := e.walk(bzlpath.ToPaths([]string{"."})); err != nil {
+			t.Fatal("Unexpected error walking tree: ", err)
+		}
+		if diff := cmp.Diff(expected, e.Stats()); diff != "" {
+			t.Errorf("Unexpected stats with parallelism %d:\n%s", parallelism, diff)
+		}
+	}
+}
+
+func TestLoadCache(t *testing.T) {
+	dir, err := ioutil.TempDir("", "cmaketobzl")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	cache := filepath.Join(dir, "CMakeCache.txt")
+	contents := "# This is the CMakeCache file.\n" +
+		"\n" +
+		"//Semicolon separated list of targets to build.\n" +
+		"LLVM_TARGETS_TO_BUILD:STRING=X86;ARM\n" +
+		"//Enable assertions.\n" +
+		"LLVM_ENABLE_ASSERTIONS:BOOL=ON\n" +
+		"PADDED:STRING=' spaced '\n" +
+		"\"QUOTED KEY\":INTERNAL=\"value\"\n" +
+		"UNTYPED=untyped\n"
+	if err := ioutil.WriteFile(cache, []byte(contents), 0644); err != nil {
+		t.Fatal(err)
+	}
+	e := NewEvaluator(writer.NewStarlarkWriter(ioutil.Discard), LoadCache(cache))
+	if e.optErr != nil {
+		t.Fatal("Unexpected error loading cache: ", e.optErr)
+	}
+	input := "set(TARGETS $CACHE{LLVM_TARGETS_TO_BUILD})\n" +
+		"set(ASSERTIONS ${LLVM_ENABLE_ASSERTIONS})\n"
+	if err := evalString(e, input); err != nil {
+		t.Fatal("Unexpected error: ", err)
+	}
+	for key, expected := range map[string]string{
+		"TARGETS":    "X86;ARM",
+		"ASSERTIONS": "ON",
+		"PADDED":     " spaced ",
+		"QUOTED KEY": "value",
+		"UNTYPED":    "untyped",
+	} {
+		if actual := e.v.Get(key); actual != expected {
+			t.Errorf("Expected %s=%#v found %#v", key, expected, actual)
+		}
+	}
+	if diff := cmp.Diff([]string{"X86", "ARM"}, e.v.GetList("LLVM_TARGETS_TO_BUILD")); diff != "" {
+		t.Errorf("Unexpected list:\n%s", diff)
+	}
+	if actual := e.v.GetCacheType("LLVM_ENABLE_ASSERTIONS"); actual != "BOOL" {
+		t.Errorf("Unexpected cache type %#v", actual)
+	}
+
+	e = NewEvaluator(writer.NewStarlarkWriter(ioutil.Discard), LoadCache(filepath.Join(dir, "missing.txt")))
+	if err := e.walk(bzlpath.ToPaths([]string{dir})); err == nil {
+		t.Error("Expected error loading missing cache")
+	}
+	if err := ReadCache(strings.NewReader("NOT AN ENTRY\n"), bindings.New()); err == nil {
+		t.Error("Expected error reading invalid cache entry")
+	}
+}
+
+// rootedFS is an fs.FS which opens absolute paths relative to the underlying filesystem.
+type rootedFS struct {
+	fstest.MapFS
+}
+
+func (r rootedFS) Open(name string) (fs.File, error) {
+	return r.MapFS.Open(strings.TrimPrefix(name, "/"))
+}
+
+func TestMultipleRoots(t *testing.T) {
+	fsys := rootedFS{fstest.MapFS{
+		"a/x/CMakeLists.txt":     {Data: []byte("add_subdirectory(lib)\n")},
+		"a/x/lib/CMakeLists.txt": {Data: []byte("configure_file(x.in x.out)\n")},
+		"b/y/CMakeLists.txt":     {Data: []byte("configure_file(${CMAKE_CURRENT_SOURCE_DIR}/y.in y.out)\n")},
+	}}
+	var b strings.Builder
+	e := NewEvaluator(writer.NewStarlarkWriter(&b), FileSystem(fsys), PrintCommands(Matching("^configure_file$")))
+	if err := e.walk(bzlpath.ToPaths([]string{"/a/x", "/b/y"})); err != nil {
+		t.Fatal("Unexpected error walking tree: ", err)
+	}
+	expected := "def generated_cmake_targets(ctx):\n" +
+		"    ctx = ctx.push_directory(ctx, \"/a/x/lib\")\n" +
+		"    ctx.configure_file(ctx, \"x.in\", \"x.out\")\n" +
+		"    ctx = ctx.pop_directory(ctx)\n" +
+		"    ctx = ctx.push_directory(ctx, \"/b/y\")\n" +
+		"    ctx.configure_file(ctx, \"/root/y.in\", \"y.out\")\n" +
+		"    ctx = ctx.pop_directory(ctx)\n" +
+		"    return ctx\n"
+	if diff := cmp.Diff(expected, b.String()); diff != "" {
+		t.Errorf("Unexpected output:\n%s", diff)
+	}
+}
+
+func TestMacroPerRoot(t *testing.T) {
+	fsys := fstest.MapFS{
+		"src/llvm/CMakeLists.txt":        {Data: []byte("add_subdirectory(lib)\n")},
+		"src/llvm/lib/CMakeLists.txt":    {Data: []byte("configure_file(llvm.in llvm.out)\n")},
+		"src/clang-tools/CMakeLists.txt": {Data: []byte("configure_file(clang.in clang.out)\n")},
+	}
+	expected := "def llvm(ctx):\n" +
+		"    ctx = ctx.push_directory(ctx, \"llvm/lib\")\n" +
+		"    ctx.configure_file(ctx, \"llvm.in\", \"llvm.out\")\n" +
+		"    ctx = ctx.pop_directory(ctx)\n" +
+		"    return ctx\n" +
+		"def clang_tools(ctx):\n" +
+		"    ctx = ctx.push_directory(ctx, \"clang-tools\")\n" +
+		"    ctx.configure_file(ctx, \"clang.in\", \"clang.out\")\n" +
+		"    ctx = ctx.pop_directory(ctx)\n" +
+		"    return ctx\n"
+	for _, parallelism := range []int{1, 4} {
+		var b strings.Builder
+		e := NewEvaluator(writer.NewStarlarkWriter(&b), FileSystem(fsys), MacroPerRoot(true), Parallelism(parallelism),
+			PrintCommands(Matching("^configure_file$")))
+		if err := e.walk(bzlpath.ToPaths([]string{"src/llvm", "src/clang-tools"})); err != nil {
+			t.Fatal("Unexpected error walking tree: ", err)
+		}
+		if diff := cmp.Diff(expected, b.String()); diff != "" {
+			t.Errorf("Unexpected output with parallelism %d:\n%s", parallelism, diff)
+		}
+	}
+}
+
+func TestMacroPerRootSharedBasename(t *testing.T) {
+	fsys := fstest.MapFS{
+		"src/llvm/lib/CMakeLists.txt":  {Data: []byte("configure_file(llvm.in llvm.out)\n")},
+		"src/clang/lib/CMakeLists.txt": {Data: []byte("configure_file(clang.in clang.out)\n")},
+	}
+	var b strings.Builder
+	e := NewEvaluator(writer.NewStarlarkWriter(&b), FileSystem(fsys), MacroPerRoot(true), PrintCommands(Matching("^configure_file$")))
+	if err := e.walk(bzlpath.ToPaths([]string{"src/llvm/lib", "src/clang/lib"})); err != nil {
+		t.Fatal("Unexpected error walking tree: ", err)
+	}
+	expected := "def llvm_lib(ctx):\n" +
+		"    ctx = ctx.push_directory(ctx, \"llvm/lib\")\n" +
+		"    ctx.configure_file(ctx, \"llvm.in\", \"llvm.out\")\n" +
+		"    ctx = ctx.pop_directory(ctx)\n" +
+		"    return ctx\n" +
+		"def clang_lib(ctx):\n" +
+		"    ctx = ctx.push_directory(ctx, \"clang/lib\")\n" +
+		"    ctx.configure_file(ctx, \"clang.in\", \"clang.out\")\n" +
+		"    ctx = ctx.pop_directory(ctx)\n" +
+		"    return ctx\n"
+	if diff := cmp.Diff(expected, b.String()); diff != "" {
+		t.Errorf("Unexpected output:\n%s", diff)
+	}
+
+	// Distinct paths which are indistinguishable as identifiers are rejected.
+	fsys["src/llvm-lib/CMakeLists.txt"] = &fstest.MapFile{Data: []byte("")}
+	e = NewEvaluator(writer.NewStarlarkWriter(ioutil.Discard), FileSystem(fsys), MacroPerRoot(true))
+	if err := e.walk(bzlpath.ToPaths([]string{"src/llvm/lib", "src/llvm-lib"})); err == nil {
+		t.Error("Expected error from conflicting macro names")
+	}
+}
+
+func TestParseCache(t *testing.T) {
+	fsys := fstest.MapFS{
+		"llvm/CMakeLists.txt":     {Data: []byte("set(NAME Support)\nadd_subdirectory(lib)\n")},
+		"llvm/lib/CMakeLists.txt": {Data: []byte("add_llvm_library(LLVM${NAME} a.cpp)\n")},
+	}
+	cache := NewParseCache()
+	walk := func() string {
+		var b strings.Builder
+		e := NewEvaluator(writer.NewStarlarkWriter(&b), FileSystem(fsys), CacheParses(cache), PrintCommands(Matching("^add_llvm_library$")))
+		if err := e.walk(bzlpath.ToPaths([]string{"llvm"})); err != nil {
+			t.Fatal("Unexpected error walking tree: ", err)
+		}
+		return b.String()
+	}
+	first := walk()
+	if parses := cache.Parses(); parses != 2 {
+		t.Errorf("Expected 2 parses after the first walk, found %d", parses)
+	}
+	if second := walk(); second != first {
+		t.Errorf("Unexpected output from cached walk:\n%s", cmp.Diff(first, second))
+	}
+	if parses := cache.Parses(); parses != 2 {
+		t.Errorf("Expected cached parses to be reused, found %d parses", parses)
+	}
+
+	// Changing an ancestor only re-parses that file, but the unchanged file is re-evaluated.
+	fsys["llvm/CMakeLists.txt"] = &fstest.MapFile{Data: []byte("set(NAME Core)\nadd_subdirectory(lib)\n")}
+	output := walk()
+	if parses := cache.Parses(); parses != 3 {
+		t.Errorf("Expected 3 parses after changing a file, found %d", parses)
+	}
+	if !strings.Contains(output, `"LLVMCore"`) {
+		t.Errorf("Expected output to reflect the changed variable:\n%s", output)
+	}
+}
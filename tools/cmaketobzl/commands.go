@@ -0,0 +1,69 @@
+/*
+ * Copyright 2019 The Kythe Authors. All rights reserved.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *   http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"os"
+	"regexp"
+	"strings"
+)
+
+// ReadCommands reads a newline-delimited list of command names or patterns from r and
+// returns a predicate matching any of them in full, suitable for PrintCommands or RecurseCommands.
+// Text following a '#' is treated as a comment and blank lines are ignored.
+func ReadCommands(r io.Reader) (func(string) bool, error) {
+	var pats []string
+	s := bufio.NewScanner(r)
+	for line := 1; s.Scan(); line++ {
+		text := s.Text()
+		if i := strings.IndexByte(text, '#'); i >= 0 {
+			text = text[:i]
+		}
+		text = strings.TrimSpace(text)
+		if text == "" {
+			continue
+		}
+		if _, err := regexp.Compile(text); err != nil {
+			return nil, fmt.Errorf("line %d: %v", line, err)
+		}
+		pats = append(pats, "(?:"+text+")")
+	}
+	if err := s.Err(); err != nil {
+		return nil, err
+	}
+	if len(pats) == 0 {
+		return func(string) bool { return false }, nil
+	}
+	return Matching("^(?:" + strings.Join(pats, "|") + ")$"), nil
+}
+
+// LoadCommands reads the command predicate from the named file as ReadCommands does.
+func LoadCommands(path string) (func(string) bool, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	p, err := ReadCommands(f)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %v", path, err)
+	}
+	return p, nil
+}
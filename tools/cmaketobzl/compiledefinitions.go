@@ -0,0 +1,98 @@
+/*
+ * Copyright 2019 The Kythe Authors. All rights reserved.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *   http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package main
+
+import (
+	"path"
+	"strings"
+)
+
+// definitionsProperty is the directory property which accumulates preprocessor definitions.
+const definitionsProperty = "COMPILE_DEFINITIONS"
+
+// addDefinitions evaluates the arguments as https://cmake.org/cmake/help/latest/command/add_definitions.html
+// recording the -D or /D flags, without the prefix, in the COMPILE_DEFINITIONS property of the current directory.
+// Other flags are compile options rather than definitions, so are ignored.
+func (e *eval) addDefinitions(args []string) {
+	var defs []string
+	for _, arg := range args {
+		if def, ok := trimDefineFlag(arg); ok {
+			defs = append(defs, def)
+		}
+	}
+	e.appendDefinitions(defs)
+}
+
+// addCompileDefinitions evaluates the arguments as https://cmake.org/cmake/help/latest/command/add_compile_definitions.html
+// recording them in the COMPILE_DEFINITIONS property of the current directory.
+func (e *eval) addCompileDefinitions(args []string) {
+	var defs []string
+	for _, arg := range args {
+		if def, _ := trimDefineFlag(arg); def != "" {
+			defs = append(defs, def)
+		}
+	}
+	e.appendDefinitions(defs)
+}
+
+// trimDefineFlag returns arg without a leading -D or /D and whether one was present.
+func trimDefineFlag(arg string) (string, bool) {
+	for _, prefix := range []string{"-D", "/D"} {
+		if strings.HasPrefix(arg, prefix) {
+			return arg[len(prefix):], true
+		}
+	}
+	return arg, false
+}
+
+// appendDefinitions adds defs to the COMPILE_DEFINITIONS property of the current directory.
+func (e *eval) appendDefinitions(defs []string) {
+	if len(defs) == 0 {
+		return
+	}
+	key := propertyKey{"DIRECTORY", path.Join(e.ProjectRoot(), e.CurrentDirectory()), definitionsProperty}
+	if value := e.props[key]; value != "" {
+		defs = append([]string{value}, defs...)
+	}
+	e.props[key] = strings.Join(defs, ";")
+}
+
+// inheritDefinitions initializes the compile definitions of the current directory from those of its parent.
+func (e *eval) inheritDefinitions(parent string) {
+	value, ok := e.props[propertyKey{"DIRECTORY", parent, definitionsProperty}]
+	if ok {
+		e.props[propertyKey{"DIRECTORY", path.Join(e.ProjectRoot(), e.CurrentDirectory()), definitionsProperty}] = value
+	}
+}
+
+// CompileDefinitions returns the preprocessor definitions, without a -D prefix, of the project-relative directory dir.
+func (e *eval) CompileDefinitions(dir string) []string {
+	if value := e.props[propertyKey{"DIRECTORY", path.Join(e.ProjectRoot(), dir), definitionsProperty}]; value != "" {
+		return strings.Split(value, ";")
+	}
+	return nil
+}
+
+// mergeDefinitions copies the compile definitions recorded by a concurrently evaluated child into e.
+// Only the directories of the child's subtree may have changed, and those are not yet known to e.
+func (e *eval) mergeDefinitions(child *eval) {
+	for key, value := range child.props {
+		if _, ok := e.props[key]; !ok && key.name == definitionsProperty {
+			e.props[key] = value
+		}
+	}
+}
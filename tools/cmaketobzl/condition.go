@@ -0,0 +1,287 @@
+/*
+ * Copyright 2019 The Kythe Authors. All rights reserved.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *   http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package main
+
+import (
+	"errors"
+	"fmt"
+	"io/fs"
+	"path"
+	"path/filepath"
+	"regexp"
+	"strconv"
+	"strings"
+)
+
+var (
+	trueConstant  = regexp.MustCompile(`^(?i:1|ON|YES|TRUE|Y)$`)
+	falseConstant = regexp.MustCompile(`^(?i:0|OFF|NO|FALSE|N|IGNORE|NOTFOUND|.*-NOTFOUND)?$`)
+	compareOps    = map[string]bool{
+		"LESS": true, "GREATER": true, "EQUAL": true, "LESS_EQUAL": true, "GREATER_EQUAL": true,
+		"STRLESS": true, "STRGREATER": true, "STREQUAL": true, "STRLESS_EQUAL": true, "STRGREATER_EQUAL": true,
+		"VERSION_LESS": true, "VERSION_GREATER": true, "VERSION_EQUAL": true, "VERSION_LESS_EQUAL": true, "VERSION_GREATER_EQUAL": true,
+	}
+)
+
+// conditionParser is a recursive-descent evaluator for the condition syntax shared by if() and while().
+// See https://cmake.org/cmake/help/latest/command/if.html#condition-syntax
+type conditionParser struct {
+	e    *eval
+	args []string
+}
+
+// evalCondition evaluates the provided arguments as a CMake condition.
+func (e *eval) evalCondition(args []string) (bool, error) {
+	p := &conditionParser{e, args}
+	result, err := p.parseOr()
+	if err != nil {
+		return false, err
+	}
+	if len(p.args) > 0 {
+		return false, fmt.Errorf("unexpected argument %q in condition", p.args[0])
+	}
+	return result, nil
+}
+
+// peek returns the next argument without consuming it, or the empty string if there are none.
+func (p *conditionParser) peek() string {
+	if len(p.args) == 0 {
+		return ""
+	}
+	return p.args[0]
+}
+
+// next consumes and returns the next argument.
+func (p *conditionParser) next() (string, error) {
+	if len(p.args) == 0 {
+		return "", errors.New("unexpected end of condition")
+	}
+	arg := p.args[0]
+	p.args = p.args[1:]
+	return arg, nil
+}
+
+// accept consumes the next argument and returns true if it is equal to keyword.
+func (p *conditionParser) accept(keyword string) bool {
+	if len(p.args) > 0 && p.args[0] == keyword {
+		p.args = p.args[1:]
+		return true
+	}
+	return false
+}
+
+func (p *conditionParser) parseOr() (bool, error) {
+	lhs, err := p.parseAnd()
+	for err == nil && p.accept("OR") {
+		var rhs bool
+		rhs, err = p.parseAnd()
+		lhs = lhs || rhs
+	}
+	return lhs, err
+}
+
+func (p *conditionParser) parseAnd() (bool, error) {
+	lhs, err := p.parseNot()
+	for err == nil && p.accept("AND") {
+		var rhs bool
+		rhs, err = p.parseNot()
+		lhs = lhs && rhs
+	}
+	return lhs, err
+}
+
+func (p *conditionParser) parseNot() (bool, error) {
+	if p.accept("NOT") {
+		value, err := p.parseNot()
+		return !value, err
+	}
+	return p.parsePredicate()
+}
+
+func (p *conditionParser) parsePredicate() (bool, error) {
+	if p.accept("(") {
+		value, err := p.parseOr()
+		if err != nil {
+			return false, err
+		}
+		if !p.accept(")") {
+			return false, errors.New("missing ) in condition")
+		}
+		return value, nil
+	}
+	if p.accept("DEFINED") {
+		name, err := p.next()
+		if env := strings.TrimPrefix(name, "ENV{"); env != name && strings.HasSuffix(env, "}") {
+			_, ok := p.e.v.LookupEnv(strings.TrimSuffix(env, "}"))
+			return ok, err
+		}
+		return p.e.v.IsSet(name), err
+	}
+	if p.accept("EXISTS") {
+		name, err := p.next()
+		_, statErr := fs.Stat(p.e.o.fsys, p.e.fsPath(name))
+		return statErr == nil, err
+	}
+	if p.accept("IS_DIRECTORY") {
+		name, err := p.next()
+		info, statErr := fs.Stat(p.e.o.fsys, p.e.fsPath(name))
+		return statErr == nil && info.IsDir(), err
+	}
+	lhs, err := p.next()
+	if err != nil {
+		return false, err
+	}
+	switch op := p.peek(); {
+	case compareOps[op]:
+		p.next()
+		rhs, err := p.next()
+		if err != nil {
+			return false, err
+		}
+		return compare(op, p.value(lhs), p.value(rhs))
+	case op == "MATCHES":
+		p.next()
+		pattern, err := p.next()
+		if err != nil {
+			return false, err
+		}
+		return p.matches(p.value(lhs), pattern)
+	case op == "IN_LIST":
+		p.next()
+		list, err := p.next()
+		if err != nil {
+			return false, err
+		}
+		for _, v := range strings.Split(p.e.v.Get(list), ";") {
+			if v == p.value(lhs) {
+				return true, nil
+			}
+		}
+		return false, nil
+	}
+	return p.truthy(lhs), nil
+}
+
+// fsPath returns the path within the configured filesystem corresponding to the path p,
+// which may be rooted at the ProjectRoot or relative to the current source directory.
+func (e *eval) fsPath(p string) string {
+	root := filepath.ToSlash(e.root.String())
+	switch {
+	case p == e.ProjectRoot():
+		return root
+	case strings.HasPrefix(p, e.ProjectRoot()+"/"):
+		return path.Join(root, strings.TrimPrefix(p, e.ProjectRoot()+"/"))
+	case path.IsAbs(p):
+		return p
+	}
+	return path.Join(root, e.CurrentDirectory(), p)
+}
+
+// value returns the value of the named variable, if defined, or arg itself otherwise.
+func (p *conditionParser) value(arg string) string {
+	if value := p.e.v.Get(arg); value != "" {
+		return value
+	}
+	return arg
+}
+
+// truthy returns the truth value of a lone constant or variable name.
+func (p *conditionParser) truthy(arg string) bool {
+	switch {
+	case trueConstant.MatchString(arg):
+		return true
+	case falseConstant.MatchString(arg):
+		return false
+	}
+	if f, err := strconv.ParseFloat(arg, 64); err == nil {
+		return f != 0
+	}
+	return !falseConstant.MatchString(p.e.v.Get(arg))
+}
+
+// matches returns true if value matches the regular expression pattern, setting CMAKE_MATCH_<n> accordingly.
+func (p *conditionParser) matches(value, pattern string) (bool, error) {
+	re, err := regexp.Compile(pattern)
+	if err != nil {
+		return false, err
+	}
+	groups := re.FindStringSubmatch(value)
+	for i, g := range groups {
+		p.e.v.Set("CMAKE_MATCH_"+strconv.Itoa(i), g)
+	}
+	return groups != nil, nil
+}
+
+// compare applies the named comparison operator to lhs and rhs.
+func compare(op, lhs, rhs string) (bool, error) {
+	var c int
+	switch {
+	case strings.HasPrefix(op, "STR"):
+		c, op = strings.Compare(lhs, rhs), op[len("STR"):]
+	case strings.HasPrefix(op, "VERSION_"):
+		c, op = compareVersions(lhs, rhs), op[len("VERSION_"):]
+	default:
+		l, err := strconv.ParseFloat(lhs, 64)
+		if err != nil {
+			return false, nil
+		}
+		r, err := strconv.ParseFloat(rhs, 64)
+		if err != nil {
+			return false, nil
+		}
+		switch {
+		case l < r:
+			c = -1
+		case l > r:
+			c = 1
+		}
+	}
+	switch op {
+	case "LESS":
+		return c < 0, nil
+	case "GREATER":
+		return c > 0, nil
+	case "EQUAL":
+		return c == 0, nil
+	case "LESS_EQUAL":
+		return c <= 0, nil
+	case "GREATER_EQUAL":
+		return c >= 0, nil
+	}
+	return false, fmt.Errorf("unknown comparison: %s", op)
+}
+
+// compareVersions compares two dot-delimited version strings component-wise.
+func compareVersions(lhs, rhs string) int {
+	l, r := strings.Split(lhs, "."), strings.Split(rhs, ".")
+	for i := 0; i < len(l) || i < len(r); i++ {
+		var a, b int
+		if i < len(l) {
+			a, _ = strconv.Atoi(l[i])
+		}
+		if i < len(r) {
+			b, _ = strconv.Atoi(r[i])
+		}
+		switch {
+		case a < b:
+			return -1
+		case a > b:
+			return 1
+		}
+	}
+	return 0
+}
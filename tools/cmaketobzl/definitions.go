@@ -0,0 +1,116 @@
+/*
+ * Copyright 2019 The Kythe Authors. All rights reserved.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *   http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package main
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+
+	"github.com/kythe/llvmbzlgen/cmakelib/ast"
+)
+
+// maxCallDepth is the maximum nesting of user-defined command invocations, matching
+// the default of https://cmake.org/cmake/help/latest/variable/CMAKE_MAXIMUM_RECURSION_DEPTH.html
+const maxCallDepth = 1000
+
+// commandDefinition is a user-defined command from a function() or macro() block.
+type commandDefinition struct {
+	kind   string // Either "function" or "macro".
+	params []string
+	body   commandList
+}
+
+// defineCommand records the function() or macro() block at the head of cmds for later invocation.
+// See https://cmake.org/cmake/help/latest/command/function.html
+// and https://cmake.org/cmake/help/latest/command/macro.html
+func (e *eval) defineCommand(cmds *commandList) (dispatchFunc, error) {
+	head := cmds.Head()
+	kind, args := strings.ToLower(head.Name), e.evalArgs(head)
+	body, err := blockBody(cmds)
+	if err != nil {
+		return nil, err
+	}
+	if len(args) == 0 {
+		e.warnf("Ignoring %s without a name at %s", kind, head.Pos)
+		return e.dispatch, nil
+	}
+	e.commands[strings.ToLower(args[0])] = &commandDefinition{kind, args[1:], body}
+	return e.dispatch, nil
+}
+
+// invokeCommand evaluates the body of the user-defined command with the arguments of cmd bound to its parameters,
+// along with ARGC, ARGV, ARGV<n> and ARGN.
+// Functions are evaluated in a new scope. Macros are evaluated in the scope of the caller, with
+// the arguments bound only for the duration of the body, which approximates their textual substitution;
+// break(), continue() and return() within a macro apply to the caller.
+func (e *eval) invokeCommand(cmd *ast.CommandInvocation, def *commandDefinition) error {
+	if e.callDepth >= maxCallDepth {
+		return fmt.Errorf("%s() at %s exceeded the maximum recursion depth of %d", cmd.Name, cmd.Pos, maxCallDepth)
+	}
+	args := e.evalArgs(cmd)
+	e.callDepth++
+	defer func() { e.callDepth-- }()
+
+	vars := map[string]string{
+		"ARGC": strconv.Itoa(len(args)),
+		"ARGV": strings.Join(args, ";"),
+		"ARGN": "",
+	}
+	for i, arg := range args {
+		vars["ARGV"+strconv.Itoa(i)] = arg
+	}
+	for i, param := range def.params {
+		vars[param] = ""
+		if i < len(args) {
+			vars[param] = args[i]
+		}
+	}
+	if len(args) > len(def.params) {
+		vars["ARGN"] = strings.Join(args[len(def.params):], ";")
+	}
+
+	if def.kind == "function" {
+		e.v.Push()
+		defer e.v.Pop()
+		for k, v := range vars {
+			e.v.Set(k, v)
+		}
+		// Functions are evaluated outside of any enclosing loop and return() exits only the function.
+		loopDepth := e.loopDepth
+		e.loopDepth = 0
+		defer func() { e.loopDepth, e.flow = loopDepth, flowNormal }()
+		return e.evalCommands(def.body)
+	}
+	saved := make(map[string]string, len(vars))
+	for k, v := range vars {
+		if e.v.IsSet(k) {
+			saved[k] = e.v.Get(k)
+		}
+		e.v.Set(k, v)
+	}
+	defer func() {
+		for k := range vars {
+			if v, ok := saved[k]; ok {
+				e.v.Set(k, v)
+			} else {
+				e.v.Unset(k)
+			}
+		}
+	}()
+	return e.evalCommands(def.body)
+}
@@ -0,0 +1,139 @@
+/*
+ * Copyright 2019 The Kythe Authors. All rights reserved.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *   http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package main
+
+import (
+	"io/fs"
+	"path"
+	"path/filepath"
+	"sort"
+	"strings"
+)
+
+// fileCommand evaluates the arguments as https://cmake.org/cmake/help/latest/command/file.html
+// Only the GLOB and GLOB_RECURSE subcommands are supported, matching against the configured filesystem;
+// the remainder only affect the build tree, so are ignored.
+func (e *eval) fileCommand(args []string) {
+	if len(args) == 0 {
+		return
+	}
+	switch args[0] {
+	case "GLOB", "GLOB_RECURSE":
+		e.fileGlob(args[0] == "GLOB_RECURSE", args[1:])
+	}
+}
+
+// fileGlob sets the variable named by the first argument to the sorted list of paths matching the
+// remaining glob expressions, relative to the current source directory.
+func (e *eval) fileGlob(recurse bool, args []string) {
+	if len(args) == 0 {
+		e.warnf("Ignoring file(GLOB) without a variable")
+		return
+	}
+	out, args := args[0], args[1:]
+	listDirs, relative := !recurse, ""
+	var patterns []string
+	for i := 0; i < len(args); i++ {
+		switch {
+		case args[i] == "LIST_DIRECTORIES" && i+1 < len(args):
+			i++
+			listDirs = !falseConstant.MatchString(args[i])
+		case args[i] == "RELATIVE" && i+1 < len(args):
+			i++
+			relative = args[i]
+		case args[i] == "CONFIGURE_DEPENDS", args[i] == "FOLLOW_SYMLINKS":
+		default:
+			patterns = append(patterns, args[i])
+		}
+	}
+	var matches []string
+	for _, pattern := range patterns {
+		found, err := e.glob(e.fsPath(pattern), recurse, listDirs)
+		if err != nil {
+			e.warnf("Ignoring file(GLOB) pattern %q: %v", pattern, err)
+			continue
+		}
+		for _, p := range found {
+			p = e.projectPath(p)
+			if relative != "" {
+				if rel, err := filepath.Rel(relative, p); err == nil {
+					p = filepath.ToSlash(rel)
+				}
+			}
+			if !contains(matches, p) {
+				matches = append(matches, p)
+			}
+		}
+	}
+	sort.Strings(matches)
+	e.v.Set(out, strings.Join(matches, ";"))
+}
+
+// glob returns the paths within the configured filesystem matching pattern.
+// If recurse is true, the final element of pattern is matched against files in every subdirectory
+// of the directories matching the remainder. Directories are only included if listDirs is true.
+func (e *eval) glob(pattern string, recurse, listDirs bool) ([]string, error) {
+	if !recurse {
+		found, err := fs.Glob(e.o.fsys, pattern)
+		if err != nil || listDirs {
+			return found, err
+		}
+		var files []string
+		for _, p := range found {
+			if info, err := fs.Stat(e.o.fsys, p); err == nil && !info.IsDir() {
+				files = append(files, p)
+			}
+		}
+		return files, nil
+	}
+	dir, base := path.Split(pattern)
+	if _, err := path.Match(base, ""); err != nil {
+		return nil, err
+	}
+	dirs, err := fs.Glob(e.o.fsys, path.Clean(dir))
+	if err != nil {
+		return nil, err
+	}
+	var found []string
+	for _, dir := range dirs {
+		fs.WalkDir(e.o.fsys, dir, func(p string, d fs.DirEntry, err error) error {
+			if err != nil || p == dir || (d.IsDir() && !listDirs) {
+				return nil
+			}
+			if ok, _ := path.Match(base, d.Name()); ok {
+				found = append(found, p)
+			}
+			return nil
+		})
+	}
+	return found, nil
+}
+
+// projectPath returns the path rooted at the ProjectRoot corresponding to the path p within the
+// configured filesystem, which is the inverse of fsPath.
+func (e *eval) projectPath(p string) string {
+	root := filepath.ToSlash(e.root.String())
+	switch {
+	case p == root:
+		return e.ProjectRoot()
+	case root == "." && !path.IsAbs(p):
+		return path.Join(e.ProjectRoot(), p)
+	case strings.HasPrefix(p, root+"/"):
+		return path.Join(e.ProjectRoot(), strings.TrimPrefix(p, root+"/"))
+	}
+	return p
+}
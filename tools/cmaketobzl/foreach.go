@@ -0,0 +1,207 @@
+/*
+ * Copyright 2019 The Kythe Authors. All rights reserved.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *   http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package main
+
+import (
+	"strconv"
+	"strings"
+
+	"github.com/kythe/llvmbzlgen/cmakelib/ast"
+	"github.com/kythe/llvmbzlgen/writer"
+)
+
+// foreachCommand prints the foreach() block at the head of cmds as a list comprehension, if possible and enabled,
+// or otherwise evaluates its body for each item if so configured.
+// Blocks which are neither printed nor evaluated are skipped, as they are when both are disabled.
+// See https://cmake.org/cmake/help/latest/command/foreach.html
+func (e *eval) foreachCommand(cmds *commandList) (dispatchFunc, error) {
+	head := cmds.Head()
+	body, err := blockBody(cmds)
+	if err != nil {
+		return nil, err
+	}
+	args := e.evalArgs(head)
+	if len(args) == 0 {
+		return e.dispatch, nil
+	}
+	items, ok := e.foreachItems(args[1:])
+	if !ok {
+		return e.dispatch, nil
+	}
+	if e.o.comprehend && len(body) == 1 && len(items) > 0 {
+		if printed, err := e.printComprehension(args[0], items, &body[0]); printed || err != nil {
+			return e.dispatch, err
+		}
+	}
+	if e.o.evalForeach {
+		return e.dispatch, e.foreachLoop(args[0], items, body)
+	}
+	return e.dispatch, nil
+}
+
+// printComprehension writes the loop over items as a list comprehension, if possible,
+// and returns whether it was written.
+func (e *eval) printComprehension(loopVar string, items []string, cmd *ast.CommandInvocation) (bool, error) {
+	name, fixed, values, ok := e.comprehension(loopVar, items, cmd)
+	if !ok {
+		return false, nil
+	}
+	varName, err := writer.IdentName(strings.ToLower(loopVar))
+	if err != nil {
+		return false, nil
+	}
+	if err := e.annotate(); err != nil {
+		return false, err
+	}
+	e.last = nil
+	e.stats.CommandsEmitted++
+	return true, writeComprehension(e.w, name, varName, values, fixed...)
+}
+
+// foreachLoop evaluates body with loopVar bound to each of the items in turn.
+func (e *eval) foreachLoop(loopVar string, items []string, body commandList) error {
+	defer e.bindLoopVar(loopVar)()
+	for _, item := range items {
+		e.v.Set(loopVar, item)
+		if done, err := e.evalLoopBody(body); err != nil || done {
+			return err
+		}
+	}
+	return nil
+}
+
+// bindLoopVar returns a function which restores the loop variable to its value prior to the loop.
+func (e *eval) bindLoopVar(loopVar string) func() {
+	saved, wasSet := e.v.Get(loopVar), e.v.IsSet(loopVar)
+	return func() {
+		if wasSet {
+			e.v.Set(loopVar, saved)
+		} else {
+			e.v.Unset(loopVar)
+		}
+	}
+}
+
+// foreachItems returns the items iterated over by a foreach() loop with the provided arguments,
+// following the loop variable, or false if the form is unsupported.
+func (e *eval) foreachItems(args []string) ([]string, bool) {
+	if len(args) == 0 {
+		return nil, false
+	}
+	if args[0] == "RANGE" {
+		return foreachRange(args[1:])
+	}
+	if args[0] != "IN" {
+		return args, true
+	}
+	sections := ast.ParseKeywordArgs(args[1:], []string{"LISTS", "ITEMS", "ZIP_LISTS"})
+	if _, ok := sections[""]; ok {
+		return nil, false
+	}
+	if _, ok := sections["ZIP_LISTS"]; ok {
+		return nil, false
+	}
+	var items []string
+	for _, list := range sections["LISTS"] {
+		for _, item := range strings.Split(e.v.Get(list), ";") {
+			if item != "" {
+				items = append(items, item)
+			}
+		}
+	}
+	return append(items, sections["ITEMS"]...), true
+}
+
+// foreachRange returns the items of a foreach(RANGE) loop with the provided bounds, or false if they are invalid.
+func foreachRange(args []string) ([]string, bool) {
+	var bounds []int
+	for _, arg := range args {
+		n, err := strconv.Atoi(arg)
+		if err != nil || n < 0 {
+			return nil, false
+		}
+		bounds = append(bounds, n)
+	}
+	start, stop, step := 0, 0, 1
+	switch len(bounds) {
+	case 1:
+		stop = bounds[0]
+	case 3:
+		step = bounds[2]
+		fallthrough
+	case 2:
+		start, stop = bounds[0], bounds[1]
+	default:
+		return nil, false
+	}
+	if stop < start || step == 0 {
+		return nil, false
+	}
+	var items []string
+	for i := start; i <= stop; i += step {
+		items = append(items, strconv.Itoa(i))
+	}
+	return items, true
+}
+
+// comprehension evaluates cmd with the loop variable bound to each of the items and returns the
+// printed command name, the arguments common to each evaluation and the varying final argument.
+// Returns false if the command would not be printed for every item or differs other than in its final argument.
+func (e *eval) comprehension(loopVar string, items []string, cmd *ast.CommandInvocation) (string, []string, []string, bool) {
+	cmdName := strings.ToLower(cmd.Name)
+	if _, ok := e.commands[cmdName]; ok || cmdName == "set" {
+		return "", nil, nil, false
+	}
+	defer e.bindLoopVar(loopVar)()
+	var name string
+	var fixed, values []string
+	for i, item := range items {
+		e.v.Set(loopVar, item)
+		if !e.shouldPrintCommand(cmdName, cmd) {
+			return "", nil, nil, false
+		}
+		printed, args, ok := cmdName, e.evalArgs(cmd), true
+		if e.o.rewrite != nil {
+			if printed, args, ok = e.o.rewrite(cmdName, args); !ok {
+				return "", nil, nil, false
+			}
+		}
+		if len(args) == 0 {
+			return "", nil, nil, false
+		}
+		if i == 0 {
+			name, fixed = printed, args[:len(args)-1]
+		} else if printed != name || !equalStrings(fixed, args[:len(args)-1]) {
+			return "", nil, nil, false
+		}
+		values = append(values, args[len(args)-1])
+	}
+	return name, fixed, values, true
+}
+
+// equalStrings returns true if a and b contain the same strings in the same order.
+func equalStrings(a, b []string) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for i := range a {
+		if a[i] != b[i] {
+			return false
+		}
+	}
+	return true
+}
@@ -0,0 +1,152 @@
+/*
+ * Copyright 2019 The Kythe Authors. All rights reserved.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *   http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package main
+
+import (
+	"path"
+	"strings"
+)
+
+// includeProperty is the directory and target property which accumulates include directories.
+const includeProperty = "INCLUDE_DIRECTORIES"
+
+// interfaceIncludeProperty is the target property which accumulates include directories for dependents.
+const interfaceIncludeProperty = "INTERFACE_INCLUDE_DIRECTORIES"
+
+// includeDirectories evaluates the arguments as https://cmake.org/cmake/help/latest/command/include_directories.html
+// recording the normalized paths in the INCLUDE_DIRECTORIES property of the current directory.
+func (e *eval) includeDirectories(args []string) {
+	before := false
+	for len(args) > 0 && (args[0] == "AFTER" || args[0] == "BEFORE" || args[0] == "SYSTEM") {
+		before = before || args[0] == "BEFORE"
+		args = args[1:]
+	}
+	dir := path.Join(e.ProjectRoot(), e.CurrentDirectory())
+	e.appendIncludes(propertyKey{"DIRECTORY", dir, includeProperty}, args, before)
+}
+
+// targetIncludeDirectories evaluates the arguments as https://cmake.org/cmake/help/latest/command/target_include_directories.html
+// recording the normalized paths in the INCLUDE_DIRECTORIES and INTERFACE_INCLUDE_DIRECTORIES properties of the target.
+func (e *eval) targetIncludeDirectories(args []string) {
+	if len(args) < 2 {
+		e.warnf("Ignoring target_include_directories without a target and scope")
+		return
+	}
+	target, args := args[0], args[1:]
+	before, scope := false, ""
+	var private, iface []string
+	for _, arg := range args {
+		switch arg {
+		case "SYSTEM", "AFTER":
+		case "BEFORE":
+			before = true
+		case "PUBLIC", "PRIVATE", "INTERFACE":
+			scope = arg
+		default:
+			if scope == "" {
+				e.warnf("Ignoring target_include_directories item %q without a scope", arg)
+				continue
+			}
+			if scope != "INTERFACE" {
+				private = append(private, arg)
+			}
+			if scope != "PRIVATE" {
+				iface = append(iface, arg)
+			}
+		}
+	}
+	e.appendIncludes(propertyKey{"TARGET", target, includeProperty}, private, before)
+	e.appendIncludes(propertyKey{"TARGET", target, interfaceIncludeProperty}, iface, before)
+}
+
+// appendIncludes adds the include paths, resolved relative to the current source directory,
+// to the property given by key, omitting any which are already present.
+func (e *eval) appendIncludes(key propertyKey, paths []string, before bool) {
+	if len(paths) == 0 {
+		return
+	}
+	var existing []string
+	if value := e.props[key]; value != "" {
+		existing = strings.Split(value, ";")
+	}
+	var added []string
+	for _, p := range paths {
+		if p == "" {
+			continue
+		}
+		if !path.IsAbs(p) {
+			p = path.Join(e.ProjectRoot(), e.CurrentDirectory(), p)
+		}
+		if p = path.Clean(p); !contains(existing, p) && !contains(added, p) {
+			added = append(added, p)
+		}
+	}
+	if before {
+		existing = append(added, existing...)
+	} else {
+		existing = append(existing, added...)
+	}
+	e.props[key] = strings.Join(existing, ";")
+}
+
+// inheritIncludes initializes the include directories of the current directory from those of its parent.
+func (e *eval) inheritIncludes(parent string) {
+	value, ok := e.props[propertyKey{"DIRECTORY", parent, includeProperty}]
+	if ok {
+		e.props[propertyKey{"DIRECTORY", path.Join(e.ProjectRoot(), e.CurrentDirectory()), includeProperty}] = value
+	}
+}
+
+// IncludeDirectories returns the normalized include directories of the project-relative directory dir.
+func (e *eval) IncludeDirectories(dir string) []string {
+	return e.includes(propertyKey{"DIRECTORY", path.Join(e.ProjectRoot(), dir), includeProperty})
+}
+
+// TargetIncludeDirectories returns the normalized include directories of the named target,
+// followed by those only provided to its dependents.
+func (e *eval) TargetIncludeDirectories(target string) []string {
+	includes := e.includes(propertyKey{"TARGET", target, includeProperty})
+	for _, p := range e.includes(propertyKey{"TARGET", target, interfaceIncludeProperty}) {
+		if !contains(includes, p) {
+			includes = append(includes, p)
+		}
+	}
+	return includes
+}
+
+func (e *eval) includes(key propertyKey) []string {
+	if value := e.props[key]; value != "" {
+		return strings.Split(value, ";")
+	}
+	return nil
+}
+
+// mergeIncludes copies the include directories recorded by a concurrently evaluated child into e.
+func (e *eval) mergeIncludes(child *eval) {
+	for key, value := range child.props {
+		if key.name != includeProperty && key.name != interfaceIncludeProperty {
+			continue
+		}
+		includes := e.includes(key)
+		for _, p := range strings.Split(value, ";") {
+			if !contains(includes, p) {
+				includes = append(includes, p)
+			}
+		}
+		e.props[key] = strings.Join(includes, ";")
+	}
+}
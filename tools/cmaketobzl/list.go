@@ -0,0 +1,98 @@
+/*
+ * Copyright 2019 The Kythe Authors. All rights reserved.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *   http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package main
+
+import (
+	"sort"
+	"strings"
+)
+
+// listCommand evaluates the arguments as https://cmake.org/cmake/help/latest/command/list.html
+// Only the SORT, REVERSE and REMOVE_DUPLICATES subcommands are supported.
+func (e *eval) listCommand(args []string) {
+	if len(args) < 2 {
+		e.warnf("Ignoring list without a subcommand and a variable")
+		return
+	}
+	op, name := args[0], args[1]
+	switch op {
+	case "SORT":
+		less, ok := e.listSortOrder(args[2:])
+		if !ok {
+			return
+		}
+		elems := e.v.GetList(name)
+		sort.SliceStable(elems, func(i, j int) bool { return less(elems[i], elems[j]) })
+		e.setListIfSet(name, elems)
+	case "REVERSE":
+		elems := e.v.GetList(name)
+		for i, j := 0, len(elems)-1; i < j; i, j = i+1, j-1 {
+			elems[i], elems[j] = elems[j], elems[i]
+		}
+		e.setListIfSet(name, elems)
+	case "REMOVE_DUPLICATES":
+		var unique []string
+		seen := make(map[string]bool)
+		for _, elem := range e.v.GetList(name) {
+			if !seen[elem] {
+				seen[elem] = true
+				unique = append(unique, elem)
+			}
+		}
+		e.setListIfSet(name, unique)
+	default:
+		e.warnf("Ignoring unsupported list(%s)", op)
+	}
+}
+
+// listSortOrder returns the comparison selected by the COMPARE, CASE and ORDER options to list(SORT).
+// The default is a case-sensitive, ascending string comparison.
+func (e *eval) listSortOrder(opts []string) (func(a, b string) bool, bool) {
+	fold, descending := false, false
+	for ; len(opts) >= 2; opts = opts[2:] {
+		switch kw, val := opts[0], opts[1]; {
+		case kw == "COMPARE" && val == "STRING":
+		case kw == "CASE" && (val == "SENSITIVE" || val == "INSENSITIVE"):
+			fold = val == "INSENSITIVE"
+		case kw == "ORDER" && (val == "ASCENDING" || val == "DESCENDING"):
+			descending = val == "DESCENDING"
+		default:
+			e.warnf("Ignoring list(SORT) with unsupported option %s %s", kw, val)
+			return nil, false
+		}
+	}
+	if len(opts) > 0 {
+		e.warnf("Ignoring list(SORT) with unsupported option %s", opts[0])
+		return nil, false
+	}
+	return func(a, b string) bool {
+		if fold {
+			a, b = strings.ToLower(a), strings.ToLower(b)
+		}
+		if descending {
+			return b < a
+		}
+		return a < b
+	}, true
+}
+
+// setListIfSet updates the named variable to elems, if it is set, as list() leaves undefined variables undefined.
+func (e *eval) setListIfSet(name string, elems []string) {
+	if e.v.IsSet(name) {
+		e.v.SetList(name, elems)
+	}
+}
@@ -0,0 +1,63 @@
+/*
+ * Copyright 2019 The Kythe Authors. All rights reserved.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *   http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+
+	bzlpath "github.com/kythe/llvmbzlgen/path"
+)
+
+// ReadPaths reads a newline-delimited list of input paths from r, suitable for walk.
+// Lines beginning with '#' are treated as comments and blank lines are ignored;
+// otherwise surrounding whitespace is trimmed and the remaining text taken as the path.
+func ReadPaths(r io.Reader) ([]bzlpath.Path, error) {
+	var paths []string
+	s := bufio.NewScanner(r)
+	for s.Scan() {
+		text := strings.TrimSpace(s.Text())
+		if text == "" || strings.HasPrefix(text, "#") {
+			continue
+		}
+		paths = append(paths, text)
+	}
+	if err := s.Err(); err != nil {
+		return nil, err
+	}
+	return bzlpath.ToPaths(paths), nil
+}
+
+// LoadPaths reads the input paths from the named file, or from stdin if path is "-", as ReadPaths does.
+func LoadPaths(path string) ([]bzlpath.Path, error) {
+	if path == "-" {
+		return ReadPaths(os.Stdin)
+	}
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	paths, err := ReadPaths(f)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %v", path, err)
+	}
+	return paths, nil
+}
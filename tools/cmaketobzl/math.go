@@ -0,0 +1,176 @@
+/*
+ * Copyright 2019 The Kythe Authors. All rights reserved.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *   http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package main
+
+import (
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+// mathCommand evaluates the arguments as https://cmake.org/cmake/help/latest/command/math.html
+// storing the result of the 64-bit integer expression in the named variable.
+func (e *eval) mathCommand(args []string) {
+	if len(args) < 3 || args[0] != "EXPR" {
+		e.warnf("Ignoring math without EXPR, a variable and an expression")
+		return
+	}
+	hex := false
+	if opts := args[3:]; len(opts) > 0 {
+		if len(opts) != 2 || opts[0] != "OUTPUT_FORMAT" || (opts[1] != "DECIMAL" && opts[1] != "HEXADECIMAL") {
+			e.warnf("Ignoring math with unsupported options %q", opts)
+			return
+		}
+		hex = opts[1] == "HEXADECIMAL"
+	}
+	value, err := evalMathExpr(args[2])
+	if err != nil {
+		e.warnf("Ignoring math(EXPR %s %q): %v", args[1], args[2], err)
+		return
+	}
+	if hex {
+		e.v.Set(args[1], fmt.Sprintf("0x%x", uint64(value)))
+	} else {
+		e.v.Set(args[1], strconv.FormatInt(value, 10))
+	}
+}
+
+// mathBinaryOps lists the binary operators accepted by math(EXPR), from lowest to highest precedence,
+// which follows that of C.
+var mathBinaryOps = [][]string{{"|"}, {"^"}, {"&"}, {"<<", ">>"}, {"+", "-"}, {"*", "/", "%"}}
+
+// evalMathExpr returns the value of the integer expression expr.
+func evalMathExpr(expr string) (int64, error) {
+	p := &mathParser{src: expr}
+	value, err := p.binary(0)
+	if err != nil {
+		return 0, err
+	}
+	if p.skipSpace(); p.pos < len(p.src) {
+		return 0, fmt.Errorf("unexpected %q at offset %d", p.src[p.pos:], p.pos)
+	}
+	return value, nil
+}
+
+// mathParser is a recursive-descent evaluator for math(EXPR) expressions.
+type mathParser struct {
+	src string
+	pos int
+}
+
+func (p *mathParser) skipSpace() {
+	for p.pos < len(p.src) && strings.IndexByte(" \t\r\n", p.src[p.pos]) >= 0 {
+		p.pos++
+	}
+}
+
+// operator consumes and returns the first of ops found at the current position, if any.
+func (p *mathParser) operator(ops []string) (string, bool) {
+	p.skipSpace()
+	for _, op := range ops {
+		if strings.HasPrefix(p.src[p.pos:], op) {
+			p.pos += len(op)
+			return op, true
+		}
+	}
+	return "", false
+}
+
+// binary evaluates a sequence of operands joined by operators of at least the given precedence level.
+func (p *mathParser) binary(level int) (int64, error) {
+	if level == len(mathBinaryOps) {
+		return p.unary()
+	}
+	lhs, err := p.binary(level + 1)
+	if err != nil {
+		return 0, err
+	}
+	for {
+		op, ok := p.operator(mathBinaryOps[level])
+		if !ok {
+			return lhs, nil
+		}
+		rhs, err := p.binary(level + 1)
+		if err != nil {
+			return 0, err
+		}
+		switch op {
+		case "|":
+			lhs |= rhs
+		case "^":
+			lhs ^= rhs
+		case "&":
+			lhs &= rhs
+		case "<<":
+			lhs <<= uint64(rhs)
+		case ">>":
+			lhs >>= uint64(rhs)
+		case "+":
+			lhs += rhs
+		case "-":
+			lhs -= rhs
+		case "*":
+			lhs *= rhs
+		case "/", "%":
+			if rhs == 0 {
+				return 0, errors.New("division by zero")
+			}
+			if op == "/" {
+				lhs /= rhs
+			} else {
+				lhs %= rhs
+			}
+		}
+	}
+}
+
+// unary evaluates an operand with any leading unary operators.
+func (p *mathParser) unary() (int64, error) {
+	if op, ok := p.operator([]string{"+", "-", "~"}); ok {
+		value, err := p.unary()
+		switch op {
+		case "-":
+			value = -value
+		case "~":
+			value = ^value
+		}
+		return value, err
+	}
+	if _, ok := p.operator([]string{"("}); ok {
+		value, err := p.binary(0)
+		if err != nil {
+			return 0, err
+		}
+		if _, ok := p.operator([]string{")"}); !ok {
+			return 0, fmt.Errorf("missing ) at offset %d", p.pos)
+		}
+		return value, nil
+	}
+	start := p.pos
+	for p.pos < len(p.src) && isAlphanumeric(p.src[p.pos]) {
+		p.pos++
+	}
+	if start == p.pos {
+		return 0, fmt.Errorf("expected a number at offset %d", start)
+	}
+	return strconv.ParseInt(p.src[start:p.pos], 0, 64)
+}
+
+func isAlphanumeric(c byte) bool {
+	return '0' <= c && c <= '9' || 'a' <= c && c <= 'z' || 'A' <= c && c <= 'Z'
+}
@@ -0,0 +1,184 @@
+/*
+ * Copyright 2019 The Kythe Authors. All rights reserved.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *   http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package main
+
+import (
+	"errors"
+
+	bzlpath "github.com/kythe/llvmbzlgen/path"
+	"github.com/kythe/llvmbzlgen/writer"
+)
+
+// recorder is a writer.Writer which records calls for later replay against another writer.Writer.
+// Neither the StarlarkWriter nor bindings.Mapping are safe for concurrent use, so each concurrently
+// evaluated subtree writes to its own recorder which is replayed in source order once complete.
+type recorder struct {
+	events []func(writer.Writer) error
+	dirs   []string
+}
+
+// record appends the event to the list of those to replay.
+func (r *recorder) record(event func(writer.Writer) error) error {
+	r.events = append(r.events, event)
+	return nil
+}
+
+// log records a diagnostic to be reported to l on replay, so that diagnostics from concurrently
+// evaluated subtrees are reported from a single goroutine in source order.
+func (r *recorder) log(l Logger, level, msg string, args ...interface{}) {
+	r.record(func(writer.Writer) error {
+		l(level, msg, args...)
+		return nil
+	})
+}
+
+// replay invokes each of the recorded events against w, in order.
+func (r *recorder) replay(w writer.Writer) error {
+	for _, event := range r.events {
+		if err := event(w); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// BeginMacro implements writer.Writer for recorder.
+func (r *recorder) BeginMacro(name string) error {
+	return r.record(func(w writer.Writer) error { return w.BeginMacro(name) })
+}
+
+// EndMacro implements writer.Writer for recorder.
+func (r *recorder) EndMacro() error {
+	return r.record(func(w writer.Writer) error { return w.EndMacro() })
+}
+
+// PushDirectory implements writer.Writer for recorder.
+func (r *recorder) PushDirectory(path string) error {
+	r.dirs = append(r.dirs, path)
+	return r.record(func(w writer.Writer) error { return w.PushDirectory(path) })
+}
+
+// PopDirectory implements writer.Writer for recorder.
+func (r *recorder) PopDirectory() (string, error) {
+	if len(r.dirs) == 0 {
+		return "", errors.New("no current directory")
+	}
+	path := pop(&r.dirs)
+	return path, r.record(func(w writer.Writer) error {
+		_, err := w.PopDirectory()
+		return err
+	})
+}
+
+// WriteCommand implements writer.Writer for recorder.
+func (r *recorder) WriteCommand(cmd string, args ...interface{}) error {
+	return r.record(func(w writer.Writer) error { return w.WriteCommand(cmd, args...) })
+}
+
+// WriteCommandAt implements positionWriter for recorder.
+func (r *recorder) WriteCommandAt(pos writer.Position, cmd string, args ...interface{}) error {
+	return r.record(func(w writer.Writer) error { return writeCommandAt(w, pos, cmd, args...) })
+}
+
+// WriteAssignment implements assignmentWriter for recorder.
+func (r *recorder) WriteAssignment(name string, value interface{}) error {
+	return r.record(func(w writer.Writer) error { return writeAssignment(w, name, value) })
+}
+
+// WriteAssignmentAt implements positionAssignmentWriter for recorder.
+func (r *recorder) WriteAssignmentAt(pos writer.Position, name string, value interface{}) error {
+	return r.record(func(w writer.Writer) error { return writeAssignmentAt(w, pos, name, value) })
+}
+
+// WriteComprehension implements comprehensionWriter for recorder.
+func (r *recorder) WriteComprehension(cmd string, varName string, items []string, fixedArgs ...string) error {
+	return r.record(func(w writer.Writer) error { return writeComprehension(w, cmd, varName, items, fixedArgs...) })
+}
+
+// WriteComment implements commentWriter for recorder.
+func (r *recorder) WriteComment(text string) error {
+	return r.record(func(w writer.Writer) error { return writeComment(w, text) })
+}
+
+// walkParallel evaluates paths as walk does, but distributes subdirectories among the configured workers.
+func (e *eval) walkParallel(paths []bzlpath.Path) error {
+	out, rec := e.w, &recorder{}
+	e.w, e.workers = rec, make(chan struct{}, e.o.parallelism)
+	defer func() { e.w, e.workers = out, nil }()
+	if err := e.walk(paths); err != nil {
+		// Report the diagnostics recorded before the failure, discarding the output.
+		rec.replay(&recorder{})
+		return err
+	}
+	return rec.replay(out)
+}
+
+// addSubdirectory evaluates the subdirectory at dirpath, concurrently if so configured.
+func (e *eval) addSubdirectory(dirpath string) error {
+	e.last = nil
+	if e.workers == nil {
+		return e.AddSubdirectory(dirpath)
+	}
+	child := &eval{
+		p:       e.p,
+		o:       e.o,
+		w:       &recorder{},
+		v:       e.v.Clone(),
+		props:   make(map[propertyKey]string, len(e.props)),
+		root:    e.root,
+		path:    append(bzlpath.Path(nil), e.path...),
+		workers: e.workers,
+
+		requiredVersion: e.requiredVersion,
+		commands:        make(map[string]*commandDefinition, len(e.commands)),
+		callDepth:       e.callDepth,
+	}
+	for k, v := range e.commands {
+		child.commands[k] = v
+	}
+	for k, v := range e.props {
+		child.props[k] = v
+	}
+	done, workers := make(chan error, 1), e.workers
+	select {
+	case workers <- struct{}{}:
+		go func() {
+			defer func() { <-workers }()
+			done <- child.AddSubdirectory(dirpath)
+		}()
+	default:
+		// All of the workers are busy, so evaluate the subtree on this one.
+		done <- child.AddSubdirectory(dirpath)
+	}
+	return e.w.(*recorder).record(func(w writer.Writer) error {
+		if err := <-done; err != nil {
+			return err
+		}
+		if err := child.w.(*recorder).replay(w); err != nil {
+			return err
+		}
+		e.stats.add(child.stats)
+		e.mergeIncludes(child)
+		e.mergeDefinitions(child)
+		return nil
+	})
+}
+
+func pop(s *[]string) (x string) {
+	x, *s = (*s)[len(*s)-1], (*s)[:len(*s)-1]
+	return
+}
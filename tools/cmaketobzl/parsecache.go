@@ -0,0 +1,74 @@
+/*
+ * Copyright 2019 The Kythe Authors. All rights reserved.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *   http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package main
+
+import (
+	"crypto/sha256"
+	"sync"
+
+	"github.com/kythe/llvmbzlgen/cmakelib/ast"
+)
+
+// ParseCache retains parsed CMakeLists.txt files keyed by their path and a hash of their contents,
+// so that repeated walks do not re-parse unchanged files.
+// Only parsing is cached: files are re-evaluated on each walk, so changes to the variables
+// flowing into a directory from its ancestors are always reflected.
+// A ParseCache is safe for concurrent use and may be shared among evaluators.
+type ParseCache struct {
+	mu     sync.Mutex
+	files  map[parseKey]*ast.CMakeFile
+	parses int
+}
+
+// parseKey identifies the contents of a file at a particular path.
+// The path is included as it is recorded in the positions of the parsed file.
+type parseKey struct {
+	path string
+	hash [sha256.Size]byte
+}
+
+// NewParseCache returns a new, empty ParseCache.
+func NewParseCache() *ParseCache {
+	return &ParseCache{files: make(map[parseKey]*ast.CMakeFile)}
+}
+
+// Parses returns the number of files which have been parsed, rather than retrieved from the cache.
+func (c *ParseCache) Parses() int {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.parses
+}
+
+// parse returns the cached parse of data from path, invoking parse on a miss.
+func (c *ParseCache) parse(path string, data []byte, parse func() (*ast.CMakeFile, error)) (*ast.CMakeFile, error) {
+	key := parseKey{path, sha256.Sum256(data)}
+	c.mu.Lock()
+	file, ok := c.files[key]
+	c.mu.Unlock()
+	if ok {
+		return file, nil
+	}
+	file, err := parse()
+	if err != nil {
+		return nil, err
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.files[key] = file
+	c.parses++
+	return file, nil
+}
@@ -0,0 +1,133 @@
+/*
+ * Copyright 2019 The Kythe Authors. All rights reserved.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *   http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package main
+
+import (
+	"path"
+	"strings"
+)
+
+// propertyKey identifies a named property of an entity within a particular scope.
+type propertyKey struct {
+	scope  string // e.g. GLOBAL, DIRECTORY or TARGET.
+	entity string // The directory, target, etc. or the empty string for GLOBAL properties.
+	name   string
+}
+
+// propertyEntities splits the scope and entity names from the leading arguments of a
+// get_property or set_property command, stopping at any of the provided keywords.
+func (e *eval) propertyEntities(args []string, stop ...string) (string, []string, []string) {
+	scope, args := args[0], args[1:]
+	var entities []string
+	for len(args) > 0 && !contains(stop, args[0]) {
+		entities, args = append(entities, args[0]), args[1:]
+	}
+	switch scope {
+	case "GLOBAL":
+		entities = []string{""}
+	case "DIRECTORY":
+		if len(entities) == 0 {
+			entities = []string{""}
+		}
+		for i, dir := range entities {
+			entities[i] = path.Join(e.ProjectRoot(), e.CurrentDirectory(), dir)
+			if path.IsAbs(dir) {
+				entities[i] = path.Clean(dir)
+			}
+		}
+	}
+	return scope, entities, args
+}
+
+// setProperty evaluates the arguments as https://cmake.org/cmake/help/latest/command/set_property.html
+func (e *eval) setProperty(args []string) {
+	if len(args) == 0 {
+		e.warnf("Missing required property scope")
+		return
+	}
+	scope, entities, args := e.propertyEntities(args, "APPEND", "APPEND_STRING", "PROPERTY")
+	var appendList, appendString bool
+	for ; len(args) > 0 && args[0] != "PROPERTY"; args = args[1:] {
+		appendList = appendList || args[0] == "APPEND"
+		appendString = appendString || args[0] == "APPEND_STRING"
+	}
+	if len(args) < 2 {
+		e.warnf("Ignoring set_property without a property name")
+		return
+	}
+	name, values := args[1], args[2:]
+	for _, entity := range entities {
+		key := propertyKey{scope, entity, name}
+		value, ok := e.props[key]
+		switch {
+		case appendList && ok && value != "":
+			e.props[key] = strings.Join(append([]string{value}, values...), ";")
+		case appendString:
+			e.props[key] = value + strings.Join(values, "")
+		default:
+			e.props[key] = strings.Join(values, ";")
+		}
+	}
+}
+
+// getProperty evaluates the arguments as https://cmake.org/cmake/help/latest/command/get_property.html
+// Properties which have not been set are stored as the empty string in the output variable.
+func (e *eval) getProperty(args []string) {
+	if len(args) < 2 {
+		e.warnf("Missing required get_property variable or scope")
+		return
+	}
+	out := args[0]
+	scope, entities, args := e.propertyEntities(args[1:], "PROPERTY")
+	if len(args) < 2 || len(entities) > 1 {
+		e.warnf("Ignoring invalid get_property command")
+		e.v.Set(out, "")
+		return
+	}
+	name, value, ok := args[1], "", false
+	switch {
+	case scope == "VARIABLE":
+		value = e.v.Get(name)
+		ok = value != ""
+	case scope == "CACHE" && name == "VALUE" && len(entities) == 1:
+		value = e.v.GetCache(entities[0])
+		ok = value != ""
+	case len(entities) == 1:
+		value, ok = e.props[propertyKey{scope, entities[0], name}]
+	}
+	if len(args) > 2 {
+		switch args[2] {
+		case "SET", "DEFINED":
+			value = "0"
+			if ok {
+				value = "1"
+			}
+		case "BRIEF_DOCS", "FULL_DOCS":
+			value = "NOTFOUND"
+		}
+	}
+	e.v.Set(out, value)
+}
+
+func contains(values []string, value string) bool {
+	for _, v := range values {
+		if v == value {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,188 @@
+/*
+ * Copyright 2019 The Kythe Authors. All rights reserved.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *   http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package writer
+
+import (
+	"errors"
+)
+
+// EmittedCommand is a single command recorded by CaptureWriter.
+type EmittedCommand struct {
+	Macro string        // The name of the enclosing macro.
+	Name  string        // The command name, as it would be written.
+	Args  []interface{} // The arguments, with ArgumentLiterals expanded.
+	Dir   []string      // The directories entered when the command was written, outermost first.
+	Pos   Position      // The source location of the command, if known.
+}
+
+// CaptureWriter records the commands written to it as EmittedCommands, optionally forwarding
+// everything written to another Writer so that structured and textual output can be produced together.
+type CaptureWriter struct {
+	next         Writer
+	commands     []EmittedCommand
+	currentMacro string
+	dirStack     []string
+}
+
+// NewCaptureWriter creates a new CaptureWriter forwarding to next, which may be nil.
+func NewCaptureWriter(next Writer) *CaptureWriter {
+	return &CaptureWriter{next: next}
+}
+
+// Commands returns the commands recorded so far, in the order they were written.
+func (cw *CaptureWriter) Commands() []EmittedCommand {
+	return cw.commands
+}
+
+// BeginMacro starts recording commands for a new macro with the given name.
+func (cw *CaptureWriter) BeginMacro(name string) error {
+	if cw.currentMacro != "" {
+		return errors.New("nested macros are not allowed")
+	}
+	name, err := identName(name)
+	if err != nil {
+		return err
+	}
+	if cw.next != nil {
+		if err := cw.next.BeginMacro(name); err != nil {
+			return err
+		}
+	}
+	cw.currentMacro = name
+	return nil
+}
+
+// EndMacro ends the current macro.
+func (cw *CaptureWriter) EndMacro() error {
+	if cw.currentMacro == "" {
+		return errors.New("no current macro")
+	}
+	cw.currentMacro = ""
+	if cw.next != nil {
+		return cw.next.EndMacro()
+	}
+	return nil
+}
+
+// PushDirectory adds path to the directory context of subsequent commands.
+func (cw *CaptureWriter) PushDirectory(path string) error {
+	if cw.currentMacro == "" {
+		return errors.New("no current macro")
+	}
+	if cw.next != nil {
+		if err := cw.next.PushDirectory(path); err != nil {
+			return err
+		}
+	}
+	cw.dirStack = append(cw.dirStack, path)
+	return nil
+}
+
+// PopDirectory removes the most recently pushed directory from the context and returns it.
+func (cw *CaptureWriter) PopDirectory() (string, error) {
+	if cw.currentMacro == "" {
+		return "", errors.New("no current macro")
+	}
+	if len(cw.dirStack) == 0 {
+		return "", errors.New("no current directory")
+	}
+	if cw.next != nil {
+		if _, err := cw.next.PopDirectory(); err != nil {
+			return "", err
+		}
+	}
+	return pop(&cw.dirStack), nil
+}
+
+// WriteCommand records the provided command and arguments.
+func (cw *CaptureWriter) WriteCommand(cmd string, args ...interface{}) error {
+	return cw.WriteCommandAt(Position{}, cmd, args...)
+}
+
+// WriteCommandAt records the provided command and arguments originating at pos.
+func (cw *CaptureWriter) WriteCommandAt(pos Position, cmd string, args ...interface{}) error {
+	if err := cw.record(pos, cmd, args); err != nil {
+		return err
+	}
+	switch next := cw.next.(type) {
+	case nil:
+		return nil
+	case interface {
+		WriteCommandAt(Position, string, ...interface{}) error
+	}:
+		return next.WriteCommandAt(pos, cmd, args...)
+	default:
+		return next.WriteCommand(cmd, args...)
+	}
+}
+
+// WriteAssignment records an assignment of value to name as a set command.
+// It is forwarded as an assignment if supported, or as a set command otherwise.
+func (cw *CaptureWriter) WriteAssignment(name string, value interface{}) error {
+	return cw.WriteAssignmentAt(Position{}, name, value)
+}
+
+// WriteAssignmentAt records an assignment of value to name originating at pos as WriteAssignment does.
+func (cw *CaptureWriter) WriteAssignmentAt(pos Position, name string, value interface{}) error {
+	if err := cw.record(pos, "set", []interface{}{name, value}); err != nil {
+		return err
+	}
+	switch next := cw.next.(type) {
+	case nil:
+		return nil
+	case interface {
+		WriteAssignmentAt(Position, string, interface{}) error
+	}:
+		return next.WriteAssignmentAt(pos, name, value)
+	case interface {
+		WriteAssignment(string, interface{}) error
+	}:
+		return next.WriteAssignment(name, value)
+	default:
+		return next.WriteCommand("set", name, value)
+	}
+}
+
+// WriteComment forwards the comment, if supported; comments are not recorded.
+func (cw *CaptureWriter) WriteComment(text string) error {
+	if cw.currentMacro == "" {
+		return errors.New("no current macro")
+	}
+	if next, ok := cw.next.(interface{ WriteComment(string) error }); ok {
+		return next.WriteComment(text)
+	}
+	return nil
+}
+
+// record appends the command to those captured.
+func (cw *CaptureWriter) record(pos Position, cmd string, args []interface{}) error {
+	if cw.currentMacro == "" {
+		return errors.New("no current macro")
+	}
+	cmd, err := identName(cmd)
+	if err != nil {
+		return err
+	}
+	cw.commands = append(cw.commands, EmittedCommand{
+		Macro: cw.currentMacro,
+		Name:  cmd,
+		Args:  expandLiterals(args),
+		Dir:   append([]string{}, cw.dirStack...),
+		Pos:   pos,
+	})
+	return nil
+}
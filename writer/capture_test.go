@@ -0,0 +1,100 @@
+/*
+ * Copyright 2019 The Kythe Authors. All rights reserved.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *   http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package writer
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/google/go-cmp/cmp"
+)
+
+func TestCaptureWriter(t *testing.T) {
+	var b strings.Builder
+	writer := NewCaptureWriter(NewStarlarkWriter(&b))
+	if err := writer.BeginMacro("x"); err != nil {
+		t.Fatal("Unexpected error writing macro: ", err)
+	}
+	if err := writer.PushDirectory("lib"); err != nil {
+		t.Fatal("Unexpected error entering directory: ", err)
+	}
+	pos := Position{Filename: "lib/CMakeLists.txt", Line: 2, Column: 3}
+	if err := writer.WriteCommandAt(pos, "configure_file", ArgumentLiterals{"a.in", "a.out"}); err != nil {
+		t.Fatal("Unexpected error writing command: ", err)
+	}
+	if err := writer.WriteComment("comment"); err != nil {
+		t.Fatal("Unexpected error writing comment: ", err)
+	}
+	if err := writer.WriteAssignment("NAME", []string{"a", "b"}); err != nil {
+		t.Fatal("Unexpected error writing assignment: ", err)
+	}
+	setPos := Position{Filename: "lib/CMakeLists.txt", Line: 4, Column: 1}
+	if err := writer.WriteAssignmentAt(setPos, "OTHER", "c"); err != nil {
+		t.Fatal("Unexpected error writing assignment: ", err)
+	}
+	if _, err := writer.PopDirectory(); err != nil {
+		t.Fatal("Unexpected error exiting directory: ", err)
+	}
+	if err := writer.WriteCommand("top"); err != nil {
+		t.Fatal("Unexpected error writing command: ", err)
+	}
+	if err := writer.EndMacro(); err != nil {
+		t.Fatal("Unexpected error ending macro: ", err)
+	}
+	if err := writer.WriteCommand("outside"); err == nil {
+		t.Error("Expected error writing a command outside of a macro")
+	}
+
+	expected := []EmittedCommand{{
+		Macro: "x",
+		Name:  "configure_file",
+		Args:  []interface{}{"a.in", "a.out"},
+		Dir:   []string{"lib"},
+		Pos:   pos,
+	}, {
+		Macro: "x",
+		Name:  "set",
+		Args:  []interface{}{"NAME", []string{"a", "b"}},
+		Dir:   []string{"lib"},
+	}, {
+		Macro: "x",
+		Name:  "set",
+		Args:  []interface{}{"OTHER", "c"},
+		Dir:   []string{"lib"},
+		Pos:   setPos,
+	}, {
+		Macro: "x",
+		Name:  "top",
+		Args:  []interface{}{},
+		Dir:   []string{},
+	}}
+	if diff := cmp.Diff(expected, writer.Commands()); diff != "" {
+		t.Errorf("Unexpected commands:\n%s", diff)
+	}
+	text := "def x(ctx):\n" +
+		"    ctx = ctx.push_directory(ctx, \"lib\")\n" +
+		"    ctx.configure_file(ctx, \"a.in\", \"a.out\")\n" +
+		"    # comment\n" +
+		"    NAME = [\"a\", \"b\"]\n" +
+		"    OTHER = \"c\"\n" +
+		"    ctx = ctx.pop_directory(ctx)\n" +
+		"    ctx.top(ctx)\n" +
+		"    return ctx\n"
+	if diff := cmp.Diff(text, b.String()); diff != "" {
+		t.Errorf("Unexpected forwarded output:\n%s", diff)
+	}
+}
@@ -0,0 +1,140 @@
+/*
+ * Copyright 2019 The Kythe Authors. All rights reserved.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *   http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package writer
+
+import (
+	"bufio"
+	"encoding/json"
+	"errors"
+	"io"
+)
+
+// Position is the source location of a written command.
+type Position struct {
+	Filename string
+	Line     int
+	Column   int
+}
+
+// JSONCommand is the JSON representation of a single command written by JSONWriter.
+type JSONCommand struct {
+	Macro     string        `json:"macro"`
+	Name      string        `json:"name"`
+	Args      []interface{} `json:"args"`
+	Directory []string      `json:"directory"`
+	File      string        `json:"file,omitempty"`
+	Line      int           `json:"line,omitempty"`
+	Column    int           `json:"column,omitempty"`
+}
+
+// JSONWriter writes commands as a stream of newline-delimited JSON objects,
+// each carrying the enclosing macro and directory context.
+type JSONWriter struct {
+	w            *bufio.Writer
+	enc          *json.Encoder
+	currentMacro string
+	dirStack     []string
+}
+
+// NewJSONWriter creates a new JSONWriter writing to the provided output.
+func NewJSONWriter(w io.Writer) *JSONWriter {
+	bw := bufio.NewWriter(w)
+	return &JSONWriter{w: bw, enc: json.NewEncoder(bw)}
+}
+
+// BeginMacro starts writing commands for a new macro with the given name.
+func (jw *JSONWriter) BeginMacro(name string) error {
+	if jw.currentMacro != "" {
+		return errors.New("nested macros are not allowed")
+	}
+	name, err := identName(name)
+	if err != nil {
+		return err
+	}
+	jw.currentMacro = name
+	return nil
+}
+
+// EndMacro ends the current macro; flushing any pending output.
+func (jw *JSONWriter) EndMacro() error {
+	if jw.currentMacro == "" {
+		return errors.New("no current macro")
+	}
+	jw.currentMacro = ""
+	return jw.Flush()
+}
+
+// Flush writes any buffered output to the underlying writer.
+func (jw *JSONWriter) Flush() error {
+	return jw.w.Flush()
+}
+
+// PushDirectory adds path to the directory context of subsequent commands.
+func (jw *JSONWriter) PushDirectory(path string) error {
+	if jw.currentMacro == "" {
+		return errors.New("no current macro")
+	}
+	jw.dirStack = append(jw.dirStack, path)
+	return nil
+}
+
+// PopDirectory removes the most recently pushed directory from the context and returns it.
+func (jw *JSONWriter) PopDirectory() (string, error) {
+	if jw.currentMacro == "" {
+		return "", errors.New("no current macro")
+	}
+	if len(jw.dirStack) == 0 {
+		return "", errors.New("no current directory")
+	}
+	return pop(&jw.dirStack), nil
+}
+
+// WriteCommand writes a JSON object for the provided command and arguments.
+func (jw *JSONWriter) WriteCommand(cmd string, args ...interface{}) error {
+	return jw.WriteCommandAt(Position{}, cmd, args...)
+}
+
+// WriteCommandAt writes a JSON object for the provided command and arguments originating at pos.
+// ArgumentLiterals are expanded into the enclosing argument list.
+func (jw *JSONWriter) WriteCommandAt(pos Position, cmd string, args ...interface{}) error {
+	if jw.currentMacro == "" {
+		return errors.New("no current macro")
+	}
+	cmd, err := identName(cmd)
+	if err != nil {
+		return err
+	}
+	return jw.enc.Encode(JSONCommand{
+		Macro:     jw.currentMacro,
+		Name:      cmd,
+		Args:      expandLiterals(args),
+		Directory: append([]string{}, jw.dirStack...),
+		File:      pos.Filename,
+		Line:      pos.Line,
+		Column:    pos.Column,
+	})
+}
+
+// WriteAssignment writes a JSON object for a set command assigning value to name.
+func (jw *JSONWriter) WriteAssignment(name string, value interface{}) error {
+	return jw.WriteAssignmentAt(Position{}, name, value)
+}
+
+// WriteAssignmentAt writes a JSON object for a set command assigning value to name originating at pos.
+func (jw *JSONWriter) WriteAssignmentAt(pos Position, name string, value interface{}) error {
+	return jw.WriteCommandAt(pos, "set", name, value)
+}
@@ -0,0 +1,95 @@
+/*
+ * Copyright 2019 The Kythe Authors. All rights reserved.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *   http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package writer
+
+import (
+	"encoding/json"
+	"io"
+	"strings"
+	"testing"
+
+	"github.com/google/go-cmp/cmp"
+)
+
+func TestJSONCommandWriting(t *testing.T) {
+	var b strings.Builder
+	writer := NewJSONWriter(&b)
+	if err := writer.BeginMacro("hello_world"); err != nil {
+		t.Fatal("Unexpected error writing macro: ", err)
+	}
+	for _, path := range []string{"llvm", "lib"} {
+		if err := writer.PushDirectory(path); err != nil {
+			t.Fatal("Unpexpected error entering directory: ", err)
+		}
+	}
+	pos := Position{Filename: "llvm/lib/CMakeLists.txt", Line: 3, Column: 1}
+	if err := writer.WriteCommandAt(pos, "configure_file", ArgumentLiterals{"a.in", "a.out"}); err != nil {
+		t.Fatal("Unpexected error writing command: ", err)
+	}
+	if err := writer.WriteCommand("add_llvm_library", ArgumentLiterals{"LLVMSupport"}, true); err != nil {
+		t.Fatal("Unpexected error writing command: ", err)
+	}
+	pos = Position{Filename: "llvm/lib/CMakeLists.txt", Line: 5, Column: 3}
+	if err := writer.WriteAssignmentAt(pos, "SOURCES", []string{"a.cpp", "b.cpp"}); err != nil {
+		t.Fatal("Unpexected error writing assignment: ", err)
+	}
+	if p, err := writer.PopDirectory(); err != nil {
+		t.Fatal("Unpexpected error exiting directory: ", err)
+	} else if p != "lib" {
+		t.Errorf("Unexpected directory path: %#v", p)
+	}
+	if err := writer.EndMacro(); err != nil {
+		t.Fatal("Unpexpected error ending macro: ", err)
+	}
+
+	var actual []JSONCommand
+	dec := json.NewDecoder(strings.NewReader(b.String()))
+	for {
+		var cmd JSONCommand
+		if err := dec.Decode(&cmd); err == io.EOF {
+			break
+		} else if err != nil {
+			t.Fatal("Unexpected error decoding output: ", err)
+		}
+		actual = append(actual, cmd)
+	}
+	expected := []JSONCommand{{
+		Macro:     "hello_world",
+		Name:      "configure_file",
+		Args:      []interface{}{"a.in", "a.out"},
+		Directory: []string{"llvm", "lib"},
+		File:      "llvm/lib/CMakeLists.txt",
+		Line:      3,
+		Column:    1,
+	}, {
+		Macro:     "hello_world",
+		Name:      "add_llvm_library",
+		Args:      []interface{}{"LLVMSupport", true},
+		Directory: []string{"llvm", "lib"},
+	}, {
+		Macro:     "hello_world",
+		Name:      "set",
+		Args:      []interface{}{"SOURCES", []interface{}{"a.cpp", "b.cpp"}},
+		Directory: []string{"llvm", "lib"},
+		File:      "llvm/lib/CMakeLists.txt",
+		Line:      5,
+		Column:    3,
+	}}
+	if diff := cmp.Diff(expected, actual); diff != "" {
+		t.Error("Unexpected writer output:\n", diff)
+	}
+}
@@ -4,8 +4,11 @@ import (
 	"bytes"
 	"fmt"
 	"reflect"
+	"sort"
 	"strconv"
 	"strings"
+	"unicode"
+	"unicode/utf8"
 )
 
 // Marshaler is the interface implemented by types that
@@ -14,6 +17,67 @@ type Marshaler interface {
 	MarshalStarlark() ([]byte, error)
 }
 
+// CallExpr is a Marshaler for a Starlark function call expression.
+type CallExpr struct {
+	Name string        // The, possibly dotted, name of the function.
+	Args []interface{} // The arguments, each marshaled in turn; use Kwarg for keyword arguments.
+}
+
+// Call returns a CallExpr which marshals as name(args...).
+func Call(name string, args ...interface{}) CallExpr {
+	return CallExpr{name, args}
+}
+
+// MarshalStarlark implements Marshaler for CallExpr.
+func (c CallExpr) MarshalStarlark() ([]byte, error) {
+	var b bytes.Buffer
+	for i, part := range strings.Split(c.Name, ".") {
+		ident, err := identName(part)
+		if err != nil {
+			return nil, err
+		}
+		if i > 0 {
+			b.WriteByte('.')
+		}
+		b.WriteString(ident)
+	}
+	b.WriteByte('(')
+	for i, arg := range c.Args {
+		if i > 0 {
+			b.WriteString(", ")
+		}
+		if err := encodeValue(&b, reflect.ValueOf(arg)); err != nil {
+			return nil, err
+		}
+	}
+	b.WriteByte(')')
+	return b.Bytes(), nil
+}
+
+// KeywordArg is a Marshaler for a keyword argument within a CallExpr.
+type KeywordArg struct {
+	Name  string
+	Value interface{}
+}
+
+// Kwarg returns a KeywordArg which marshals as name = value.
+func Kwarg(name string, value interface{}) KeywordArg {
+	return KeywordArg{name, value}
+}
+
+// MarshalStarlark implements Marshaler for KeywordArg.
+func (k KeywordArg) MarshalStarlark() ([]byte, error) {
+	name, err := identName(k.Name)
+	if err != nil {
+		return nil, err
+	}
+	value, err := Marshal(k.Value)
+	if err != nil {
+		return nil, err
+	}
+	return append([]byte(name+" = "), value...), nil
+}
+
 var (
 	marshalerType = reflect.TypeOf((*Marshaler)(nil)).Elem()
 )
@@ -23,8 +87,10 @@ var (
 // Marshal traverses the value v recursively using the following type-dependent default encodings:
 //
 // Boolean values are encoded as True/False.
-// Strings values are encoded as quoted Starlark strings.
+// Strings values are encoded as quoted Starlark strings, escaping only non-printable characters.
+// Strings containing newlines are encoded as triple-quoted Starlark strings.
 // Array and slice values are encoded as Starlark lists, with their contents recursively encoded.
+// Map values are encoded as Starlark dicts, with entries sorted by their encoded keys.
 // Nil pointer values are encoded as None.
 func Marshal(v interface{}) ([]byte, error) {
 	var buf bytes.Buffer
@@ -61,6 +127,8 @@ func encodeType(b *bytes.Buffer, t reflect.Type, v reflect.Value) error {
 		return encodeSlice(b, v)
 	case reflect.Array:
 		return encodeArray(b, v)
+	case reflect.Map:
+		return encodeMap(b, v)
 	case reflect.Interface, reflect.Ptr:
 		return encodeInterface(b, v)
 	default:
@@ -85,7 +153,53 @@ func encodeFloat(b *bytes.Buffer, v reflect.Value) error {
 }
 
 func encodeString(b *bytes.Buffer, v reflect.Value) error {
-	return writeString(b, strconv.QuoteToASCII(v.String()))
+	return writeString(b, quoteString(v.String()))
+}
+
+// quoteString returns a double-quoted Starlark string literal for s.
+// Printable UTF-8 is retained as-is while other characters are written using only
+// the escape sequences recognized by Starlark.
+// Strings containing newlines are written as triple-quoted literals with the newlines retained.
+func quoteString(s string) string {
+	quote := `"`
+	multiline := strings.Contains(s, "\n")
+	if multiline {
+		quote = `"""`
+	}
+	var b strings.Builder
+	b.WriteString(quote)
+	for len(s) > 0 {
+		r, width := utf8.DecodeRuneInString(s)
+		switch {
+		case r == utf8.RuneError && width == 1:
+			fmt.Fprintf(&b, `\x%02x`, s[0])
+		case r == '"' && multiline && !strings.HasPrefix(s, `"""`) && s != `"`:
+			// Only quotes which would otherwise terminate the literal need escaping.
+			b.WriteRune(r)
+		case r == '"', r == '\\':
+			b.WriteByte('\\')
+			b.WriteRune(r)
+		case r == '\n' && multiline:
+			b.WriteRune(r)
+		case r == '\n':
+			b.WriteString(`\n`)
+		case r == '\r':
+			b.WriteString(`\r`)
+		case r == '\t':
+			b.WriteString(`\t`)
+		case r < utf8.RuneSelf && !unicode.IsPrint(r):
+			fmt.Fprintf(&b, `\x%02x`, r)
+		case !unicode.IsPrint(r) && r <= 0xFFFF:
+			fmt.Fprintf(&b, `\u%04x`, r)
+		case !unicode.IsPrint(r):
+			fmt.Fprintf(&b, `\U%08x`, r)
+		default:
+			b.WriteRune(r)
+		}
+		s = s[width:]
+	}
+	b.WriteString(quote)
+	return b.String()
 }
 
 func encodeSlice(b *bytes.Buffer, v reflect.Value) error {
@@ -113,6 +227,37 @@ func encodeArray(b *bytes.Buffer, v reflect.Value) error {
 	return b.WriteByte(']')
 }
 
+func encodeMap(b *bytes.Buffer, v reflect.Value) error {
+	type entry struct{ key, value []byte }
+	var entries []entry
+	iter := v.MapRange()
+	for iter.Next() {
+		var key, value bytes.Buffer
+		if err := encodeValue(&key, iter.Key()); err != nil {
+			return err
+		}
+		if err := encodeValue(&value, iter.Value()); err != nil {
+			return err
+		}
+		entries = append(entries, entry{key.Bytes(), value.Bytes()})
+	}
+	sort.Slice(entries, func(i, j int) bool { return bytes.Compare(entries[i].key, entries[j].key) < 0 })
+	if err := b.WriteByte('{'); err != nil {
+		return err
+	}
+	for i, e := range entries {
+		if i > 0 {
+			if err := writeString(b, ", "); err != nil {
+				return err
+			}
+		}
+		b.Write(e.key)
+		b.WriteString(": ")
+		b.Write(e.value)
+	}
+	return b.WriteByte('}')
+}
+
 func encodeInterface(b *bytes.Buffer, v reflect.Value) error {
 	if v.IsNil() {
 		return writeString(b, "None")
@@ -139,3 +284,115 @@ func writeString(b *bytes.Buffer, value string) error {
 	_, err := b.WriteString(value)
 	return err
 }
+
+// MarshalEqual reports whether a and b marshal to equivalent Starlark, disregarding insignificant
+// whitespace, trailing commas and the order of dict entries, including within the output of a Marshaler.
+// It is intended for tests which compare generated values.
+func MarshalEqual(a, b interface{}) (bool, error) {
+	ma, err := Marshal(a)
+	if err != nil {
+		return false, err
+	}
+	mb, err := Marshal(b)
+	if err != nil {
+		return false, err
+	}
+	na, err := normalizeStarlark(string(ma))
+	if err != nil {
+		return false, err
+	}
+	nb, err := normalizeStarlark(string(mb))
+	if err != nil {
+		return false, err
+	}
+	return na == nb, nil
+}
+
+// normalizeStarlark returns a canonical form of the Starlark expression src for comparison.
+func normalizeStarlark(src string) (string, error) {
+	norm, end, err := normalizeUntil(src, 0, 0)
+	if err != nil {
+		return "", err
+	}
+	if end != len(src) {
+		return "", fmt.Errorf("unexpected %q at offset %d", src[end], end)
+	}
+	return norm, nil
+}
+
+// normalizeUntil normalizes src from offset i until the closing bracket, returning the normalized
+// text and the offset of the closing bracket, or the end of src if closing is 0.
+// Within brackets, elements are separated by commas, with an empty trailing element dropped,
+// and dict entries are sorted.
+func normalizeUntil(src string, i int, closing byte) (string, int, error) {
+	var elems []string
+	var cur []byte
+	for i < len(src) {
+		switch c := src[i]; {
+		case c == '"' || c == '\'':
+			end, err := scanString(src, i)
+			if err != nil {
+				return "", i, err
+			}
+			cur, i = append(cur, src[i:end]...), end
+		case c == ' ' || c == '\t' || c == '\n' || c == '\r':
+			for i < len(src) && strings.IndexByte(" \t\n\r", src[i]) >= 0 {
+				i++
+			}
+			// Whitespace is only significant between words.
+			if len(cur) > 0 && i < len(src) && isWordByte(cur[len(cur)-1]) && isWordByte(src[i]) {
+				cur = append(cur, ' ')
+			}
+		case c == '(' || c == '[' || c == '{':
+			closer := map[byte]byte{'(': ')', '[': ']', '{': '}'}[c]
+			inner, end, err := normalizeUntil(src, i+1, closer)
+			if err != nil {
+				return "", i, err
+			}
+			cur = append(append(append(cur, c), inner...), closer)
+			i = end + 1
+		case c == ')' || c == ']' || c == '}':
+			if c != closing {
+				return "", i, fmt.Errorf("unexpected %q at offset %d", c, i)
+			}
+			if len(cur) > 0 {
+				elems = append(elems, string(cur))
+			}
+			if c == '}' {
+				sort.Strings(elems)
+			}
+			return strings.Join(elems, ","), i, nil
+		case c == ',' && closing != 0:
+			elems, cur = append(elems, string(cur)), nil
+			i++
+		default:
+			cur = append(cur, c)
+			i++
+		}
+	}
+	if closing != 0 {
+		return "", i, fmt.Errorf("missing %q at end of input", closing)
+	}
+	return string(cur), i, nil
+}
+
+// scanString returns the offset following the string literal starting at src[i].
+func scanString(src string, i int) (int, error) {
+	quote := src[i : i+1]
+	if strings.HasPrefix(src[i:], strings.Repeat(quote, 3)) {
+		quote = strings.Repeat(quote, 3)
+	}
+	for j := i + len(quote); j < len(src); j++ {
+		switch {
+		case src[j] == '\\':
+			j++
+		case strings.HasPrefix(src[j:], quote):
+			return j + len(quote), nil
+		}
+	}
+	return 0, fmt.Errorf("unterminated string at offset %d", i)
+}
+
+func isWordByte(c byte) bool {
+	return c == '_' || c == '.' || '0' <= c && c <= '9' || 'a' <= c && c <= 'z' || 'A' <= c && c <= 'Z'
+}
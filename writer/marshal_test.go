@@ -20,8 +20,26 @@ func TestMarshalling(t *testing.T) {
 		{1.3, "1.3"},
 		{true, "True"},
 		{"hello, world", `"hello, world"`},
+		{"line\nbreak", "\"\"\"line\nbreak\"\"\""},
+		{"say \"\"\"hi\"\"\"\nthere", "\"\"\"say \\\"\"\"hi\\\"\"\"\nthere\"\"\""},
+		{"ends with\n\"", "\"\"\"ends with\n\\\"\"\"\""},
+		{"ends with\nbackslash\\", "\"\"\"ends with\nbackslash\\\\\"\"\""},
+		{"escape\\n\n", "\"\"\"escape\\\\n\n\"\"\""},
+		{"carriage\r\nreturn", "\"\"\"carriage\\r\nreturn\"\"\""},
+		{`say "hi"`, `"say \"hi\""`},
+		{`back\slash`, `"back\\slash"`},
+		{"/src/m\u00fcnchen/\u4e16", "\"/src/m\u00fcnchen/\u4e16\""},
+		{"nul\x00byte", `"nul\x00byte"`},
+		{"bad\xffutf8", `"bad\xffutf8"`},
+		{"zero\u200bwidth", `"zero\u200bwidth"`},
 		{[]interface{}{1, true, "hello"}, "[1, True, \"hello\"]"},
 		{marsh{}, "marshaled"},
+		{Call("glob", []string{"*.c"}), `glob(["*.c"])`},
+		{Call("native.glob", []string{"*.c"}, Kwarg("exclude", []string{"x.c"})), `native.glob(["*.c"], exclude = ["x.c"])`},
+		{Call("select", Call("glob", []string{"*.cpp"})), `select(glob(["*.cpp"]))`},
+		{map[string]int{"b": 2, "a": 1}, `{"a": 1, "b": 2}`},
+		{map[string][]string{}, `{}`},
+		{[]interface{}{Call("f"), Kwarg("srcs", Call("glob", []interface{}{"a", marsh{}}))}, `[f(), srcs = glob(["a", marshaled])]`},
 	}
 
 	for _, test := range tests {
@@ -33,3 +51,57 @@ func TestMarshalling(t *testing.T) {
 		}
 	}
 }
+
+func TestMarshalCallErrors(t *testing.T) {
+	for _, v := range []interface{}{
+		Call("not valid"),
+		Call("glob", Kwarg("1st", true)),
+		Call("glob", func() {}),
+	} {
+		if a, err := Marshal(v); err == nil {
+			t.Errorf("Expected error marshaling %#v, got %#v", v, string(a))
+		}
+	}
+}
+
+type rawMarshaler string
+
+func (r rawMarshaler) MarshalStarlark() ([]byte, error) {
+	return []byte(r), nil
+}
+
+func TestMarshalEqual(t *testing.T) {
+	a, b := map[string]interface{}{}, map[string]interface{}{}
+	for _, k := range []string{"name", "deps", "srcs"} {
+		a[k] = []string{k}
+	}
+	for _, k := range []string{"srcs", "name", "deps"} {
+		b[k] = []string{k}
+	}
+	tests := []struct {
+		a, b  interface{}
+		equal bool
+	}{
+		{a, b, true},
+		{a, map[string]interface{}{"name": []string{"name"}}, false},
+		{rawMarshaler(`{"b": 2, "a": [1, 2,]}`), rawMarshaler("{\n  \"a\": [1,2],\n  \"b\": 2,\n}"), true},
+		{rawMarshaler(`f(x = {"b": 1, "a": 2})`), Call("f", Kwarg("x", map[string]int{"a": 2, "b": 1})), true},
+		{rawMarshaler(`["b", "a"]`), []string{"a", "b"}, false},
+		{rawMarshaler(`"a  b"`), "a b", false},
+		{rawMarshaler(`not x`), rawMarshaler(`notx`), false},
+	}
+	for _, test := range tests {
+		equal, err := MarshalEqual(test.a, test.b)
+		if err != nil {
+			t.Errorf("Unexpected error comparing %#v and %#v: %v", test.a, test.b, err)
+		} else if equal != test.equal {
+			t.Errorf("Expected MarshalEqual(%#v, %#v) == %v", test.a, test.b, test.equal)
+		}
+	}
+
+	for _, v := range []interface{}{rawMarshaler(`[1, 2`), rawMarshaler(`"open`), rawMarshaler(`(]`), func() {}} {
+		if _, err := MarshalEqual(v, v); err == nil {
+			t.Errorf("Expected error comparing %#v", v)
+		}
+	}
+}
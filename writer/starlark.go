@@ -21,7 +21,9 @@ import (
 	"errors"
 	"fmt"
 	"io"
+	"path"
 	"regexp"
+	"strings"
 
 	"bitbucket.org/creachadair/stringset"
 )
@@ -36,14 +38,34 @@ var (
 		"def", "lambda", "class",
 		"del", "raise", "except", "try", "finally", "from", "with",
 	)
+	// Names of the macro parameter and predeclared constants which local variables must not shadow.
+	shadowedNames = stringset.New("ctx", "True", "False", "None")
+)
+
+// Writer is the interface implemented by output backends for evaluated CMake commands.
+type Writer interface {
+	BeginMacro(name string) error                       // Begins a new macro with the given name.
+	EndMacro() error                                    // Ends the current macro, flushing any pending output.
+	PushDirectory(path string) error                    // Enters the given directory.
+	PopDirectory() (string, error)                      // Exits the most recently entered directory, returning it.
+	WriteCommand(cmd string, args ...interface{}) error // Writes a command with the provided arguments.
+}
+
+var (
+	_ Writer = (*StarlarkWriter)(nil)
+	_ Writer = (*JSONWriter)(nil)
+	_ Writer = (*CaptureWriter)(nil)
 )
 
 // StarlarkWriter is a simple type for writing basic Starlark macros with a consistent form.
+// Output is buffered until EndMacro, so callers which do not end each macro must call Flush.
 type StarlarkWriter struct {
 	w            *bufio.Writer
 	buf          []string
 	currentMacro string
 	dirStack     []string
+	pending      []string // Directories entered, but not yet written; always a suffix of dirStack.
+	written      []int    // The number of directories entered by each written push_directory.
 }
 
 // NewStarlarkWriter creates a new StarlarkWriter writing to the provided output.
@@ -66,35 +88,45 @@ func (sw *StarlarkWriter) BeginMacro(name string) error {
 }
 
 // EndMacro ends writing the current macro; flushing any pending output.
+// As the macro threads ctx through each command, the final statement is always `return ctx`,
+// which also serves as the body of an otherwise empty macro.
+// Output is flushed even if writing the end of the macro fails.
 func (sw *StarlarkWriter) EndMacro() error {
 	if sw.currentMacro == "" {
 		return errors.New("no current macro")
 	}
 	err := sw.writeBuffered()
-	if err != nil {
-		return err
+	if err == nil {
+		err = sw.writeString(sw.indentf("return ctx\n"))
+	}
+	if ferr := sw.Flush(); err == nil {
+		err = ferr
 	}
-	if err := sw.writeString(sw.indentf("return ctx\n")); err != nil {
+	if err != nil {
 		return err
 	}
 	sw.currentMacro = ""
+	return nil
+}
+
+// Flush writes any buffered output to the underlying writer.
+// Directives and macro headers which are deferred until a command is written are not flushed.
+func (sw *StarlarkWriter) Flush() error {
 	return sw.w.Flush()
 }
 
 // PushDirectory writes a Starlark directive indicating a new directory context should be used in the given path.
+// Directives are buffered until a command is written within the directory, at which point consecutive
+// pending directories are combined into a single directive.
 func (sw *StarlarkWriter) PushDirectory(path string) error {
 	if sw.currentMacro == "" {
 		return errors.New("no current macro")
 	}
 	sw.dirStack = append(sw.dirStack, path)
-	sw.buf = append(sw.buf, sw.pushDirString(path))
+	sw.pending = append(sw.pending, path)
 	return nil
 }
 
-func (sw *StarlarkWriter) pushDirString(path string) string {
-	return sw.indentf("ctx = ctx.push_directory(ctx, %#v)\n", path)
-}
-
 // PopDirectory writes a Starlark directive indicating that the directory has been exited and to restore the previous context.
 func (sw *StarlarkWriter) PopDirectory() (string, error) {
 	if sw.currentMacro == "" {
@@ -105,10 +137,15 @@ func (sw *StarlarkWriter) PopDirectory() (string, error) {
 	}
 	path := pop(&sw.dirStack)
 	// Suppress enter/exit pairs which are otherwise empty.
-	if len(sw.buf) > 0 && sw.buf[len(sw.buf)-1] == sw.pushDirString(path) {
-		sw.buf = sw.buf[:len(sw.buf)-1]
+	if len(sw.pending) > 0 {
+		sw.pending = sw.pending[:len(sw.pending)-1]
 		return path, nil
 	}
+	// Exiting a combined directive also exits the enclosing directories, which must be re-entered
+	// if anything further is written within them.
+	n := sw.written[len(sw.written)-1]
+	sw.written = sw.written[:len(sw.written)-1]
+	sw.pending = append(sw.pending, sw.dirStack[len(sw.dirStack)-(n-1):]...)
 	return path, sw.writeString(sw.indentf("ctx = ctx.pop_directory(ctx)\n"))
 }
 
@@ -139,6 +176,74 @@ func (sw *StarlarkWriter) WriteCommand(cmd string, args ...interface{}) error {
 	return sw.writeString(")\n")
 }
 
+// WriteComprehension writes a list comprehension invoking the provided command once for each of the items,
+// with the fixed arguments preceding the item bound to varName, e.g. [ctx.cmd(ctx, "fixed", n) for n in ["a", "b"]].
+// varName is renamed as by localName.
+func (sw *StarlarkWriter) WriteComprehension(cmd string, varName string, items []string, fixedArgs ...string) error {
+	if sw.currentMacro == "" {
+		return errors.New("no current macro")
+	}
+	cmd, err := identName(cmd)
+	if err != nil {
+		return err
+	}
+	varName, err = localName(varName)
+	if err != nil {
+		return err
+	}
+	fixed, err := Marshal(fixedArgs)
+	if err != nil {
+		return err
+	}
+	vals, err := Marshal(items)
+	if err != nil {
+		return err
+	}
+	if err := sw.writeBuffered(); err != nil {
+		return err
+	}
+	call := "ctx." + cmd + "(ctx"
+	if len(fixedArgs) > 0 {
+		call += ", " + string(fixed[1:len(fixed)-1])
+	}
+	return sw.writeString(sw.indentf("[%s, %s) for %s in %s]\n", call, varName, varName, string(vals)))
+}
+
+// WriteAssignment writes an assignment of the marshaled value to the named variable, renamed as by localName.
+func (sw *StarlarkWriter) WriteAssignment(name string, value interface{}) error {
+	if sw.currentMacro == "" {
+		return errors.New("no current macro")
+	}
+	name, err := localName(name)
+	if err != nil {
+		return err
+	}
+	val, err := Marshal(value)
+	if err != nil {
+		return err
+	}
+	if err := sw.writeBuffered(); err != nil {
+		return err
+	}
+	return sw.writeString(sw.indentf("%s = %s\n", name, string(val)))
+}
+
+// WriteComment writes the text as a comment, one line per line of text.
+func (sw *StarlarkWriter) WriteComment(text string) error {
+	if sw.currentMacro == "" {
+		return errors.New("no current macro")
+	}
+	if err := sw.writeBuffered(); err != nil {
+		return err
+	}
+	for _, line := range strings.Split(text, "\n") {
+		if err := sw.writeString(strings.TrimRight(sw.indentf("# %s", line), " ") + "\n"); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
 func (sw *StarlarkWriter) indentf(format string, vals ...interface{}) string {
 	return fmt.Sprintf("    "+format, vals...)
 }
@@ -155,7 +260,26 @@ func (sw *StarlarkWriter) writeBuffered() error {
 		}
 	}
 	sw.buf = nil
-	return nil
+	if len(sw.pending) == 0 {
+		return nil
+	}
+	sw.written = append(sw.written, len(sw.pending))
+	dir := joinDirs(sw.pending)
+	sw.pending = nil
+	return sw.writeString(sw.indentf("ctx = ctx.push_directory(ctx, %#v)\n", dir))
+}
+
+// joinDirs joins the directories, each relative to the last, into a single path.
+func joinDirs(dirs []string) string {
+	var result string
+	for _, dir := range dirs {
+		if path.IsAbs(dir) {
+			result = dir
+		} else {
+			result = path.Join(result, dir)
+		}
+	}
+	return result
 }
 
 // ArgumentLiterals represents a list of literal positional argument and is written to support
@@ -171,11 +295,43 @@ func (al ArgumentLiterals) MarshalStarlark() ([]byte, error) {
 	return b[1 : len(b)-1], nil
 }
 
+// expandLiterals returns args with the values of each ArgumentLiterals expanded in place.
+func expandLiterals(args []interface{}) []interface{} {
+	values := []interface{}{}
+	for _, arg := range args {
+		if al, ok := arg.(ArgumentLiterals); ok {
+			for _, v := range al {
+				values = append(values, v)
+			}
+		} else {
+			values = append(values, arg)
+		}
+	}
+	return values
+}
+
 func pop(s *[]string) (x string) {
 	x, *s = (*s)[len(*s)-1], (*s)[:len(*s)-1]
 	return
 }
 
+// IdentName returns the Starlark identifier written for ident, which has a trailing
+// underscore appended if ident is a reserved word, or an error if ident is not a valid identifier.
+func IdentName(ident string) (string, error) {
+	return identName(ident)
+}
+
+// localName returns the Starlark identifier written for a local variable named ident,
+// which is renamed as identName does and, if it would shadow the macro's ctx parameter
+// or a predeclared constant, by appending an underscore.
+func localName(ident string) (string, error) {
+	name, err := identName(ident)
+	if err == nil && shadowedNames.Contains(name) {
+		name += "_"
+	}
+	return name, err
+}
+
 func identName(ident string) (string, error) {
 	if !validIdentPattern.MatchString(ident) {
 		return "", fmt.Errorf("invalid Starlark identifier: %s", ident)
@@ -21,6 +21,52 @@ func TestEmptyMacro(t *testing.T) {
 	}
 }
 
+func TestConsecutiveEmptyMacros(t *testing.T) {
+	var b strings.Builder
+	writer := NewStarlarkWriter(&b)
+	for _, name := range []string{"x", "y"} {
+		if err := writer.BeginMacro(name); err != nil {
+			t.Fatal("Unexpected error writing macro: ", err)
+		}
+		if err := writer.EndMacro(); err != nil {
+			t.Fatal("Unpexpected error ending macro: ", err)
+		}
+	}
+	if diff := cmp.Diff("def x(ctx):\n    return ctx\ndef y(ctx):\n    return ctx\n", b.String()); diff != "" {
+		t.Error("Unexpected writer output:\n", diff)
+	}
+}
+
+func TestFlush(t *testing.T) {
+	var b strings.Builder
+	writer := NewStarlarkWriter(&b)
+	if err := writer.BeginMacro("x"); err != nil {
+		t.Fatal("Unexpected error writing macro: ", err)
+	}
+	if err := writer.PushDirectory("lib"); err != nil {
+		t.Fatal("Unexpected error pushing directory: ", err)
+	}
+	if err := writer.WriteCommand("cmd", "arg"); err != nil {
+		t.Fatal("Unexpected error writing command: ", err)
+	}
+	if err := writer.WriteComment("done"); err != nil {
+		t.Fatal("Unexpected error writing comment: ", err)
+	}
+	if b.Len() != 0 {
+		t.Errorf("Expected output to be buffered, found %#v", b.String())
+	}
+	if err := writer.Flush(); err != nil {
+		t.Fatal("Unexpected error flushing: ", err)
+	}
+	expected := "def x(ctx):\n" +
+		"    ctx = ctx.push_directory(ctx, \"lib\")\n" +
+		"    ctx.cmd(ctx, \"arg\")\n" +
+		"    # done\n"
+	if diff := cmp.Diff(expected, b.String()); diff != "" {
+		t.Error("Unexpected writer output:\n", diff)
+	}
+}
+
 func TestDirectoryBuffering(t *testing.T) {
 	var b strings.Builder
 	writer := NewStarlarkWriter(&b)
@@ -47,6 +93,53 @@ func TestDirectoryBuffering(t *testing.T) {
 	}
 }
 
+func TestNestedDirectoryCollapsing(t *testing.T) {
+	var b strings.Builder
+	writer := NewStarlarkWriter(&b)
+	if err := writer.BeginMacro("hello_world"); err != nil {
+		t.Fatal("Unexpected error writing macro: ", err)
+	}
+	for _, path := range []string{"a", "b", "c", "d"} {
+		if err := writer.PushDirectory(path); err != nil {
+			t.Fatal("Unpexpected error entering directory: ", err)
+		}
+	}
+	if err := writer.WriteCommand("deepest"); err != nil {
+		t.Fatal("Unpexected error writing command: ", err)
+	}
+	for _, path := range []string{"d", "c"} {
+		if p, err := writer.PopDirectory(); err != nil {
+			t.Fatal("Unpexpected error exiting directory: ", err)
+		} else if diff := cmp.Diff(path, p); diff != "" {
+			t.Error("Unpexpected directory path:\n", diff)
+		}
+	}
+	if err := writer.WriteCommand("intermediate"); err != nil {
+		t.Fatal("Unpexected error writing command: ", err)
+	}
+	for _, path := range []string{"b", "a"} {
+		if p, err := writer.PopDirectory(); err != nil {
+			t.Fatal("Unpexpected error exiting directory: ", err)
+		} else if diff := cmp.Diff(path, p); diff != "" {
+			t.Error("Unpexpected directory path:\n", diff)
+		}
+	}
+	if err := writer.EndMacro(); err != nil {
+		t.Fatal("Unpexpected error ending macro: ", err)
+	}
+	expected := "def hello_world(ctx):\n" +
+		"    ctx = ctx.push_directory(ctx, \"a/b/c/d\")\n" +
+		"    ctx.deepest(ctx)\n" +
+		"    ctx = ctx.pop_directory(ctx)\n" +
+		"    ctx = ctx.push_directory(ctx, \"a/b\")\n" +
+		"    ctx.intermediate(ctx)\n" +
+		"    ctx = ctx.pop_directory(ctx)\n" +
+		"    return ctx\n"
+	if diff := cmp.Diff(expected, b.String()); diff != "" {
+		t.Error("Unexpected writer output:\n", diff)
+	}
+}
+
 func TestCommandWriting(t *testing.T) {
 	var b strings.Builder
 	writer := NewStarlarkWriter(&b)
@@ -75,6 +168,98 @@ func TestCommandWriting(t *testing.T) {
 	}
 }
 
+func TestComprehensionWriting(t *testing.T) {
+	var b strings.Builder
+	writer := NewStarlarkWriter(&b)
+	if err := writer.BeginMacro("hello_world"); err != nil {
+		t.Fatal("Unexpected error writing macro: ", err)
+	}
+	if err := writer.WriteComprehension("add_x", "n", []string{"a", "b", "c"}, "fixed"); err != nil {
+		t.Fatal("Unpexected error writing comprehension: ", err)
+	}
+	if err := writer.WriteComprehension("add_y", "n", []string{"d"}); err != nil {
+		t.Fatal("Unpexected error writing comprehension: ", err)
+	}
+	if err := writer.WriteComprehension("add_ctx", "ctx", []string{"f"}); err != nil {
+		t.Fatal("Unpexected error writing comprehension: ", err)
+	}
+	if err := writer.WriteComprehension("add_z", "not valid", []string{"e"}); err == nil {
+		t.Error("Invalid variable name accepted")
+	}
+	if err := writer.EndMacro(); err != nil {
+		t.Fatal("Unpexpected error ending macro: ", err)
+	}
+	expected := "def hello_world(ctx):\n" +
+		"    [ctx.add_x(ctx, \"fixed\", n) for n in [\"a\", \"b\", \"c\"]]\n" +
+		"    [ctx.add_y(ctx, n) for n in [\"d\"]]\n" +
+		"    [ctx.add_ctx(ctx, ctx_) for ctx_ in [\"f\"]]\n" +
+		"    return ctx\n"
+	if diff := cmp.Diff(expected, b.String()); diff != "" {
+		t.Error("Unexpected writer output:\n", diff)
+	}
+}
+
+func TestAssignmentWriting(t *testing.T) {
+	var b strings.Builder
+	writer := NewStarlarkWriter(&b)
+	if err := writer.BeginMacro("hello_world"); err != nil {
+		t.Fatal("Unexpected error writing macro: ", err)
+	}
+	if err := writer.WriteAssignment("SCALAR", "value"); err != nil {
+		t.Fatal("Unpexected error writing assignment: ", err)
+	}
+	if err := writer.WriteAssignment("LIST", []string{"a", "b"}); err != nil {
+		t.Fatal("Unpexected error writing assignment: ", err)
+	}
+	if err := writer.WriteAssignment("None", "value"); err != nil {
+		t.Fatal("Unpexected error writing assignment: ", err)
+	}
+	if err := writer.WriteAssignment("not valid", "value"); err == nil {
+		t.Error("Invalid variable name accepted")
+	}
+	if err := writer.EndMacro(); err != nil {
+		t.Fatal("Unpexpected error ending macro: ", err)
+	}
+	expected := "def hello_world(ctx):\n" +
+		"    SCALAR = \"value\"\n" +
+		"    LIST = [\"a\", \"b\"]\n" +
+		"    None_ = \"value\"\n" +
+		"    return ctx\n"
+	if diff := cmp.Diff(expected, b.String()); diff != "" {
+		t.Error("Unexpected writer output:\n", diff)
+	}
+}
+
+func TestCommentWriting(t *testing.T) {
+	var b strings.Builder
+	writer := NewStarlarkWriter(&b)
+	if err := writer.BeginMacro("hello_world"); err != nil {
+		t.Fatal("Unexpected error writing macro: ", err)
+	}
+	if err := writer.PushDirectory("dir"); err != nil {
+		t.Fatal("Unpexpected error entering directory: ", err)
+	}
+	if err := writer.WriteComment("first\n\nlast"); err != nil {
+		t.Fatal("Unpexected error writing comment: ", err)
+	}
+	if _, err := writer.PopDirectory(); err != nil {
+		t.Fatal("Unpexpected error exiting directory: ", err)
+	}
+	if err := writer.EndMacro(); err != nil {
+		t.Fatal("Unpexpected error ending macro: ", err)
+	}
+	expected := "def hello_world(ctx):\n" +
+		"    ctx = ctx.push_directory(ctx, \"dir\")\n" +
+		"    # first\n" +
+		"    #\n" +
+		"    # last\n" +
+		"    ctx = ctx.pop_directory(ctx)\n" +
+		"    return ctx\n"
+	if diff := cmp.Diff(expected, b.String()); diff != "" {
+		t.Error("Unexpected writer output:\n", diff)
+	}
+}
+
 func TestInvalidMacroName(t *testing.T) {
 	var b strings.Builder
 	writer := NewStarlarkWriter(&b)